@@ -0,0 +1,63 @@
+//
+// Copyright (c) 2024 Markku Rossi
+//
+// All rights reserved.
+//
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+
+	"github.com/markkurossi/shades/db"
+)
+
+func main() {
+	network := flag.String("n", "tcp", "network: tcp or unix")
+	address := flag.String("a", "localhost:8485", "listen address")
+	segment := flag.Int64("s", 0,
+		"segment size; the storage is a segmented device directory")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(),
+			"Usage: %s [options] storage\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "Options:\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if len(flag.Args()) != 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	err := run(*network, *address, *segment, flag.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func run(network, address string, segment int64, storage string) error {
+	var device db.Device
+	var err error
+	if segment > 0 {
+		device, err = db.OpenSegmentedDevice(storage, segment, false)
+	} else {
+		device, err = db.OpenFileDevice(storage, os.O_RDWR|os.O_CREATE)
+	}
+	if err != nil {
+		return err
+	}
+	defer device.Close()
+
+	l, err := net.Listen(network, address)
+	if err != nil {
+		return err
+	}
+	log.Printf("serving %s on %s", storage, l.Addr())
+
+	return db.ServeDevice(l, device)
+}
@@ -0,0 +1,121 @@
+//
+// Copyright (c) 2024 Markku Rossi
+//
+// All rights reserved.
+//
+
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/markkurossi/shades/db"
+)
+
+var commands = map[string]func(params db.Params, file string) error{
+	"info":    cmdInfo,
+	"recover": cmdRecover,
+	"upgrade": cmdUpgrade,
+}
+
+func main() {
+	pageSize := flag.Int("p", 0, "page size for recovering without root block")
+	key := flag.String("k", "", "authentication key in hex")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(),
+			"Usage: %s [options] command file\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "Commands:\n")
+		for name := range commands {
+			fmt.Fprintf(flag.CommandLine.Output(), "  %s\n", name)
+		}
+		fmt.Fprintf(flag.CommandLine.Output(), "Options:\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if len(flag.Args()) != 2 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		log.Fatalf("unknown command: %s", flag.Arg(0))
+	}
+
+	params := db.NewParams()
+	if *pageSize > 0 {
+		params.PageSize = *pageSize
+	}
+	if len(*key) > 0 {
+		k, err := hex.DecodeString(*key)
+		if err != nil {
+			log.Fatalf("invalid key: %s", err)
+		}
+		params.AuthKey = k
+	}
+
+	err := cmd(params, flag.Arg(1))
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func cmdInfo(params db.Params, file string) error {
+	f, err := db.OpenFileDevice(file, os.O_RDONLY)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	params.ReadOnly = true
+	d, err := db.Open(params, f)
+	if err != nil {
+		return err
+	}
+	fmt.Println(d.Root())
+	return nil
+}
+
+func cmdRecover(params db.Params, file string) error {
+	f, err := db.OpenFileDevice(file, os.O_RDWR)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	d, err := db.Recover(params, f)
+	if err != nil {
+		return err
+	}
+	fmt.Println(d.Root())
+	return nil
+}
+
+func cmdUpgrade(params db.Params, file string) error {
+	f, err := db.OpenFileDevice(file, os.O_RDWR)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	d, err := db.Open(params, f)
+	if err != nil {
+		return err
+	}
+	version := d.Root().Version
+	upgraded, err := d.Upgrade()
+	if err != nil {
+		return err
+	}
+	if upgraded {
+		fmt.Printf("upgraded format version %v to %v\n",
+			version, d.Root().Version)
+	} else {
+		fmt.Printf("format version %v is current\n", version)
+	}
+	return nil
+}
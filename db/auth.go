@@ -0,0 +1,167 @@
+//
+// Copyright (c) 2024 Markku Rossi
+//
+// All rights reserved.
+//
+
+package db
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/markkurossi/shades/crypto"
+)
+
+// MACSize defines the size of the page MACs in bytes.
+const MACSize = 16
+
+// newAuthPRFs derives the root pointer and page MAC functions from
+// the authentication key.
+func newAuthPRFs(key []byte) (*crypto.PRF, *crypto.PRF, error) {
+	prf, err := crypto.NewPRF(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	rootKey := prf.Int(0, nil)
+	pageKey := prf.Int(1, nil)
+
+	root, err := crypto.NewPRF(rootKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	page, err := crypto.NewPRF(pageKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return root, page, nil
+}
+
+// macPage computes the MAC of the page data.
+func (pt *PageTable) macPage(data []byte) [MACSize]byte {
+	var mac [MACSize]byte
+	pt.mac.Data(data, mac[:0])
+	return mac
+}
+
+// verify verifies the page ref against the MAC. The pages created in
+// the transaction tr are not yet authenticated by the page table and
+// they are verified against the MACs computed when they were flushed
+// to the device before the commit.
+func (pt *PageTable) verify(tr *BaseTransaction, ref *PageRef,
+	mac []byte) error {
+
+	if ref.verified {
+		return nil
+	}
+	if pt.mac == nil {
+		return fmt.Errorf("authenticated database requires AuthKey")
+	}
+	if tr != nil {
+		_, ok := tr.writable[ref.pid]
+		if ok {
+			flushed := pt.flushed[ref.pid]
+			mac = flushed[:]
+		}
+	}
+	computed := pt.macPage(ref.Read())
+	if !bytes.Equal(computed[:], mac) {
+		return fmt.Errorf("page %v: MAC verification failed", ref.pid)
+	}
+	ref.verified = true
+	return nil
+}
+
+// flushedPage records the MAC of the page ref, which was written to
+// the device. The MACs verify the uncommitted pages that are read
+// back from the device.
+func (pt *PageTable) flushedPage(ref *PageRef) {
+	if pt.mac == nil || ref.pid == RootBlock {
+		return
+	}
+	pt.flushed[ref.pid] = pt.macPage(ref.Read())
+}
+
+// forgetFlushed removes the recorded MACs of the pages of the
+// transaction tr, which has ended.
+func (pt *PageTable) forgetFlushed(tr *BaseTransaction) {
+	if len(pt.concurrent) == 0 {
+		clear(pt.flushed)
+		return
+	}
+	for pid := range tr.writable {
+		delete(pt.flushed, pid)
+	}
+}
+
+// authenticate updates the MACs of the page table entries that refer
+// to pages created in the transaction, and the page table root MAC.
+func (pt *PageTable) authenticate(tr *BaseTransaction) error {
+	root := pt.root1.PageTable
+	_, ok := tr.writable[root]
+	if !ok {
+		return nil
+	}
+	mac, err := pt.authenticateTable(tr, root, int(pt.root1.Depth))
+	if err != nil {
+		return err
+	}
+	pt.root1.PageTableMAC = mac
+	return nil
+}
+
+func (pt *PageTable) authenticateTable(tr *BaseTransaction, pid PhysicalID,
+	depth int) ([MACSize]byte, error) {
+
+	ref, err := pt.db.cache.Get(pid)
+	if err != nil {
+		return [MACSize]byte{}, err
+	}
+	defer ref.release()
+	err = pt.verify(tr, ref, nil)
+	if err != nil {
+		return [MACSize]byte{}, err
+	}
+
+	entrySize := pt.root1.entrySize()
+	buf := ref.Data()
+
+	for i := 0; i < pt.root1.idsPerPage(); i++ {
+		ofs := i * entrySize
+		child := PhysicalID(bo.Uint64(buf[ofs:]))
+		if child.Pagenum() == 0 {
+			continue
+		}
+		_, ok := tr.writable[child]
+		if !ok {
+			continue
+		}
+		var mac [MACSize]byte
+		if depth > 0 {
+			mac, err = pt.authenticateTable(tr, child, depth-1)
+		} else {
+			mac, err = pt.authenticatePage(tr, child)
+		}
+		if err != nil {
+			return mac, err
+		}
+		copy(buf[ofs+8:], mac[:])
+	}
+	return pt.macPage(buf), nil
+}
+
+func (pt *PageTable) authenticatePage(tr *BaseTransaction, pid PhysicalID) (
+	[MACSize]byte, error) {
+
+	ref, err := pt.db.cache.Get(pid)
+	if err != nil {
+		return [MACSize]byte{}, err
+	}
+	defer ref.release()
+
+	err = pt.verify(tr, ref, nil)
+	if err != nil {
+		return [MACSize]byte{}, err
+	}
+	return pt.macPage(ref.Read()), nil
+}
@@ -0,0 +1,185 @@
+//
+// Copyright (c) 2024 Markku Rossi
+//
+// All rights reserved.
+//
+
+package db
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestAuthenticated(t *testing.T) {
+	params := NewParams()
+	params.PageSize = 1024
+	params.AuthKey = []byte("0123456789abcdef")
+
+	device := NewMemDevice(1024 * 1024)
+	db, err := Create(params, device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := writeTestPages(t, db, nil, 100, 1)
+	ids = append(ids, writeTestPages(t, db, ids[:1:1], 10, 2)[1:]...)
+	if db.pt.committed().Depth == 0 {
+		t.Fatalf("page table depth did not grow")
+	}
+
+	db, err = Open(params, device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyTestPages(t, db, ids[:1], 2)
+	verifyTestPages(t, db, ids[1:100], 1)
+	verifyTestPages(t, db, ids[100:], 2)
+
+	noKey := params
+	noKey.AuthKey = nil
+	_, err = Open(noKey, device)
+	if err == nil {
+		t.Errorf("Open succeeded without AuthKey")
+	}
+
+	// Modify a data page on the device.
+	db, err = Open(params, device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr, err := db.NewTransaction(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid, err := db.pt.get(tr, ids[50])
+	if err != nil {
+		t.Fatal(err)
+	}
+	device.buf[int(pid.Pagenum())*params.PageSize+100]++
+
+	_, err = tr.ReadablePage(ids[50])
+	if err == nil || !strings.Contains(err.Error(), "MAC") {
+		t.Errorf("modified page not detected: %v", err)
+	}
+	err = tr.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Modify the page table root.
+	root := db.pt.committed().PageTable
+	device.buf[int(root.Pagenum())*params.PageSize]++
+
+	db, err = Open(params, device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr, err = db.NewTransaction(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tr.ReadablePage(ids[1])
+	if err == nil || !strings.Contains(err.Error(), "MAC") {
+		t.Errorf("modified page table not detected: %v", err)
+	}
+}
+
+func TestAuthenticatedTLB(t *testing.T) {
+	params := NewParams()
+	params.PageSize = 1024
+	params.AuthKey = []byte("0123456789abcdef")
+
+	device := NewMemDevice(1024 * 1024)
+	db, err := Create(params, device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := writeTestPages(t, db, nil, 100, 1)
+
+	db, err = Open(params, device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyTestPages(t, db, ids, 1)
+
+	// The cached translations verify the pages without the page
+	// table.
+	db.cache.purge()
+	root := db.pt.committed().PageTable
+	device.buf[int(root.Pagenum())*params.PageSize]++
+
+	verifyTestPages(t, db, ids, 1)
+}
+
+func TestAuthenticatedEvicted(t *testing.T) {
+	params := NewParams()
+	params.PageSize = 1024
+	params.AuthKey = []byte("0123456789abcdef")
+
+	device := NewMemDevice(1024 * 1024)
+	db, err := Create(params, device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr, err := db.NewTransaction(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, id, err := tr.NewPage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref.Data()[0] = 1
+	ref.Release()
+
+	// Evict the writable page and modify it on the device.
+	err = db.cache.flush(func(pid PhysicalID) bool {
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.cache.purge()
+	pid, err := db.pt.get(tr, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	device.buf[int(pid.Pagenum())*params.PageSize+100]++
+
+	_, err = tr.ReadablePage(id)
+	if err == nil || !strings.Contains(err.Error(), "MAC") {
+		t.Errorf("modified writable page not detected: %v", err)
+	}
+	err = tr.Commit()
+	if err == nil || !strings.Contains(err.Error(), "MAC") {
+		t.Errorf("modified writable page committed: %v", err)
+	}
+}
+
+func TestAuthenticatedRollback(t *testing.T) {
+	params := NewParams()
+	params.PageSize = 1024
+	params.AuthKey = []byte("0123456789abcdef")
+
+	device := NewMemDevice(1024 * 1024)
+	db, err := Create(params, device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestPages(t, db, nil, 10, 1)
+	old := NewMemDevice(len(device.buf))
+	copy(old.buf, device.buf)
+
+	writeTestPages(t, db, nil, 10, 2)
+	params.AuthGeneration = uint64(db.pt.committed().Generation)
+
+	_, err = Open(params, device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Open(params, old)
+	if !errors.Is(err, ErrRollback) {
+		t.Errorf("rolled back device not detected: %v", err)
+	}
+}
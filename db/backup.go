@@ -0,0 +1,249 @@
+//
+// Copyright (c) 2024 Markku Rossi
+//
+// All rights reserved.
+//
+
+package db
+
+import (
+	"fmt"
+)
+
+// Backup copies the latest committed database generation into the
+// device dst. The backup pins the committed root pointer and copies
+// only the pages reachable from it so the writers can continue
+// committing new generations while the backup is running.
+func (db *DB) Backup(dst Device) error {
+	err := db.flushPending()
+	if err != nil {
+		return err
+	}
+	return copyGeneration(db.params, db.device, dst, db.pt.committed(),
+		RootPointer{})
+}
+
+// BackupSince makes an incremental backup into the device dst, which
+// must hold a backup of the database generation. The generation must
+// be the latest committed generation or it must be retained in the
+// root history. Only the physical pages that are not part of the
+// generation are copied.
+func (db *DB) BackupSince(dst Device, generation uint64) error {
+	base, err := readRoot(db.params, dst)
+	if err != nil {
+		return err
+	}
+	if base.Generation != generation {
+		return fmt.Errorf("backup generation mismatch: got %v, expected %v",
+			base.Generation, generation)
+	}
+	err = db.flushPending()
+	if err != nil {
+		return err
+	}
+	root := db.pt.committed()
+	if base.PageSize != root.PageSize {
+		return fmt.Errorf("backup page size mismatch: got %v, expected %v",
+			base.PageSize, root.PageSize)
+	}
+	if base.Generation > root.Generation {
+		return fmt.Errorf("backup generation %v is newer than database",
+			base.Generation)
+	}
+	retained, err := db.pt.rootAt(generation)
+	if err != nil {
+		return err
+	}
+	if !retained.sameGeneration(base) {
+		return fmt.Errorf("backup does not hold generation %v of the database",
+			generation)
+	}
+	return copyGeneration(db.params, db.device, dst, root, retained)
+}
+
+// Restore restores the database backup from the device src into the
+// device dst and opens the restored database.
+func Restore(params Params, src, dst Device) (*DB, error) {
+	root, err := readRoot(params, src)
+	if err != nil {
+		return nil, err
+	}
+	err = copyGeneration(params, src, dst, root, RootPointer{})
+	if err != nil {
+		return nil, err
+	}
+	return Open(params, dst)
+}
+
+// copyGeneration copies the database generation, identified by the
+// root pointer, from the device src to the device dst. The physical
+// pages of the generation base are already in dst and they are not
+// copied.
+func copyGeneration(params Params, src, dst Device, root,
+	base RootPointer) error {
+	err := walkPages(src, root, base,
+		func(pid PhysicalID, data []byte) error {
+			off, _ := physicalRange(pid, int(root.PageSize))
+			_, err := dst.WriteAt(data, off)
+			return err
+		})
+	if err != nil {
+		return err
+	}
+	err = dst.Sync()
+	if err != nil {
+		return err
+	}
+
+	params.PageSize = int(root.PageSize)
+	pt, err := NewPageTable(&DB{
+		params: params,
+	})
+	if err != nil {
+		return err
+	}
+	// The root history refers to pages that are not copied.
+	root.Snapshots = 0
+
+	buf := make([]byte, root.PageSize)
+	pt.formatRootBlock(&root, buf)
+
+	_, err = dst.WriteAt(buf, 0)
+	if err != nil {
+		return err
+	}
+	return dst.Sync()
+}
+
+// walkPages calls the function fn for all page table and data pages
+// reachable from the root pointer, which are not reachable from the
+// root pointer base. The pages are read directly from the device. The
+// page tables of the generations are compared position by position
+// and, since committed pages are never modified, the subtrees that
+// share the same physical page are skipped. The zero base selects all
+// pages.
+func walkPages(device Device, root, base RootPointer,
+	fn func(pid PhysicalID, data []byte) error) error {
+
+	data := func(pid, basePid PhysicalID) error {
+		if pid == basePid {
+			return nil
+		}
+		data, err := readPhysical(device, int(root.PageSize), pid)
+		if err != nil {
+			return err
+		}
+		return fn(pid, data)
+	}
+	err := walkPageTable(device, root, root.PageTable, int(root.Depth),
+		base.PageTable, int(base.Depth), fn, data)
+	if err != nil || root.Objects == 0 {
+		return err
+	}
+
+	// The leaves of the object directory are object page tables.
+	dir, depth := root.Objects.treeRoot()
+	baseDir, baseDepth := base.Objects.treeRoot()
+	return walkPageTable(device, root, dir, depth, baseDir, baseDepth, fn,
+		func(pid, basePid PhysicalID) error {
+			table, depth := pid.treeRoot()
+			baseTable, baseDepth := basePid.treeRoot()
+			return walkPageTable(device, root, table, depth,
+				baseTable, baseDepth, fn, data)
+		})
+}
+
+// walkPageTable calls the function fn for the page table pages of the
+// tree rooted at pid and the function leaf for the tree entries,
+// which are not part of the tree rooted at base. The leaf function
+// receives the entry and the entry of the same key in the base tree.
+// The shallower tree maps only the first subtree of the deeper tree.
+func walkPageTable(device Device, root RootPointer, pid PhysicalID,
+	depth int, base PhysicalID, baseDepth int,
+	fn func(pid PhysicalID, data []byte) error,
+	leaf func(pid, base PhysicalID) error) error {
+
+	if pid == base && depth == baseDepth {
+		return nil
+	}
+	if baseDepth > depth {
+		entries, err := tableEntries(device, root, base)
+		if err != nil {
+			return err
+		}
+		return walkPageTable(device, root, pid, depth, entries[0],
+			baseDepth-1, fn, leaf)
+	}
+	data, err := readPhysical(device, int(root.PageSize), pid)
+	if err != nil {
+		return err
+	}
+	err = fn(pid, data)
+	if err != nil {
+		return err
+	}
+	var baseEntries []PhysicalID
+	if baseDepth == depth {
+		baseEntries, err = tableEntries(device, root, base)
+		if err != nil {
+			return err
+		}
+	}
+	for i := 0; i < root.idsPerPage(); i++ {
+		child := PhysicalID(bo.Uint64(data[i*root.entrySize():]))
+		if child.Pagenum() == 0 {
+			continue
+		}
+		var baseChild PhysicalID
+		childBaseDepth := depth - 1
+		if baseEntries != nil {
+			baseChild = baseEntries[i]
+		} else if i == 0 {
+			baseChild = base
+			childBaseDepth = baseDepth
+		}
+		if depth > 0 {
+			err = walkPageTable(device, root, child, depth-1,
+				baseChild, childBaseDepth, fn, leaf)
+		} else {
+			err = leaf(child, baseChild)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tableEntries returns the entries of the page table page pid. The
+// zero page ID is an empty page table page.
+func tableEntries(device Device, root RootPointer, pid PhysicalID) (
+	[]PhysicalID, error) {
+
+	result := make([]PhysicalID, root.idsPerPage())
+	if pid.Pagenum() == 0 {
+		return result, nil
+	}
+	data, err := readPhysical(device, int(root.PageSize), pid)
+	if err != nil {
+		return nil, err
+	}
+	for i := range result {
+		result[i] = PhysicalID(bo.Uint64(data[i*root.entrySize():]))
+	}
+	return result, nil
+}
+
+// readPhysical reads the raw data of the physical page pid from the
+// device.
+func readPhysical(device Device, pageSize int, pid PhysicalID) (
+	[]byte, error) {
+
+	off, size := physicalRange(pid, pageSize)
+	buf := make([]byte, size)
+	_, err := device.ReadAt(buf, off)
+	if err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
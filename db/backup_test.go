@@ -0,0 +1,201 @@
+//
+// Copyright (c) 2024 Markku Rossi
+//
+// All rights reserved.
+//
+
+package db
+
+import (
+	"testing"
+)
+
+func writeTestPages(t testing.TB, db *DB, ids []LogicalID, count int,
+	value byte) []LogicalID {
+
+	tr, err := db.NewTransaction(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range ids {
+		ref, err := tr.WritablePage(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := ref.Data()
+		for i := 8; i < len(buf); i++ {
+			buf[i] = value
+		}
+		ref.Release()
+	}
+	for i := 0; i < count; i++ {
+		ref, id, err := tr.NewPage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := ref.Data()
+		bo.PutUint64(buf, uint64(id))
+		for i := 8; i < len(buf); i++ {
+			buf[i] = value
+		}
+		ref.Release()
+		ids = append(ids, id)
+	}
+	err = tr.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ids
+}
+
+func verifyTestPages(t *testing.T, db *DB, ids []LogicalID, value byte) {
+	tr, err := db.NewTransaction(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range ids {
+		ref, err := tr.ReadablePage(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := ref.Read()
+		if bo.Uint64(buf) != uint64(id) {
+			t.Errorf("page %v: invalid ID %v", id, bo.Uint64(buf))
+		}
+		for i := 8; i < len(buf); i++ {
+			if buf[i] != value {
+				t.Fatalf("page %v: data[%v]=%v, expected %v",
+					id, i, buf[i], value)
+			}
+		}
+		ref.Release()
+	}
+	err = tr.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBackup(t *testing.T) {
+	params := NewParams()
+	params.PageSize = 1024
+
+	db, err := Create(params, NewMemDevice(1024*1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := writeTestPages(t, db, nil, 100, 1)
+
+	backup := &recordingDevice{
+		MemDevice: NewMemDevice(1024 * 1024),
+	}
+	err = db.Backup(backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	full := len(backup.writes)
+	gen := db.pt.committed().Generation
+
+	updated := writeTestPages(t, db, ids[:1:1], 10, 2)
+
+	backup.writes = nil
+	err = db.BackupSince(backup, gen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backup.writes) >= full {
+		t.Errorf("incremental backup wrote %v pages, full backup %v",
+			len(backup.writes), full)
+	}
+	err = db.BackupSince(backup, gen)
+	if err == nil {
+		t.Errorf("incremental backup from wrong generation succeeded")
+	}
+
+	restored, err := Restore(params, backup, NewMemDevice(1024*1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyTestPages(t, restored, ids[1:], 1)
+	verifyTestPages(t, restored, updated, 2)
+}
+
+func TestBackupConcurrent(t *testing.T) {
+	params := NewParams()
+	params.PageSize = 1024
+
+	db, err := Create(params, NewMemDevice(1024*1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := writeTestPages(t, db, nil, 100, 1)
+
+	// The transaction committing after the backup allocates its
+	// pages before the backup generation.
+	tr1, err := db.NewConcurrentTransaction()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr2, err := db.NewConcurrentTransaction()
+	if err != nil {
+		t.Fatal(err)
+	}
+	updatePage(t, tr1, ids[0], 2)
+	updatePage(t, tr2, ids[99], 3)
+	err = tr2.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backup := NewMemDevice(1024 * 1024)
+	err = db.Backup(backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gen := db.Root().Generation
+
+	err = tr1.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.BackupSince(backup, gen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored, err := Restore(params, backup, NewMemDevice(1024*1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyTestPages(t, restored, ids[1:99], 1)
+	verifyTestPages(t, restored, ids[:1], 2)
+	verifyTestPages(t, restored, ids[99:], 3)
+}
+
+func TestBackupSinceOtherDatabase(t *testing.T) {
+	params := NewParams()
+	params.PageSize = 1024
+
+	a, err := Create(params, NewMemDevice(1024*1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := Create(params, NewMemDevice(1024*1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestPages(t, a, nil, 10, 1)
+	writeTestPages(t, b, nil, 10, 2)
+	gen := a.Root().Generation
+	if b.Root().Generation != gen {
+		t.Fatalf("generations differ: %v, %v", gen, b.Root().Generation)
+	}
+	backup := NewMemDevice(1024 * 1024)
+	err = b.Backup(backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = a.BackupSince(backup, gen)
+	if err == nil {
+		t.Errorf("incremental backup onto other database succeeded")
+	}
+}
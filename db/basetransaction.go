@@ -7,6 +7,7 @@
 package db
 
 import (
+	"errors"
 	"fmt"
 )
 
@@ -15,11 +16,35 @@ type BaseTransaction struct {
 	cache    *Cache
 	pt       *PageTable
 	rw       bool
+	root     *RootPointer
 	writable map[PhysicalID]PhysicalID
+	written  map[LogicalID]PhysicalID
+
+	// The nonce of the page headers written in the transaction.
+	nonce uint64
+
+	// Concurrent transaction state.
+	concurrent bool
+	start      RootPointer
+	reads      map[LogicalID]bool
+
+	// Objects dropped in the transaction.
+	dropped []uint16
+
+	// Page references handed out in debug mode.
+	pins map[*PageRef]bool
+
+	// Sequential read detection.
+	lastRead  LogicalID
+	seqReads  int
+	readAhead LogicalID
 }
 
 // NewPage allocates a new page.
 func (tr *BaseTransaction) NewPage() (*PageRef, LogicalID, error) {
+	tr.pt.db.m.Lock()
+	defer tr.pt.db.m.Unlock()
+
 	if !tr.rw {
 		return nil, 0, fmt.Errorf("read-only transaction")
 	}
@@ -27,53 +52,168 @@ func (tr *BaseTransaction) NewPage() (*PageRef, LogicalID, error) {
 	if err != nil {
 		return nil, 0, err
 	}
+	ref, id, err := tr.newPage(id)
+	if err != nil {
+		return nil, 0, err
+	}
+	return tr.track(ref, false), id, nil
+}
+
+// newPage allocates a new physical page for the new logical page id.
+func (tr *BaseTransaction) newPage(id LogicalID) (
+	*PageRef, LogicalID, error) {
+
 	pid, err := tr.pt.allocPhysicalID()
 	if err != nil {
 		tr.pt.freeLogicalID(id)
 		return nil, 0, err
 	}
-	err = tr.pt.set(tr, id, pid)
+	ref, err := tr.cache.New(pid, nil)
 	if err != nil {
 		tr.pt.freePhysicalID(pid)
 		tr.pt.freeLogicalID(id)
 		return nil, 0, err
 	}
-	tr.writable[pid] = 0
-
-	ref, err := tr.cache.New(pid, nil)
+	err = tr.pt.set(tr, id, pid)
 	if err != nil {
-		delete(tr.writable, pid)
 		tr.pt.freePhysicalID(pid)
 		tr.pt.freeLogicalID(id)
+		ref.release()
 		return nil, 0, err
 	}
+	tr.writable[pid] = 0
+	ref.label(tr, PageTypeData, id)
+	tr.written[id] = pid
 
 	return ref, id, nil
 }
 
 // ReadablePage returns a read-only reference to the page id.
 func (tr *BaseTransaction) ReadablePage(id LogicalID) (*PageRef, error) {
-	pid, err := tr.pt.get(tr, id)
+	tr.pt.db.m.Lock()
+	defer tr.pt.db.m.Unlock()
+
+	ref, pid, err := tr.page(id)
 	if err != nil {
 		return nil, err
 	}
-	return tr.cache.Get(pid)
+	_, writable := tr.writable[pid]
+	tr.detectSequential(id)
+	return tr.track(ref, !writable), nil
+}
+
+// page returns a reference to the current physical page of the
+// logical page id. In authenticated databases, the page is verified
+// against its MAC when it is loaded from the device.
+func (tr *BaseTransaction) page(id LogicalID) (*PageRef, PhysicalID, error) {
+	if tr.reads != nil {
+		tr.reads[id] = true
+	}
+	pid, mac, err := tr.pt.translate(tr, id)
+	if err != nil {
+		return nil, 0, err
+	}
+	ref, err := tr.cache.Get(pid)
+	if err != nil {
+		return nil, 0, err
+	}
+	if ref.verified || !tr.pt.rootFor(tr).authenticated() {
+		return ref, pid, nil
+	}
+	err = tr.pt.verify(tr, ref, mac)
+	if err != nil {
+		ref.release()
+		return nil, 0, err
+	}
+	return ref, pid, nil
+}
+
+// Prefetch hints that the pages ids will be accessed soon. The pages
+// are read into the cache concurrently in the background.
+func (tr *BaseTransaction) Prefetch(ids []LogicalID) error {
+	tr.pt.db.m.Lock()
+	defer tr.pt.db.m.Unlock()
+
+	var pids []PhysicalID
+	for _, id := range ids {
+		pid, err := tr.pt.get(tr, id)
+		if err != nil {
+			return err
+		}
+		pids = append(pids, pid)
+	}
+	tr.cache.Prefetch(pids)
+	return nil
+}
+
+// detectSequential tracks the read access pattern and starts
+// read-ahead when the transaction reads consecutive logical pages.
+func (tr *BaseTransaction) detectSequential(id LogicalID) {
+	count := tr.cache.db.params.ReadAhead
+	if count <= 0 {
+		return
+	}
+	if id == tr.lastRead+1 {
+		tr.seqReads++
+	} else {
+		tr.seqReads = 0
+		tr.readAhead = id
+	}
+	tr.lastRead = id
+
+	if tr.seqReads < 2 || tr.readAhead > id+LogicalID(count/2) {
+		return
+	}
+	start := tr.readAhead + 1
+	if start <= id {
+		start = id + 1
+	}
+	end := id + LogicalID(count)
+	limit := ^LogicalID(0)
+	root := tr.pt.rootFor(tr)
+	if root.objectID(id) == 0 {
+		limit = NewLogicalID(id.Meta(), id.ObjectID(),
+			uint64(root.NextLogical))
+	}
+
+	var pids []PhysicalID
+	for next := start; next <= end && next < limit; next++ {
+		pid, err := tr.pt.get(tr, next)
+		if err != nil {
+			break
+		}
+		pids = append(pids, pid)
+	}
+	tr.readAhead = end
+	tr.cache.Prefetch(pids)
 }
 
 // WritablePage returns a writable reference to the page id.
 func (tr *BaseTransaction) WritablePage(id LogicalID) (*PageRef, error) {
+	tr.pt.db.m.Lock()
+	defer tr.pt.db.m.Unlock()
+
+	ref, err := tr.writablePage(id)
+	if err != nil {
+		return nil, err
+	}
+	return tr.track(ref, false), nil
+}
+
+func (tr *BaseTransaction) writablePage(id LogicalID) (*PageRef, error) {
 	if !tr.rw {
 		return nil, fmt.Errorf("read-only transaction")
 	}
-	pid, err := tr.pt.get(tr, id)
+	oldRef, pid, err := tr.page(id)
 	if err != nil {
 		return nil, err
 	}
 	_, writable := tr.writable[pid]
 	if writable {
 		// The page is writable in this transaction.
-		return tr.cache.Get(pid)
+		return oldRef, nil
 	}
+	defer oldRef.release()
 
 	// Make page writable.
 
@@ -81,35 +221,80 @@ func (tr *BaseTransaction) WritablePage(id LogicalID) (*PageRef, error) {
 	if err != nil {
 		return nil, err
 	}
-	oldRef, err := tr.cache.Get(pid)
-	if err != nil {
-		tr.pt.freePhysicalID(newPid)
-		return nil, err
-	}
-	defer oldRef.Release()
 
 	newRef, err := tr.cache.New(newPid, oldRef.Read())
 	if err != nil {
 		tr.pt.freePhysicalID(newPid)
 		return nil, err
 	}
+	newRef.label(tr, PageTypeData, id)
 	err = tr.pt.set(tr, id, newPid)
 	if err != nil {
 		tr.pt.freePhysicalID(newPid)
-		newRef.Release()
+		newRef.release()
 		return nil, err
 	}
 	tr.writable[newPid] = pid
+	tr.written[id] = newPid
 
 	return newRef, nil
 }
 
-// Commit commits the transaction.
+// Commit commits the transaction. The read-write transactions run
+// the database commit hooks before committing and deliver a commit
+// event to the database subscribers after a successful commit. The
+// transaction is aborted if the commit fails.
 func (tr *BaseTransaction) Commit() error {
-	return tr.pt.commit(tr)
+	db := tr.pt.db
+	if tr.rw {
+		db.m.Lock()
+		hooks := db.hooks
+		db.m.Unlock()
+
+		for _, hook := range hooks {
+			err := hook(tr)
+			if err != nil {
+				abortErr := tr.Abort()
+				if abortErr != nil {
+					return errors.Join(err, abortErr)
+				}
+				return err
+			}
+		}
+	}
+	db.m.Lock()
+	if db.params.Debug {
+		err := db.checkPinned(tr)
+		if err != nil {
+			tr.pt.abort(tr)
+			db.m.Unlock()
+			return err
+		}
+	}
+	err := tr.pt.commit(tr)
+	if err != nil {
+		tr.pt.abort(tr)
+		db.m.Unlock()
+		return err
+	}
+	if tr.rw {
+		tr.pt.forgetFlushed(tr)
+		db.notify(tr)
+	}
+	db.m.Unlock()
+	return nil
 }
 
-// Abort aborts the transaction.
+// Abort aborts the transaction. In the debug mode, Abort returns an
+// error if the transaction has pinned pages.
 func (tr *BaseTransaction) Abort() error {
-	return tr.pt.abort(tr)
+	db := tr.pt.db
+	db.m.Lock()
+	defer db.m.Unlock()
+
+	var err error
+	if db.params.Debug {
+		err = db.checkPinned(tr)
+	}
+	return errors.Join(err, tr.pt.abort(tr))
 }
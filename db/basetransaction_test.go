@@ -35,9 +35,13 @@ func TestTrBasic(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	_, err = db.NewTransaction(false)
-	if err == nil {
-		t.Fatal("concurrent base transaction allowed")
+	tr2, err := db.NewTransaction(false)
+	if err != nil {
+		t.Fatalf("concurrent read-only transaction: %v", err)
+	}
+	err = tr2.Commit()
+	if err != nil {
+		t.Error(err)
 	}
 
 	_, _, err = tr.NewPage()
@@ -54,6 +58,10 @@ func TestTrBasic(t *testing.T) {
 		if err != nil {
 			t.Fatal(err)
 		}
+		_, err = db.NewTransaction(true)
+		if err == nil {
+			t.Fatal("concurrent base transaction allowed")
+		}
 		ref, id, err := tr.NewPage()
 		if err != nil {
 			t.Fatal(err)
@@ -100,3 +108,72 @@ func TestTrBasic(t *testing.T) {
 		}
 	}
 }
+
+func TestTrPrefetch(t *testing.T) {
+	params := NewParams()
+	params.PageSize = 1024
+	params.ReadAhead = 8
+
+	device := NewMemDevice(1024 * 1024)
+	db, err := Create(params, device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr, err := db.NewTransaction(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []LogicalID
+	for i := 0; i < 64; i++ {
+		ref, id, err := tr.NewPage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		bo.PutUint64(ref.Data(), uint64(id))
+		ref.Release()
+		ids = append(ids, id)
+	}
+	err = tr.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Reopen the database so that the pages are not cached.
+	db, err = Open(params, device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr, err = db.NewTransaction(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tr.Prefetch(ids[:4])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, id := range ids {
+		ref, err := tr.ReadablePage(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bo.Uint64(ref.Read()) != uint64(id) {
+			t.Errorf("page %v: invalid data", id)
+		}
+		ref.Release()
+
+		if i == 4 {
+			pid, err := db.pt.get(tr, ids[i+1])
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, ok := db.cache.cached[pid]
+			if !ok {
+				t.Errorf("sequential read did not start read-ahead")
+			}
+		}
+	}
+	err = tr.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
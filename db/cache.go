@@ -8,6 +8,8 @@ package db
 
 import (
 	"fmt"
+	"sort"
+	"sync"
 )
 
 // Cache implements page cache.
@@ -21,9 +23,17 @@ type Cache struct {
 
 // NewCache creates a new cache for the database.
 func NewCache(db *DB) (*Cache, error) {
-	mem := 128 * 1024 * 1024
+	mem := db.params.CacheSize
+	if mem == 0 {
+		mem = DefaultCacheSize
+	}
 	pageSize := db.params.PageSize
 	numRefs := mem / pageSize
+	if numRefs < 1 {
+		return nil, fmt.Errorf("cache size %v smaller than page size %v",
+			mem, pageSize)
+	}
+	mem = numRefs * pageSize
 
 	cache := &Cache{
 		db:     db,
@@ -50,9 +60,21 @@ func (cache *Cache) Get(pid PhysicalID) (*PageRef, error) {
 		}
 		cache.cached[pid] = ref
 		ref.pid = pid
+		ref.pageType = PageTypeNone
 
 		err = ref.read()
 		if err != nil {
+			delete(cache.cached, pid)
+			ref.pid = 0
+			return nil, err
+		}
+	} else if ref.done != nil {
+		// Wait for the prefetch to complete.
+		err = <-ref.done
+		ref.done = nil
+		if err != nil {
+			delete(cache.cached, pid)
+			ref.pid = 0
 			return nil, err
 		}
 	}
@@ -60,6 +82,7 @@ func (cache *Cache) Get(pid PhysicalID) (*PageRef, error) {
 		panic("cached PageRef has invalid PhysicalID")
 	}
 	ref.refcount++
+	ref.pin()
 
 	return ref, nil
 }
@@ -76,42 +99,264 @@ func (cache *Cache) New(pid PhysicalID, init []byte) (*PageRef, error) {
 	}
 	cache.cached[pid] = ref
 	ref.pid = pid
+	ref.pageType = PageTypeNone
 
 	n := copy(ref.data, init)
 	for i := n; i < len(ref.data); i++ {
 		ref.data[i] = 0
 	}
+	// The copied pages must be flushed even if they are not modified.
+	ref.dirty = init != nil
+	ref.verified = true
 	ref.refcount++
+	ref.pin()
 
 	return ref, nil
 }
 
-func (cache *Cache) flush() error {
-	for _, ref := range cache.cached {
-		err := ref.flush()
+// pinned returns the pinned page references in the cache. The root
+// block is pinned for the lifetime of the database and it is not
+// included in the result.
+func (cache *Cache) pinned() []*PageRef {
+	var result []*PageRef
+	for pid, ref := range cache.cached {
+		if pid != RootBlock && ref.refcount > 0 {
+			result = append(result, ref)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].pid < result[j].pid
+	})
+	return result
+}
+
+// Prefetch starts reading the physical pages into the cache. The
+// reads are executed concurrently in the background and Get waits
+// for the pending reads to complete. Prefetching is a hint and it
+// stops silently if the cache runs out of free page references.
+func (cache *Cache) Prefetch(pids []PhysicalID) {
+	for _, pid := range pids {
+		_, ok := cache.cached[pid]
+		if ok {
+			continue
+		}
+		ref, err := cache.newRef()
+		if err != nil {
+			return
+		}
+		cache.cached[pid] = ref
+		ref.pid = pid
+		ref.pageType = PageTypeNone
+		ref.done = make(chan error, 1)
+
+		go func(ref *PageRef) {
+			ref.done <- ref.read()
+		}(ref)
+	}
+}
+
+// flush writes all dirty pages, except the root block, to the
+// device. If the function flushable is not nil, only the pages for
+// which it returns true are written. The pages are written in the
+// physical page number order and consecutive pages are coalesced into
+// single writes.
+func (cache *Cache) flush(flushable func(pid PhysicalID) bool) error {
+	var dirty []*PageRef
+	for pid, ref := range cache.cached {
+		if pid == RootBlock || (flushable != nil && !flushable(pid)) {
+			continue
+		}
+		if ref.dirty {
+			dirty = append(dirty, ref)
+		}
+	}
+	for _, ref := range dirty {
+		ref.seal()
+	}
+	sort.Slice(dirty, func(i, j int) bool {
+		if dirty[i].pid.Pagenum() != dirty[j].pid.Pagenum() {
+			return dirty[i].pid.Pagenum() < dirty[j].pid.Pagenum()
+		}
+		return dirty[i].pid.Meta() < dirty[j].pid.Meta()
+	})
+
+	pageSize := cache.db.params.PageSize
+	maxRun := cache.db.params.MaxWriteSize / pageSize
+	if maxRun < 1 {
+		maxRun = 1
+	}
+
+	var runs [][]*PageRef
+	for i := 0; i < len(dirty); {
+		j := i + 1
+		for j < len(dirty) && j-i < maxRun &&
+			!dirty[j-1].pid.Compressed() && !dirty[j].pid.Compressed() &&
+			dirty[j].pid.Pagenum() == dirty[j-1].pid.Pagenum()+1 {
+			j++
+		}
+		runs = append(runs, dirty[i:j])
+		i = j
+	}
+
+	workers := cache.db.params.FlushWorkers
+	if workers > len(runs) {
+		workers = len(runs)
+	}
+	if workers < 2 {
+		var buf []byte
+		for _, run := range runs {
+			err := cache.writeRun(run, &buf)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	ch := make(chan []*PageRef)
+	errs := make([]error, workers)
+	var wg sync.WaitGroup
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(idx int) {
+			defer wg.Done()
+			var buf []byte
+			for run := range ch {
+				if errs[idx] != nil {
+					continue
+				}
+				errs[idx] = cache.writeRun(run, &buf)
+			}
+		}(i)
+	}
+	for _, run := range runs {
+		ch <- run
+	}
+	close(ch)
+	wg.Wait()
+
+	for _, err := range errs {
 		if err != nil {
 			return err
 		}
 	}
+	return nil
+}
 
+// writeRun writes the run of consecutive pages with a single device
+// write. The argument buf holds the caller's scratch buffer, which is
+// grown as needed.
+func (cache *Cache) writeRun(run []*PageRef, buf *[]byte) error {
+	if len(run) == 1 {
+		return run[0].flush()
+	}
+	pageSize := cache.db.params.PageSize
+	size := len(run) * pageSize
+	if len(*buf) < size {
+		*buf = make([]byte, size)
+	}
+	for i, ref := range run {
+		copy((*buf)[i*pageSize:], ref.data)
+	}
+	off := int64(run[0].pid.Pagenum() * uint64(pageSize))
+	_, err := cache.db.device.WriteAt((*buf)[:size], off)
+	if err != nil {
+		return err
+	}
+	for _, ref := range run {
+		ref.dirty = false
+		ref.db.pt.flushedPage(ref)
+	}
 	return nil
 }
 
+// drop removes the page from the cache without writing it to the
+// device.
+func (cache *Cache) drop(pid PhysicalID) {
+	ref, ok := cache.cached[pid]
+	if !ok {
+		return
+	}
+	ref.dirty = false
+	delete(cache.cached, pid)
+}
+
+// purge drops all unpinned pages, except the root block, from the
+// cache without writing them to the device.
+func (cache *Cache) purge() {
+	for pid, ref := range cache.cached {
+		if pid == RootBlock || ref.refcount > 0 || ref.done != nil {
+			continue
+		}
+		ref.dirty = false
+		delete(cache.cached, pid)
+	}
+}
+
+// rename changes the physical ID of the cached page from pid to
+// newPid.
+func (cache *Cache) rename(pid, newPid PhysicalID) error {
+	ref, ok := cache.cached[pid]
+	if !ok {
+		return fmt.Errorf("page %v is not cached", pid)
+	}
+	_, ok = cache.cached[newPid]
+	if ok {
+		return fmt.Errorf("page %v is not new", newPid)
+	}
+	delete(cache.cached, pid)
+	cache.cached[newPid] = ref
+	ref.pid = newPid
+	return nil
+}
+
+// pinnedDirty tests if the dirty page ref must be kept in the
+// cache. The read-only databases can't write the pages they replay
+// from the write-ahead log so the pages stay cached until the next
+// refresh.
+func (cache *Cache) pinnedDirty(ref *PageRef) bool {
+	return ref.dirty && cache.db.params.ReadOnly
+}
+
 func (cache *Cache) newRef() (*PageRef, error) {
 	start := cache.clock
 	for {
 		ref := &cache.lru[cache.clock]
-		if ref.refcount == 0 {
+		if ref.done != nil {
+			// Evict completed prefetches but skip pending ones.
+			select {
+			case <-ref.done:
+				ref.done = nil
+			default:
+			}
+		}
+		if ref.refcount == 0 && ref.done == nil && !cache.pinnedDirty(ref) {
+			if ref.poisoned {
+				// Poisoned refs are already flushed and uncached.
+				ref.checkPoison()
+				ref.pid = 0
+				ref.dirty = false
+			}
+			ref.stacks = nil
 			// Don't flush and uncache zero pids since they mark an
 			// unallocated page, but the zero pid is also used for the
 			// root pointer.
 			if ref.pid != 0 {
+				ref.seal()
 				err := ref.flush()
 				if err != nil {
 					return nil, err
 				}
-				delete(cache.cached, ref.pid)
+				if cache.cached[ref.pid] == ref {
+					delete(cache.cached, ref.pid)
+				}
 			}
+			// Advance the clock past the returned reference so that
+			// the next allocation does not evict it as soon as it is
+			// released.
+			cache.clock++
+			cache.clock %= len(cache.lru)
 			return ref, nil
 		}
 		cache.clock++
@@ -129,6 +374,18 @@ type PageRef struct {
 	data     []byte
 	refcount int32
 	dirty    bool
+	verified bool
+	done     chan error
+	pageType PageType
+	id       LogicalID
+	nonce    uint64
+
+	// Debug mode state.
+	shared   *PageRef
+	owner    *BaseTransaction
+	readOnly bool
+	poisoned bool
+	stacks   [][]uintptr
 }
 
 func (ref *PageRef) String() string {
@@ -138,14 +395,37 @@ func (ref *PageRef) String() string {
 
 // Release releases the page reference.
 func (ref *PageRef) Release() {
+	ref.db.m.Lock()
+	ref.release()
+	ref.db.m.Unlock()
+}
+
+func (ref *PageRef) release() {
 	if ref.refcount <= 0 {
 		panic("releasing unreferenced page")
 	}
 	ref.refcount--
+	if ref.shared != nil {
+		if ref.refcount == 0 && ref.owner != nil {
+			delete(ref.owner.pins, ref)
+		}
+		ref.shared.release()
+		return
+	}
+	if ref.db.params.Debug {
+		ref.unpin()
+		if ref.refcount == 0 {
+			ref.poison()
+		}
+	}
 }
 
 // Read returns the page data in read-only mode.
 func (ref *PageRef) Read() []byte {
+	ref.checkReleased()
+	if ref.db.headers && ref.pid != RootBlock {
+		return ref.data[:len(ref.data)-PageHeaderSize]
+	}
 	return ref.data
 }
 
@@ -153,6 +433,13 @@ func (ref *PageRef) Read() []byte {
 // marked dirty and it will be flushed to storage when the transaction
 // commits.
 func (ref *PageRef) Data() []byte {
+	ref.checkReleased()
+	if ref.readOnly {
+		panic(fmt.Sprintf("page %v: Data called for read-only page", ref.pid))
+	}
+	if ref.shared != nil {
+		return ref.shared.Data()
+	}
 	ref.dirty = true
 	return ref.Read()
 }
@@ -161,6 +448,10 @@ func (ref *PageRef) read() error {
 	if ref.dirty {
 		panic("loading dirty page reference")
 	}
+	ref.verified = false
+	if ref.pid.Compressed() {
+		return ref.readCompressed()
+	}
 	off := int64(ref.pid.Pagenum() * uint64(ref.db.params.PageSize))
 	_, err := ref.db.device.ReadAt(ref.data, off)
 
@@ -171,11 +462,19 @@ func (ref *PageRef) flush() error {
 	if !ref.dirty {
 		return nil
 	}
-	off := int64(ref.pid.Pagenum() * uint64(ref.db.params.PageSize))
-	_, err := ref.db.device.WriteAt(ref.data, off)
+	var err error
+	if ref.pid.Compressed() {
+		err = ref.flushCompressed()
+	} else {
+		off := int64(ref.pid.Pagenum() * uint64(ref.db.params.PageSize))
+		_, err = ref.db.device.WriteAt(ref.data, off)
+	}
 	if err != nil {
 		return err
 	}
 	ref.dirty = false
+	if ref.db.pt != nil {
+		ref.db.pt.flushedPage(ref)
+	}
 	return nil
 }
@@ -7,13 +7,204 @@
 package db
 
 import (
+	"sync"
 	"testing"
 )
 
 func TestCache(t *testing.T) {
-	db, err := newDB(NewParams(), &MemDevice{})
+	params := NewParams()
+	params.PageSize = 1024 * 1024
+
+	db, err := newDB(params, NewMemDevice(4*params.PageSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := db.cache
+	numRefs := len(cache.lru)
+
+	// Pin all page references.
+	var refs []*PageRef
+	for i := 1; i <= numRefs; i++ {
+		ref, err := cache.New(NewPhysicalID(0, uint64(i)), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ref.Data()[0] = byte(i)
+		refs = append(refs, ref)
+	}
+	_, err = cache.New(NewPhysicalID(0, 1), nil)
+	if err == nil {
+		t.Errorf("New succeeded for cached page")
+	}
+	pid := NewPhysicalID(0, uint64(numRefs+1))
+	_, err = cache.New(pid, nil)
+	if err == nil {
+		t.Errorf("New succeeded with all pages pinned")
+	}
+	if len(cache.pinned()) != numRefs {
+		t.Errorf("pinned: got %v, expected %v", len(cache.pinned()), numRefs)
+	}
+
+	// Releasing a page makes it available for eviction.
+	refs[0].Release()
+	ref, err := cache.New(pid, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ref != refs[0] {
+		t.Errorf("New did not reuse the released page")
+	}
+	ref.Release()
+	for _, ref := range refs[1:] {
+		ref.Release()
+	}
+	if len(cache.pinned()) != 0 {
+		t.Errorf("pinned pages after release: %v", cache.pinned())
+	}
+
+	// The evicted page is flushed and read back from the device.
+	ref, err = cache.Get(NewPhysicalID(0, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ref.Read()[0] != 1 {
+		t.Errorf("evicted page data %v, expected 1", ref.Read()[0])
+	}
+	ref.Release()
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("releasing unreferenced page did not panic")
+		}
+	}()
+	ref.Release()
+}
+
+type writeRecord struct {
+	off  int64
+	size int
+}
+
+type recordingDevice struct {
+	*MemDevice
+	m      sync.Mutex
+	writes []writeRecord
+}
+
+func (dev *recordingDevice) WriteAt(b []byte, off int64) (int, error) {
+	dev.m.Lock()
+	defer dev.m.Unlock()
+	dev.writes = append(dev.writes, writeRecord{
+		off:  off,
+		size: len(b),
+	})
+	return dev.MemDevice.WriteAt(b, off)
+}
+
+func TestCacheFlush(t *testing.T) {
+	for _, workers := range []int{1, 4} {
+		device := &recordingDevice{
+			MemDevice: NewMemDevice(1024 * 1024),
+		}
+		params := NewParams()
+		params.PageSize = 1024
+		params.MaxWriteSize = 4 * 1024
+		params.FlushWorkers = workers
+
+		db, err := Create(params, device)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tr, err := db.NewTransaction(true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []LogicalID
+		for i := 0; i < 20; i++ {
+			ref, id, err := tr.NewPage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			bo.PutUint64(ref.Data(), uint64(id))
+			ref.Release()
+			ids = append(ids, id)
+		}
+		device.writes = nil
+		err = tr.Commit()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		last := device.writes[len(device.writes)-1]
+		if last.off != 0 {
+			t.Errorf("root block not written last: %v", device.writes)
+		}
+		for i, w := range device.writes {
+			if w.size > params.MaxWriteSize {
+				t.Errorf("write %v exceeds MaxWriteSize", w)
+			}
+			if workers == 1 && i > 0 && i < len(device.writes)-1 &&
+				w.off <= device.writes[i-1].off {
+				t.Errorf("writes not sorted: %v", device.writes)
+			}
+		}
+		if workers == 1 && len(device.writes) > 8 {
+			t.Errorf("writes not coalesced: %v", device.writes)
+		}
+
+		db, err = Open(params, device)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tr, err = db.NewTransaction(false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, id := range ids {
+			ref, err := tr.ReadablePage(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bo.Uint64(ref.Read()) != uint64(id) {
+				t.Errorf("page %v: invalid data", id)
+			}
+			ref.Release()
+		}
+		err = tr.Commit()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCacheClock(t *testing.T) {
+	device := &recordingDevice{
+		MemDevice: NewMemDevice(1024 * 1024),
+	}
+	params := NewParams()
+	params.PageSize = 1024
+
+	db, err := Create(params, device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr, err := db.NewTransaction(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	device.writes = nil
+	for i := 0; i < 10; i++ {
+		ref, _, err := tr.NewPage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ref.Release()
+	}
+	if len(device.writes) != 0 {
+		t.Errorf("released pages evicted before commit: %v", device.writes)
+	}
+	err = tr.Commit()
 	if err != nil {
 		t.Fatal(err)
 	}
-	_ = db
 }
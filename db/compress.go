@@ -0,0 +1,231 @@
+//
+// Copyright (c) 2024 Markku Rossi
+//
+// All rights reserved.
+//
+
+package db
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// MaxSizeClass defines the smallest compressed page slot size,
+// PageSize>>MaxSizeClass.
+const MaxSizeClass = 3
+
+// slotAllocator allocates compressed page slots from partially
+// filled physical pages.
+type slotAllocator struct {
+	pages [MaxSizeClass + 1]PhysicalID
+	next  [MaxSizeClass + 1]int
+}
+
+// compressPages compresses the data pages written in the transaction
+// and relocates them into size class slots. The pages that do not
+// compress to half of the page size are kept uncompressed.
+func (pt *PageTable) compressPages(tr *BaseTransaction) error {
+	var ids []LogicalID
+	for id := range tr.written {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+
+	var slots slotAllocator
+
+	for _, id := range ids {
+		pid := tr.written[id]
+		if pid.Compressed() {
+			continue
+		}
+		ref, ok := pt.db.cache.cached[pid]
+		if !ok || !ref.dirty {
+			// The page is already flushed to its uncompressed
+			// location.
+			continue
+		}
+		ref.seal()
+		compressed, err := compressPage(ref.data)
+		if err != nil {
+			return err
+		}
+		err = pt.relocate(tr, id, ref, len(compressed), &slots)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// relocate moves the page ref into the smallest size class slot that
+// can hold size bytes.
+func (pt *PageTable) relocate(tr *BaseTransaction, id LogicalID,
+	ref *PageRef, size int, slots *slotAllocator) error {
+
+	pageSize := pt.db.params.PageSize
+	pid := ref.pid
+
+	var class int
+	for class = MaxSizeClass; class > 0; class-- {
+		if size <= pageSize>>class {
+			break
+		}
+	}
+	if class == 0 {
+		return nil
+	}
+	// The slots are stored in the physical page of the relocated
+	// page, which starts a new slot page. The physical pages of the
+	// pages relocated to the existing slot pages are freed.
+	free := true
+	if slots.pages[class] == 0 || slots.next[class] >= 1<<class {
+		slots.pages[class] = NewPhysicalID(0, pid.Pagenum())
+		slots.next[class] = 0
+		free = false
+	}
+	meta := PIDMetaCompressed |
+		uint16(class)<<PIDMetaSizeClassShift | uint16(slots.next[class])
+	newPid := NewPhysicalID(meta, slots.pages[class].Pagenum())
+	slots.next[class]++
+
+	// Keep the page pinned while updating the page table.
+	ref.refcount++
+	defer ref.release()
+
+	err := pt.set(tr, id, newPid)
+	if err != nil {
+		return err
+	}
+	err = pt.db.cache.rename(pid, newPid)
+	if err != nil {
+		return err
+	}
+	tr.writable[newPid] = tr.writable[pid]
+	delete(tr.writable, pid)
+	tr.written[id] = newPid
+
+	if free {
+		return pt.freePhysicalID(pid)
+	}
+	return nil
+}
+
+func compressPage(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.BestSpeed)
+	if err != nil {
+		return nil, err
+	}
+	_, err = w.Write(data)
+	if err != nil {
+		return nil, err
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// slot returns the device offset and size of the compressed page
+// slot.
+func (ref *PageRef) slot() (int64, int) {
+	return physicalRange(ref.pid, ref.db.params.PageSize)
+}
+
+// physicalRange returns the device offset and size of the physical
+// page pid.
+func physicalRange(pid PhysicalID, pageSize int) (int64, int) {
+	if !pid.Compressed() {
+		return int64(pid.Pagenum() * uint64(pageSize)), pageSize
+	}
+	size := pageSize >> pid.SizeClass()
+	off := pid.Pagenum()*uint64(pageSize) + uint64(pid.Slot()*size)
+	return int64(off), size
+}
+
+func (ref *PageRef) readCompressed() error {
+	off, size := ref.slot()
+	buf := make([]byte, size)
+	_, err := ref.db.device.ReadAt(buf, off)
+	if err != nil {
+		return err
+	}
+	r := flate.NewReader(bytes.NewReader(buf))
+	defer r.Close()
+
+	n, err := io.ReadFull(r, ref.data)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return fmt.Errorf("page %v: %v", ref.pid, err)
+	}
+	for i := n; i < len(ref.data); i++ {
+		ref.data[i] = 0
+	}
+	return nil
+}
+
+// decompressSlots decompresses the compressed page slots of the
+// physical page buf. The pages are stored in the smallest size class
+// that can hold them so the size class of the page is the largest
+// class whose first slot holds a complete compressed page. The
+// function returns the size class and the decompressed pages, indexed
+// by slot, or an empty result if the page does not hold compressed
+// pages. The pages of the unused and the corrupted slots are nil.
+func decompressSlots(buf []byte) (int, [][]byte) {
+	pageSize := len(buf)
+	for class := MaxSizeClass; class > 0; class-- {
+		size := pageSize >> class
+		page := decompressSlot(buf[:size], pageSize)
+		if page == nil {
+			continue
+		}
+		pages := [][]byte{page}
+		for slot := 1; slot < 1<<class; slot++ {
+			pages = append(pages,
+				decompressSlot(buf[slot*size:(slot+1)*size], pageSize))
+		}
+		return class, pages
+	}
+	return 0, nil
+}
+
+// decompressSlot decompresses the page from the slot. The function
+// returns nil if the slot does not hold a complete compressed page.
+func decompressSlot(slot []byte, pageSize int) []byte {
+	r := flate.NewReader(bytes.NewReader(slot))
+	defer r.Close()
+
+	page := make([]byte, pageSize)
+	_, err := io.ReadFull(r, page)
+	if err != nil {
+		return nil
+	}
+	var extra [1]byte
+	_, err = r.Read(extra[:])
+	if err != io.EOF {
+		return nil
+	}
+	return page
+}
+
+func (ref *PageRef) flushCompressed() error {
+	off, size := ref.slot()
+	compressed, err := compressPage(ref.data)
+	if err != nil {
+		return err
+	}
+	if len(compressed) > size {
+		return fmt.Errorf("page %v: compressed data does not fit slot",
+			ref.pid)
+	}
+	buf := make([]byte, size)
+	copy(buf, compressed)
+	_, err = ref.db.device.WriteAt(buf, off)
+	return err
+}
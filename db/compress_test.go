@@ -0,0 +1,115 @@
+//
+// Copyright (c) 2024 Markku Rossi
+//
+// All rights reserved.
+//
+
+package db
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestCompression(t *testing.T) {
+	params := NewParams()
+	params.PageSize = 4096
+	params.Compression = true
+
+	device := NewMemDevice(1024 * 1024)
+	db, err := Create(params, device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr, err := db.NewTransaction(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := []byte("Shades of data. ")
+	rand := rand.New(rand.NewSource(42))
+
+	var ids []LogicalID
+	for i := 0; i < 16; i++ {
+		ref, id, err := tr.NewPage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := ref.Data()
+		if i%4 == 3 {
+			// Incompressible data.
+			rand.Read(buf)
+		} else {
+			for j := 0; j < len(buf); j += len(text) {
+				copy(buf[j:], text)
+			}
+		}
+		bo.PutUint64(buf, uint64(id))
+		ref.Release()
+		ids = append(ids, id)
+	}
+	err = tr.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, id := range ids {
+		pid, err := db.pt.get(nil, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pid.Compressed() != (i%4 != 3) {
+			t.Errorf("page %v: pid=%v", id, pid)
+		}
+	}
+
+	db, err = Open(params, device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr, err = db.NewTransaction(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, id := range ids {
+		ref, err := tr.ReadablePage(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := ref.Read()
+		if bo.Uint64(buf) != uint64(id) {
+			t.Errorf("page %v: invalid ID %v", id, bo.Uint64(buf))
+		}
+		if i%4 != 3 && string(buf[16:32]) != string(text) {
+			t.Errorf("page %v: invalid data %q", id, buf[16:32])
+		}
+		ref.Release()
+	}
+	err = tr.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCompressionGrowth(t *testing.T) {
+	grow := func(compression bool) uint64 {
+		params := NewParams()
+		params.PageSize = 4096
+		params.Compression = compression
+
+		db, err := Create(params, NewMemDevice(1024*1024))
+		if err != nil {
+			t.Fatal(err)
+		}
+		start := db.Root().NextPhysical
+		ids := writeTestPages(t, db, nil, 64, 1)
+		writeTestPages(t, db, ids, 0, 2)
+		verifyTestPages(t, db, ids, 2)
+
+		return db.Root().NextPhysical - start
+	}
+	plain := grow(false)
+	compressed := grow(true)
+	if compressed >= plain {
+		t.Errorf("compressed database grew %v pages, uncompressed %v pages",
+			compressed, plain)
+	}
+}
@@ -0,0 +1,146 @@
+//
+// Copyright (c) 2024 Markku Rossi
+//
+// All rights reserved.
+//
+
+package db
+
+import (
+	"errors"
+	"sort"
+)
+
+// ErrConflict is returned from the Commit of a concurrent
+// transaction if the pages it read or wrote were modified by a
+// transaction committed after it started. The transaction is aborted
+// and it can be retried.
+var ErrConflict = errors.New("transaction conflict")
+
+// NewConcurrentTransaction starts a new read-write transaction that
+// can run concurrently with other concurrent transactions. The
+// transaction works on its own copy of the latest committed root
+// pointer. At commit, the logical pages the transaction read and
+// wrote are checked against the generations committed after the
+// transaction started. If any of them were modified, or if a base
+// transaction is active, the transaction is aborted with
+// ErrConflict. Otherwise the page table changes of the transaction
+// are rebased on top of the latest committed generation.
+func (db *DB) NewConcurrentTransaction() (*BaseTransaction, error) {
+	if db.params.ReadOnly {
+		return nil, ErrReadOnly
+	}
+	db.m.Lock()
+	defer db.m.Unlock()
+
+	return db.pt.newConcurrentTransaction()
+}
+
+func (pt *PageTable) newConcurrentTransaction() (*BaseTransaction, error) {
+	nonce, err := newNonce()
+	if err != nil {
+		return nil, err
+	}
+	pt.initAlloc()
+
+	start := pt.root0
+	root := start
+	root.Generation++
+
+	tr := &BaseTransaction{
+		cache:      pt.db.cache,
+		pt:         pt,
+		rw:         true,
+		root:       &root,
+		concurrent: true,
+		start:      start,
+		writable:   make(map[PhysicalID]PhysicalID),
+		written:    make(map[LogicalID]PhysicalID),
+		reads:      make(map[LogicalID]bool),
+		nonce:      nonce,
+	}
+	pt.concurrent[tr] = true
+	return tr, nil
+}
+
+// commitConcurrent commits the concurrent transaction tr. The
+// transaction is committed through root1, which is free since no
+// read-write base transaction is active. The read-only transactions
+// read the committed root so they do not conflict with the commit.
+func (pt *PageTable) commitConcurrent(tr *BaseTransaction) error {
+	if pt.root1.Generation > pt.root0.Generation {
+		pt.abort(tr)
+		return ErrConflict
+	}
+	if pt.root0.Generation != tr.start.Generation {
+		err := pt.checkConflicts(tr)
+		if err == nil {
+			err = pt.rebase(tr)
+		}
+		if err != nil {
+			pt.abort(tr)
+			return err
+		}
+	}
+	delete(pt.concurrent, tr)
+
+	pt.root1 = *tr.root
+	pt.root1.Generation = pt.root0.Generation + 1
+	tr.root = nil
+	tr.concurrent = false
+
+	err := pt.commit(tr)
+	if err != nil {
+		pt.root1.Generation = pt.root0.Generation
+	}
+	return err
+}
+
+// checkConflicts checks if the logical pages read or written by the
+// concurrent transaction tr were modified after the transaction
+// started.
+func (pt *PageTable) checkConflicts(tr *BaseTransaction) error {
+	err := pt.flushPending()
+	if err != nil {
+		return err
+	}
+	changes, err := diffRoots(pt.db.device, tr.start, pt.root0)
+	if err != nil {
+		return err
+	}
+	for _, ids := range [][]LogicalID{
+		changes.Added, changes.Removed, changes.Modified,
+	} {
+		for _, id := range ids {
+			_, written := tr.written[id]
+			if written || tr.reads[id] {
+				return ErrConflict
+			}
+		}
+	}
+	return nil
+}
+
+// rebase replays the page mappings of the concurrent transaction tr
+// on top of the latest committed root pointer.
+func (pt *PageTable) rebase(tr *BaseTransaction) error {
+	var ids []LogicalID
+	for id := range tr.written {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+
+	root := pt.root0
+	tr.root = &root
+	tr.start = pt.root0
+
+	for _, id := range ids {
+		err := pt.set(tr, id, tr.written[id])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,278 @@
+//
+// Copyright (c) 2024 Markku Rossi
+//
+// All rights reserved.
+//
+
+package db
+
+import (
+	"errors"
+	"sync"
+	"testing"
+)
+
+func updatePage(t *testing.T, tr *BaseTransaction, id LogicalID, value byte) {
+	ref, err := tr.WritablePage(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := ref.Data()
+	for i := 8; i < len(buf); i++ {
+		buf[i] = value
+	}
+	ref.Release()
+}
+
+func TestConcurrentTransactions(t *testing.T) {
+	params := NewParams()
+	params.PageSize = 1024
+
+	device := NewMemDevice(4 * 1024 * 1024)
+	db, err := Create(params, device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := writeTestPages(t, db, nil, 200, 1)
+
+	// Disjoint writers are rebased.
+	tr1, err := db.NewConcurrentTransaction()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr2, err := db.NewConcurrentTransaction()
+	if err != nil {
+		t.Fatal(err)
+	}
+	updatePage(t, tr1, ids[0], 2)
+	updatePage(t, tr2, ids[199], 3)
+
+	ref, id, err := tr2.NewPage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bo.PutUint64(ref.Data(), uint64(id))
+	for i := 8; i < len(ref.Data()); i++ {
+		ref.Data()[i] = 3
+	}
+	ref.Release()
+
+	err = tr1.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tr2.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(params, device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyTestPages(t, db, ids[1:199], 1)
+	verifyTestPages(t, db, ids[:1], 2)
+	verifyTestPages(t, db, []LogicalID{ids[199], id}, 3)
+
+	// Write-write conflict.
+	tr1, err = db.NewConcurrentTransaction()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr2, err = db.NewConcurrentTransaction()
+	if err != nil {
+		t.Fatal(err)
+	}
+	updatePage(t, tr1, ids[10], 4)
+	updatePage(t, tr2, ids[10], 5)
+	err = tr1.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tr2.Commit()
+	if !errors.Is(err, ErrConflict) {
+		t.Fatalf("write-write conflict: got %v, expected %v", err, ErrConflict)
+	}
+	verifyTestPages(t, db, ids[10:11], 4)
+
+	// Read-write conflict.
+	tr1, err = db.NewConcurrentTransaction()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr2, err = db.NewConcurrentTransaction()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err = tr2.ReadablePage(ids[20])
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref.Release()
+	updatePage(t, tr2, ids[21], 6)
+	updatePage(t, tr1, ids[20], 6)
+	err = tr1.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tr2.Commit()
+	if !errors.Is(err, ErrConflict) {
+		t.Fatalf("read-write conflict: got %v, expected %v", err, ErrConflict)
+	}
+	verifyTestPages(t, db, ids[21:22], 1)
+
+	// Read-only transactions do not conflict and they keep reading
+	// their snapshot.
+	err = db.View(func(view *BaseTransaction) error {
+		tr1, err := db.NewConcurrentTransaction()
+		if err != nil {
+			return err
+		}
+		updatePage(t, tr1, ids[40], 8)
+		err = tr1.Commit()
+		if err != nil {
+			return err
+		}
+		ref, err := view.ReadablePage(ids[40])
+		if err != nil {
+			return err
+		}
+		defer ref.Release()
+		if ref.Read()[8] != 1 {
+			t.Errorf("view read %v, expected 1", ref.Read()[8])
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("concurrent commit with view: %v", err)
+	}
+	verifyTestPages(t, db, ids[40:41], 8)
+
+	// Active base transaction conflicts.
+	tr1, err = db.NewConcurrentTransaction()
+	if err != nil {
+		t.Fatal(err)
+	}
+	updatePage(t, tr1, ids[30], 7)
+	base, err := db.NewTransaction(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tr1.Commit()
+	if !errors.Is(err, ErrConflict) {
+		t.Fatalf("base conflict: got %v, expected %v", err, ErrConflict)
+	}
+	err = base.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConcurrentWriters(t *testing.T) {
+	params := NewParams()
+	params.PageSize = 1024
+
+	db, err := Create(params, NewMemDevice(16*1024*1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	const workers = 4
+	const pages = 50
+
+	ids := writeTestPages(t, db, nil, workers*pages, 1)
+
+	var wg sync.WaitGroup
+	errs := make([]error, workers)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for _, id := range ids[w*pages : (w+1)*pages] {
+				for {
+					err := writeConcurrent(db, id)
+					if errors.Is(err, ErrConflict) {
+						continue
+					}
+					if err != nil {
+						errs[w] = err
+						return
+					}
+					break
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	verifyTestPages(t, db, ids, 2)
+}
+
+func writeConcurrent(db *DB, id LogicalID) error {
+	tr, err := db.NewConcurrentTransaction()
+	if err != nil {
+		return err
+	}
+	ref, err := tr.WritablePage(id)
+	if err != nil {
+		tr.Abort()
+		return err
+	}
+	buf := ref.Data()
+	for i := 8; i < len(buf); i++ {
+		buf[i] = 2
+	}
+	ref.Release()
+	return tr.Commit()
+}
+
+func TestConcurrentFirstTransaction(t *testing.T) {
+	params := NewParams()
+	params.PageSize = 1024
+	params.ObjectTables = true
+
+	device := NewMemDevice(1024 * 1024)
+	db, err := Create(params, device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []LogicalID
+	for round := 0; round < 2; round++ {
+		tr, err := db.NewConcurrentTransaction()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, objectID := range []uint16{0, 1} {
+			var ref *PageRef
+			var id LogicalID
+			if objectID == 0 {
+				ref, id, err = tr.NewPage()
+			} else {
+				ref, id, err = tr.NewObjectPage(objectID)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			buf := ref.Data()
+			bo.PutUint64(buf, uint64(id))
+			for i := 8; i < len(buf); i++ {
+				buf[i] = 1
+			}
+			ref.Release()
+			ids = append(ids, id)
+		}
+		err = tr.Commit()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The first transaction of the opened database.
+		db, err = Open(params, device)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	verifyTestPages(t, db, ids, 1)
+}
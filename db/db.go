@@ -7,11 +7,15 @@
 package db
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"sync"
 )
 
-// Device implements an I/O device.
+// Device implements an I/O device. Like os.File, the reads past the
+// end of the device return the bytes before the end and io.EOF.
 type Device interface {
 	Close() error
 	ReadAt(b []byte, off int64) (n int, err error)
@@ -19,17 +23,45 @@ type Device interface {
 	WriteAt(b []byte, off int64) (n int, err error)
 }
 
+var (
+	// ErrReadOnly is returned when a read-only database is modified.
+	ErrReadOnly = errors.New("read-only database")
+
+	// ErrTransactionActive is returned when an operation requires
+	// that no transactions are active.
+	ErrTransactionActive = errors.New("transaction active")
+
+	// ErrUnsupportedFormat is returned when the database format
+	// version or its required features are not supported.
+	ErrUnsupportedFormat = errors.New("unsupported database format")
+
+	// ErrRollback is returned when an authenticated database is
+	// older than the Params.AuthGeneration.
+	ErrRollback = errors.New("database rolled back")
+)
+
 var (
 	_ Device = &os.File{}
+	_ Device = &FileDevice{}
 	_ Device = &MemDevice{}
+	_ Device = &ORAMDevice{}
 )
 
 // DB implements the Shades database.
 type DB struct {
 	params Params
 	device Device
-	pt     *PageTable
-	cache  *Cache
+
+	// The m serializes the page table and cache operations of the
+	// transactions.
+	m       sync.Mutex
+	pt      *PageTable
+	cache   *Cache
+	headers bool
+	hooks   []CommitHook
+
+	subscribersM sync.Mutex
+	subscribers  []*Subscription
 }
 
 // Create creates a new database with the parameters and I/O device.
@@ -41,6 +73,17 @@ func Create(params Params, device Device) (*DB, error) {
 	if pageSize != params.PageSize {
 		return nil, fmt.Errorf("page size must be power of 2 and >= 1024")
 	}
+	if params.ObjectTables && len(params.AuthKey) > 0 {
+		return nil, fmt.Errorf("object tables not supported in " +
+			"authenticated mode")
+	}
+	if params.WAL && (params.Compression || len(params.AuthKey) > 0) {
+		return nil, fmt.Errorf("WAL not supported with compression or " +
+			"in authenticated mode")
+	}
+	if params.ReadOnly {
+		return nil, ErrReadOnly
+	}
 
 	db, err := newDB(params, device)
 	if err != nil {
@@ -55,31 +98,59 @@ func Create(params Params, device Device) (*DB, error) {
 
 // Open opens the database from the I/O device.
 func Open(params Params, device Device) (*DB, error) {
-	pt, err := NewPageTable(nil)
+	root, err := readRoot(params, device)
 	if err != nil {
 		return nil, err
 	}
+	// Use the generation time values and open the database.
+	params.PageSize = int(root.PageSize)
+	return open(params, device)
+}
+
+// readRoot reads the latest valid root pointer from the device. The
+// parameters specify the authentication key of authenticated
+// databases.
+func readRoot(params Params, device Device) (RootPointer, error) {
+	pt, err := NewPageTable(&DB{
+		params: params,
+	})
+	if err != nil {
+		return RootPointer{}, err
+	}
 	// Open the root block and read database page size.
 	for pageSize := 1024; pageSize <= 1024*1024; pageSize *= 2 {
 		buf := make([]byte, pageSize)
-		_, err := device.ReadAt(buf, 0)
-		if err != nil {
-			return nil, err
+		n, err := device.ReadAt(buf, 0)
+		if err == io.EOF {
+			buf = buf[:n]
+		} else if err != nil {
+			return RootPointer{}, err
 		}
+		// The larger buffers span the pages after the root block
+		// and they can hold root pointers of the history pages.
 		err = pt.parseRootBlock(buf)
-		if err == nil {
-			// Parsed the existing root pointer. Use the generation
-			// time values and open the database.
-			params.PageSize = int(pt.root0.PageSize)
-			return open(params, device)
+		if err == nil && int(pt.root0.PageSize) == pageSize {
+			return pt.root0, nil
+		}
+		if errors.Is(err, ErrUnsupportedFormat) {
+			return RootPointer{}, err
 		}
 	}
-	return nil, fmt.Errorf("not a valid shades DB file")
+	return RootPointer{}, fmt.Errorf("not a valid shades DB file")
 }
 
 // NewTransaction starts a new base transaction in read-only or
-// read-write mode depeneding on the argument rw.
+// read-write mode depeneding on the argument rw. Only one read-write
+// base transaction can be active at a time. The read-only
+// transactions read the latest committed generation and they can
+// run alongside the other transactions.
 func (db *DB) NewTransaction(rw bool) (*BaseTransaction, error) {
+	if rw && db.params.ReadOnly {
+		return nil, ErrReadOnly
+	}
+	db.m.Lock()
+	defer db.m.Unlock()
+
 	tr, err := db.pt.newTransaction(rw)
 	if err != nil {
 		return nil, err
@@ -88,6 +159,59 @@ func (db *DB) NewTransaction(rw bool) (*BaseTransaction, error) {
 	return tr, nil
 }
 
+// Refresh moves the database to the latest generation committed into
+// the device by another process. The function returns true if the
+// database generation changed. Refresh returns ErrTransactionActive
+// if transactions are active.
+func (db *DB) Refresh() (bool, error) {
+	db.m.Lock()
+	defer db.m.Unlock()
+
+	return db.pt.refresh()
+}
+
+// View runs the function fn in a read-only transaction. The
+// transaction is committed if fn returns nil and aborted if fn returns
+// an error or panics.
+func (db *DB) View(fn func(tr *BaseTransaction) error) error {
+	return db.run(false, fn)
+}
+
+// Update runs the function fn in a read-write transaction. The
+// transaction is committed if fn returns nil and aborted if fn returns
+// an error or panics. The panic is propagated to the caller after the
+// transaction is aborted.
+func (db *DB) Update(fn func(tr *BaseTransaction) error) error {
+	return db.run(true, fn)
+}
+
+func (db *DB) run(rw bool, fn func(tr *BaseTransaction) error) error {
+	tr, err := db.NewTransaction(rw)
+	if err != nil {
+		return err
+	}
+	done := false
+	defer func() {
+		if !done {
+			// The panic of fn is propagated to the caller so the
+			// abort error can't be returned.
+			tr.Abort()
+		}
+	}()
+
+	err = fn(tr)
+	done = true
+	if err != nil {
+		return errors.Join(err, tr.Abort())
+	}
+	return tr.Commit()
+}
+
+// Root returns the latest committed root pointer.
+func (db *DB) Root() RootPointer {
+	return db.pt.committed()
+}
+
 func open(params Params, device Device) (*DB, error) {
 	db, err := newDB(params, device)
 	if err != nil {
@@ -103,6 +227,10 @@ func open(params Params, device Device) (*DB, error) {
 func newDB(params Params, device Device) (*DB, error) {
 	var err error
 
+	if params.Debug && params.Compression {
+		return nil, fmt.Errorf("compression not supported in debug mode")
+	}
+
 	db := &DB{
 		params: params,
 		device: device,
@@ -0,0 +1,315 @@
+//
+// Copyright (c) 2024 Markku Rossi
+//
+// All rights reserved.
+//
+
+package db
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestUpdateView(t *testing.T) {
+	params := NewParams()
+	params.PageSize = 1024
+	params.Debug = true
+
+	db, err := Create(params, NewMemDevice(1024*1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var id LogicalID
+	err = db.Update(func(tr *BaseTransaction) error {
+		ref, newID, err := tr.NewPage()
+		if err != nil {
+			return err
+		}
+		defer ref.Release()
+		id = newID
+		ref.Data()[0] = 1
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gen := db.Root().Generation
+
+	// Failing update is aborted.
+	errFail := errors.New("fail")
+	err = db.Update(func(tr *BaseTransaction) error {
+		ref, err := tr.WritablePage(id)
+		if err != nil {
+			return err
+		}
+		defer ref.Release()
+		ref.Data()[0] = 2
+		return errFail
+	})
+	if !errors.Is(err, errFail) {
+		t.Errorf("Update: got error %v, expected %v", err, errFail)
+	}
+
+	// Panicking update is aborted and the panic is propagated.
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("Update did not propagate panic")
+			}
+		}()
+		db.Update(func(tr *BaseTransaction) error {
+			ref, err := tr.WritablePage(id)
+			if err != nil {
+				return err
+			}
+			defer ref.Release()
+			ref.Data()[0] = 3
+			panic("update")
+		})
+	}()
+	if db.Root().Generation != gen {
+		t.Errorf("aborted updates committed generation %v, expected %v",
+			db.Root().Generation, gen)
+	}
+
+	err = db.View(func(tr *BaseTransaction) error {
+		ref, err := tr.ReadablePage(id)
+		if err != nil {
+			return err
+		}
+		defer ref.Release()
+		if ref.Read()[0] != 1 {
+			t.Errorf("page data %v, expected 1", ref.Read()[0])
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Debug mode reports leaked pins.
+	var leaked *PageRef
+	err = db.View(func(tr *BaseTransaction) error {
+		leaked, err = tr.ReadablePage(id)
+		return err
+	})
+	if err == nil {
+		t.Errorf("View did not report pinned page")
+	}
+	leaked.Release()
+
+	err = db.View(func(tr *BaseTransaction) error {
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// failingDevice fails the writes and syncs when fail is set.
+type failingDevice struct {
+	*MemDevice
+	fail bool
+}
+
+var errDevice = errors.New("device failure")
+
+func (dev *failingDevice) WriteAt(b []byte, off int64) (int, error) {
+	if dev.fail {
+		return 0, errDevice
+	}
+	return dev.MemDevice.WriteAt(b, off)
+}
+
+func (dev *failingDevice) Sync() error {
+	if dev.fail {
+		return errDevice
+	}
+	return dev.MemDevice.Sync()
+}
+
+func TestUpdateCommitFailure(t *testing.T) {
+	params := NewParams()
+	params.PageSize = 1024
+
+	device := &failingDevice{
+		MemDevice: NewMemDevice(1024 * 1024),
+	}
+	db, err := Create(params, device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := writeTestPages(t, db, nil, 10, 1)
+
+	device.fail = true
+	err = db.Update(func(tr *BaseTransaction) error {
+		ref, err := tr.WritablePage(ids[0])
+		if err != nil {
+			return err
+		}
+		ref.Data()[8] = 2
+		ref.Release()
+		return nil
+	})
+	if !errors.Is(err, errDevice) {
+		t.Fatalf("Update: got error %v, expected %v", err, errDevice)
+	}
+
+	// The failed commit is aborted and new transactions can start.
+	device.fail = false
+	verifyTestPages(t, db, ids, 1)
+	writeTestPages(t, db, ids, 0, 3)
+
+	db, err = Open(params, device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyTestPages(t, db, ids, 3)
+}
+
+func TestOpenTruncated(t *testing.T) {
+	params := NewParams()
+	params.PageSize = 1024
+
+	device := NewMemDevice(1024 * 1024)
+	db, err := Create(params, device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestPages(t, db, nil, 100, 1)
+	size := db.Root().PageTable.Pagenum() * uint64(params.PageSize)
+
+	// The device without Size is checked with a read.
+	truncated := NewMemDevice(int(size))
+	copy(truncated.buf, device.buf)
+	_, err = Open(params, truncated)
+	if err == nil {
+		t.Errorf("Open succeeded with truncated device")
+	}
+
+	// The segmented device reports its size.
+	seg, err := OpenSegmentedDevice(t.TempDir(), 16*1024, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer seg.Close()
+	_, err = seg.WriteAt(device.buf[:size], 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Open(params, seg)
+	if err == nil {
+		t.Errorf("Open succeeded with truncated segmented device")
+	}
+	_, err = seg.WriteAt(device.buf[size:], int64(size))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Open(params, seg)
+	if err != nil {
+		t.Errorf("Open: %v", err)
+	}
+}
+
+// fuzzCacheSize specifies the page cache size of the fuzz targets. The
+// default cache would dominate the cost of each fuzz input.
+const fuzzCacheSize = 256 * 1024
+
+func FuzzOpen(f *testing.F) {
+	for _, params := range []Params{
+		{PageSize: 1024},
+		{PageSize: 1024, ObjectTables: true, PageHeaders: true},
+		{PageSize: 1024, WAL: true, WALSize: 4096},
+		{PageSize: 1024, RetainGenerations: 2},
+	} {
+		params.CacheSize = fuzzCacheSize
+		device := NewMemDevice(1024 * 1024)
+		db, err := Create(params, device)
+		if err != nil {
+			f.Fatal(err)
+		}
+		ids := writeTestPages(f, db, nil, 20, 1)
+		writeTestPages(f, db, ids[:3], 0, 2)
+		if params.ObjectTables {
+			writeObjectPages(f, db, 1, 3, 3)
+		}
+		size := db.Root().NextPhysical * uint64(params.PageSize)
+		f.Add(device.buf[:size])
+	}
+
+	// Root histories whose links point to the page itself.
+	params := Params{
+		PageSize:          1024,
+		CacheSize:         fuzzCacheSize,
+		RetainGenerations: 30,
+	}
+	device := NewMemDevice(1024 * 1024)
+	db, err := Create(params, device)
+	if err != nil {
+		f.Fatal(err)
+	}
+	ids := writeTestPages(f, db, nil, 10, 1)
+	for i := 0; i < 10; i++ {
+		writeTestPages(f, db, ids, 0, byte(i))
+	}
+	root := db.Root()
+	size := root.NextPhysical * uint64(params.PageSize)
+	for _, count := range []uint16{0, 1} {
+		data := bytes.Clone(device.buf[:size])
+		buf := data[root.Snapshots.Pagenum()*uint64(params.PageSize):]
+		bo.PutUint16(buf[HistOfsCount:], count)
+		bo.PutUint64(buf[HistOfsNext:], uint64(root.Snapshots))
+		f.Add(data)
+	}
+	hashPT, err := NewPageTable(&DB{})
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		data = append([]byte(nil), data...)
+		fixRootChecksums(hashPT, data[:min(len(data), 1024)], RootPtrSize)
+
+		device := NewMemDevice(len(data))
+		copy(device.buf, data)
+
+		params := NewParams()
+		params.TLBSize = 0
+		params.CacheSize = fuzzCacheSize
+		db, err := Open(params, device)
+		if err != nil {
+			return
+		}
+		root := db.Root()
+		tr, err := db.NewTransactionAt(root.Generation - 1)
+		if err == nil {
+			tr.Commit()
+		}
+		db.View(func(tr *BaseTransaction) error {
+			for i := uint64(1); i < min(root.NextLogical, 300); i++ {
+				for _, objectID := range []uint16{0, 1} {
+					ref, err := tr.ReadablePage(NewLogicalID(0, objectID, i))
+					if err == nil {
+						ref.Release()
+					}
+				}
+			}
+			return nil
+		})
+		db.Update(func(tr *BaseTransaction) error {
+			ref, _, err := tr.NewPage()
+			if err != nil {
+				return err
+			}
+			ref.Release()
+			ref, err = tr.WritablePage(NewLogicalID(0, 0, 1))
+			if err != nil {
+				return err
+			}
+			ref.Release()
+			return nil
+		})
+	})
+}
@@ -0,0 +1,337 @@
+//
+// Copyright (c) 2024 Markku Rossi
+//
+// All rights reserved.
+//
+
+// Package dbtest implements a conformance test suite for the
+// db.Device implementations. The suite checks that the devices
+// behave like os.File: the written data is read back from any offset,
+// the reads past the end of the device return the bytes before the
+// end and io.EOF, the negative offsets are rejected, and the
+// devices can be used concurrently from multiple goroutines.
+package dbtest
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/markkurossi/shades/db"
+)
+
+// PageSize defines the page size that the suite uses for the page
+// boundary tests.
+const PageSize = 1024
+
+// MinSize defines the minimum capacity of the fixed-size devices.
+const MinSize = 64 * PageSize
+
+// Config describes the device implementation under test.
+type Config struct {
+	// New creates a new, empty device.
+	New func(t *testing.T) db.Device
+
+	// Size specifies the capacity of fixed-size devices. The writes
+	// past the capacity fail and the reads past it return io.EOF.
+	// The zero value specifies a device that grows when it is
+	// written past its end, like os.File.
+	Size int64
+
+	// Reopen closes the device and opens it again. If set, the
+	// suite checks that the synced data survives the reopen.
+	Reopen func(t *testing.T, device db.Device) db.Device
+}
+
+type testFunc func(t *testing.T, config Config, device db.Device) db.Device
+
+// Run runs the conformance suite for the device implementation.
+func Run(t *testing.T, config Config) {
+	if config.Size != 0 && config.Size < MinSize {
+		t.Fatalf("device size %v smaller than %v", config.Size, MinSize)
+	}
+	tests := []struct {
+		name string
+		fn   testFunc
+	}{
+		{"ReadWrite", testReadWrite},
+		{"PageBoundaries", testPageBoundaries},
+		{"ShortRead", testShortRead},
+		{"OutOfRange", testOutOfRange},
+		{"Sync", testSync},
+		{"Concurrent", testConcurrent},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			device := test.fn(t, config, config.New(t))
+			err := device.Close()
+			if err != nil {
+				t.Errorf("Close: %v", err)
+			}
+		})
+	}
+}
+
+// pattern returns a deterministic test pattern of size bytes.
+func pattern(seed, size int) []byte {
+	buf := make([]byte, size)
+	for i := range buf {
+		buf[i] = byte(seed*31 + i*7 + i>>8)
+	}
+	return buf
+}
+
+func write(t *testing.T, device db.Device, data []byte, off int64) {
+	t.Helper()
+	n, err := device.WriteAt(data, off)
+	if err != nil {
+		t.Fatalf("WriteAt(%v, %v): %v", len(data), off, err)
+	}
+	if n != len(data) {
+		t.Fatalf("WriteAt(%v, %v): wrote %v bytes", len(data), off, n)
+	}
+}
+
+func verify(t *testing.T, device db.Device, expected []byte, off int64) {
+	t.Helper()
+	err := check(device, expected, off)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// check reads len(expected) bytes from the offset off and compares
+// them with expected. The reads that end at the end of the device may
+// return io.EOF.
+func check(device db.Device, expected []byte, off int64) error {
+	buf := make([]byte, len(expected))
+	n, err := device.ReadAt(buf, off)
+	if n != len(buf) || (err != nil && err != io.EOF) {
+		return fmt.Errorf("ReadAt(%v, %v): n=%v, err=%v", len(buf), off, n, err)
+	}
+	if !bytes.Equal(buf, expected) {
+		return fmt.Errorf("ReadAt(%v, %v): data mismatch", len(buf), off)
+	}
+	return nil
+}
+
+// testReadWrite checks that the data written at arbitrary offsets is
+// read back from any offset inside it and that the unwritten ranges
+// read as zeros.
+func testReadWrite(t *testing.T, config Config, device db.Device) db.Device {
+	data := pattern(1, 2000)
+	off := int64(3*PageSize + 10)
+
+	write(t, device, data, off)
+	verify(t, device, data, off)
+	verify(t, device, data[1:2], off+1)
+	verify(t, device, data[500:1500], off+500)
+	verify(t, device, data[1999:], off+1999)
+
+	// Unwritten data before the written range.
+	expected := append(make([]byte, 100), data[:100]...)
+	verify(t, device, expected, off-100)
+	verify(t, device, make([]byte, PageSize), 0)
+
+	// Overwrite inside the written range.
+	patch := pattern(2, 300)
+	write(t, device, patch, off+700)
+	copy(data[700:], patch)
+	verify(t, device, data, off)
+
+	// Single byte and empty accesses.
+	write(t, device, []byte{0xff}, 0)
+	verify(t, device, []byte{0xff, 0}, 0)
+	n, err := device.WriteAt(nil, 10)
+	if n != 0 || err != nil {
+		t.Errorf("empty WriteAt: n=%v, err=%v", n, err)
+	}
+	n, err = device.ReadAt(nil, 10)
+	if n != 0 || err != nil {
+		t.Errorf("empty ReadAt: n=%v, err=%v", n, err)
+	}
+	return device
+}
+
+// testPageBoundaries checks the page-aligned accesses and the
+// accesses that span page boundaries.
+func testPageBoundaries(t *testing.T, config Config,
+	device db.Device) db.Device {
+
+	const pages = 16
+	var expected []byte
+	for i := 0; i < pages; i++ {
+		page := pattern(i+10, PageSize)
+		write(t, device, page, int64(i*PageSize))
+		expected = append(expected, page...)
+	}
+	for i := 0; i < pages; i++ {
+		verify(t, device, expected[i*PageSize:(i+1)*PageSize],
+			int64(i*PageSize))
+	}
+	verify(t, device, expected, 0)
+
+	// Writes spanning page boundaries.
+	for _, span := range []struct {
+		off, size int
+	}{
+		{PageSize - 1, 2},
+		{2*PageSize - 100, PageSize + 200},
+		{5 * PageSize, 3 * PageSize},
+		{8*PageSize + 1, 4*PageSize - 2},
+	} {
+		data := pattern(span.off, span.size)
+		write(t, device, data, int64(span.off))
+		copy(expected[span.off:], data)
+	}
+	verify(t, device, expected, 0)
+	for i := 0; i+PageSize/2 <= len(expected); i += PageSize / 2 {
+		verify(t, device, expected[i:i+PageSize/2], int64(i))
+	}
+	return device
+}
+
+// end returns the end offset of the device. The growable devices are
+// written up to the returned offset.
+func end(t *testing.T, config Config, device db.Device) (int64, []byte) {
+	size := config.Size
+	if size == 0 {
+		size = 10*PageSize + 100
+	}
+	tail := pattern(3, 300)
+	write(t, device, tail, size-int64(len(tail)))
+	return size, tail
+}
+
+// testShortRead checks the reads past the end of the device.
+func testShortRead(t *testing.T, config Config, device db.Device) db.Device {
+	size, tail := end(t, config, device)
+
+	buf := make([]byte, PageSize)
+	n, err := device.ReadAt(buf, size-100)
+	if n != 100 || err != io.EOF {
+		t.Errorf("ReadAt across end: n=%v, err=%v, expected 100, EOF", n, err)
+	}
+	if !bytes.Equal(buf[:n], tail[len(tail)-100:]) {
+		t.Errorf("ReadAt across end: data mismatch")
+	}
+	n, err = device.ReadAt(buf, size)
+	if n != 0 || err != io.EOF {
+		t.Errorf("ReadAt at end: n=%v, err=%v, expected 0, EOF", n, err)
+	}
+	n, err = device.ReadAt(buf, size+10*PageSize)
+	if n != 0 || err != io.EOF {
+		t.Errorf("ReadAt after end: n=%v, err=%v, expected 0, EOF", n, err)
+	}
+	verify(t, device, tail, size-int64(len(tail)))
+
+	return device
+}
+
+// testOutOfRange checks the negative offsets and the writes past the
+// capacity of the fixed-size devices.
+func testOutOfRange(t *testing.T, config Config, device db.Device) db.Device {
+	buf := make([]byte, PageSize)
+
+	_, err := device.ReadAt(buf, -1)
+	if err == nil {
+		t.Errorf("ReadAt with negative offset succeeded")
+	}
+	_, err = device.WriteAt(buf, -1)
+	if err == nil {
+		t.Errorf("WriteAt with negative offset succeeded")
+	}
+	if config.Size == 0 {
+		// Writes past the end grow the device.
+		data := pattern(4, 100)
+		off := int64(20 * PageSize)
+		write(t, device, data, off)
+		verify(t, device, make([]byte, PageSize), off-PageSize)
+		verify(t, device, data, off)
+		return device
+	}
+	n, err := device.WriteAt(buf, config.Size-PageSize/2)
+	if err == nil {
+		t.Errorf("WriteAt across capacity succeeded: n=%v", n)
+	}
+	_, err = device.WriteAt(buf, config.Size)
+	if err == nil {
+		t.Errorf("WriteAt at capacity succeeded")
+	}
+	_, err = device.WriteAt(buf, 1<<62)
+	if err == nil {
+		t.Errorf("WriteAt far after capacity succeeded")
+	}
+	_, err = device.ReadAt(buf, 1<<62)
+	if err != io.EOF {
+		t.Errorf("ReadAt far after capacity: got %v, expected EOF", err)
+	}
+	return device
+}
+
+// testSync checks that the synced data is readable and, if the device
+// can be reopened, that it survives the reopen.
+func testSync(t *testing.T, config Config, device db.Device) db.Device {
+	err := device.Sync()
+	if err != nil {
+		t.Fatalf("Sync empty device: %v", err)
+	}
+	data := pattern(5, 3*PageSize)
+	write(t, device, data, PageSize)
+	err = device.Sync()
+	if err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+	verify(t, device, data, PageSize)
+
+	if config.Reopen == nil {
+		return device
+	}
+	device = config.Reopen(t, device)
+	verify(t, device, data, PageSize)
+
+	return device
+}
+
+// testConcurrent checks the concurrent accesses to disjoint ranges of
+// the device.
+func testConcurrent(t *testing.T, config Config, device db.Device) db.Device {
+	const workers = 8
+	const pages = 4
+	const rounds = 20
+
+	var wg sync.WaitGroup
+	errs := make([]error, workers)
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			base := int64(w * pages * PageSize)
+			for r := 0; r < rounds; r++ {
+				data := pattern(w*rounds+r, pages*PageSize)
+				_, err := device.WriteAt(data, base)
+				if err == nil {
+					err = device.Sync()
+				}
+				if err == nil {
+					err = check(device, data, base)
+				}
+				if err != nil {
+					errs[w] = err
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	for w, err := range errs {
+		if err != nil {
+			t.Errorf("worker %v: %v", w, err)
+		}
+	}
+	return device
+}
@@ -0,0 +1,146 @@
+//
+// Copyright (c) 2024 Markku Rossi
+//
+// All rights reserved.
+//
+
+package db
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// PoisonByte defines the value that fills the released page buffers
+// in debug mode.
+const PoisonByte = 0xdb
+
+// pin records the acquisition stack of the page reference in debug
+// mode.
+func (ref *PageRef) pin() {
+	if !ref.db.params.Debug {
+		return
+	}
+	pcs := make([]uintptr, 32)
+	n := runtime.Callers(3, pcs)
+	ref.stacks = append(ref.stacks, pcs[:n])
+}
+
+// track returns the view of the page reference ref, which the
+// transaction tr hands out to the caller in debug mode. The view
+// shares the page data and releasing the view releases the
+// reference. The transaction tracks its views so that only its own
+// pins are reported when it ends. The Data calls through the
+// read-only views are rejected but the other transactions can still
+// modify the cached page.
+func (tr *BaseTransaction) track(ref *PageRef, readOnly bool) *PageRef {
+	if !tr.pt.db.params.Debug {
+		return ref
+	}
+	view := &PageRef{
+		db:       ref.db,
+		pid:      ref.pid,
+		data:     ref.data,
+		refcount: 1,
+		pageType: ref.pageType,
+		id:       ref.id,
+		nonce:    ref.nonce,
+		shared:   ref,
+		owner:    tr,
+		readOnly: readOnly,
+	}
+	view.pin()
+	if tr.pins == nil {
+		tr.pins = make(map[*PageRef]bool)
+	}
+	tr.pins[view] = true
+	return view
+}
+
+// unpin removes the latest acquisition stack of the page reference.
+func (ref *PageRef) unpin() {
+	if len(ref.stacks) > 0 {
+		ref.stacks = ref.stacks[:len(ref.stacks)-1]
+	}
+}
+
+// poison flushes and uncaches the released page reference and fills
+// its buffer with PoisonByte so that any access through the released
+// reference is detected. The page is kept cached if it can't be
+// flushed.
+func (ref *PageRef) poison() {
+	cache := ref.db.cache
+	if ref.pid == RootBlock || ref.done != nil ||
+		cache.cached[ref.pid] != ref || cache.pinnedDirty(ref) {
+		return
+	}
+	if ref.dirty {
+		ref.seal()
+		if ref.flush() != nil {
+			return
+		}
+	}
+	delete(cache.cached, ref.pid)
+	for i := range ref.data {
+		ref.data[i] = PoisonByte
+	}
+	ref.dirty = false
+	ref.poisoned = true
+}
+
+// checkReleased panics if the view ref is used after it was released.
+func (ref *PageRef) checkReleased() {
+	if ref.shared != nil && ref.refcount == 0 {
+		panic(fmt.Sprintf("page %v used after release", ref.pid))
+	}
+}
+
+// checkPoison verifies that the poisoned page reference was not
+// modified after it was released.
+func (ref *PageRef) checkPoison() {
+	if !ref.poisoned {
+		return
+	}
+	ref.poisoned = false
+	for _, b := range ref.data {
+		if b != PoisonByte {
+			panic(fmt.Sprintf("page %v modified after release", ref.pid))
+		}
+	}
+}
+
+// checkPinned returns an error describing the page references of
+// the transaction tr that are still pinned at the end of the
+// transaction, and their acquisition stacks.
+func (db *DB) checkPinned(tr *BaseTransaction) error {
+	var pinned []*PageRef
+	for ref := range tr.pins {
+		pinned = append(pinned, ref)
+	}
+	if len(pinned) == 0 {
+		return nil
+	}
+	sort.Slice(pinned, func(i, j int) bool {
+		return pinned[i].pid < pinned[j].pid
+	})
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%v pinned pages at transaction end:", len(pinned))
+	for _, ref := range pinned {
+		fmt.Fprintf(&sb, "\n%v", ref)
+		for _, stack := range ref.stacks {
+			sb.WriteString("\n  acquired at:")
+			frames := runtime.CallersFrames(stack)
+			for {
+				frame, more := frames.Next()
+				fmt.Fprintf(&sb, "\n    %s\n      %s:%d",
+					frame.Function, frame.File, frame.Line)
+				if !more {
+					break
+				}
+			}
+		}
+	}
+	return fmt.Errorf("%s", sb.String())
+}
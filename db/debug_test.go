@@ -0,0 +1,273 @@
+//
+// Copyright (c) 2024 Markku Rossi
+//
+// All rights reserved.
+//
+
+package db
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func expectPanic(t *testing.T, name string, fn func()) {
+	t.Helper()
+	defer func() {
+		if recover() == nil {
+			t.Errorf("%v did not panic", name)
+		}
+	}()
+	fn()
+}
+
+func TestDebug(t *testing.T) {
+	params := NewParams()
+	params.PageSize = 1024 * 1024
+	params.Debug = true
+
+	db, err := Create(params, NewMemDevice(16*params.PageSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := writeTestPages(t, db, nil, 1, 1)
+
+	// Outstanding pins are reported at commit.
+	tr, err := db.NewTransaction(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaked, _, err := tr.NewPage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tr.Commit()
+	if err == nil {
+		t.Fatalf("Commit succeeded with pinned page")
+	}
+	if !strings.Contains(err.Error(), "TestDebug") {
+		t.Errorf("acquisition stack not reported: %v", err)
+	}
+	leaked.Release()
+
+	// The pins are reported when the transaction is aborted.
+	errFailed := errors.New("update failed")
+	err = db.Update(func(tr *BaseTransaction) error {
+		leaked, err = tr.ReadablePage(ids[0])
+		if err != nil {
+			return err
+		}
+		return errFailed
+	})
+	if !errors.Is(err, errFailed) {
+		t.Errorf("Update error %v, expected %v", err, errFailed)
+	}
+	if err == nil || !strings.Contains(err.Error(), "pinned pages") {
+		t.Errorf("pinned pages not reported at abort: %v", err)
+	}
+	leaked.Release()
+
+	// Data is rejected through read-only references.
+	err = db.View(func(tr *BaseTransaction) error {
+		ref, err := tr.ReadablePage(ids[0])
+		if err != nil {
+			return err
+		}
+		defer ref.Release()
+		expectPanic(t, "Data", func() {
+			ref.Data()
+		})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(tr *BaseTransaction) error {
+		ref, err := tr.WritablePage(ids[0])
+		if err != nil {
+			return err
+		}
+		ref.Release()
+		ref, err = tr.ReadablePage(ids[0])
+		if err != nil {
+			return err
+		}
+		defer ref.Release()
+		ref.Data()[8] = 2
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The released references can't be used.
+	err = db.Update(func(tr *BaseTransaction) error {
+		ref, err := tr.WritablePage(ids[0])
+		if err != nil {
+			return err
+		}
+		ref.Release()
+		expectPanic(t, "Data after release", func() {
+			ref.Data()[8] = 3
+		})
+		expectPanic(t, "Read after release", func() {
+			ref.Read()
+		})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.View(func(tr *BaseTransaction) error {
+		ref, err := tr.ReadablePage(ids[0])
+		if err != nil {
+			return err
+		}
+		defer ref.Release()
+		if ref.Read()[8] != 2 {
+			t.Errorf("page modified after release")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The released buffers are poisoned and writes after release are
+	// detected when the buffer is reused.
+	var released *PageRef
+	err = db.View(func(tr *BaseTransaction) error {
+		released, err = tr.ReadablePage(ids[0])
+		if err != nil {
+			return err
+		}
+		released.Release()
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if released.data[8] != PoisonByte {
+		t.Errorf("released buffer not poisoned")
+	}
+	released.data[8] = 2
+
+	expectPanic(t, "reusing modified buffer", func() {
+		for i := 0; i <= len(db.cache.lru); i++ {
+			ref, err := db.cache.New(NewPhysicalID(0, uint64(100+i)), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ref.Release()
+		}
+	})
+}
+
+func TestDebugPinnedByOtherTransaction(t *testing.T) {
+	params := NewParams()
+	params.PageSize = 1024
+	params.Debug = true
+	params.RetainGenerations = 2
+
+	db, err := Create(params, NewMemDevice(1024*1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := writeTestPages(t, db, nil, 2, 1)
+
+	// The pins of a historical view and a concurrent transaction do
+	// not fail the commits of the other transactions.
+	view, err := db.NewTransactionAt(db.Root().Generation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	viewRef, err := view.ReadablePage(ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctr, err := db.NewConcurrentTransaction()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctrRef, err := ctr.WritablePage(ids[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(tr *BaseTransaction) error {
+		ref, err := tr.WritablePage(ids[0])
+		if err != nil {
+			return err
+		}
+		ref.Data()[8] = 2
+		ref.Release()
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Update with pins of other transactions: %v", err)
+	}
+
+	// The pins are reported for their own transactions.
+	err = view.Commit()
+	if err == nil {
+		t.Errorf("view Commit succeeded with pinned page")
+	}
+	viewRef.Release()
+	ctrRef.Release()
+	err = ctr.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDebugReadOnlyShared(t *testing.T) {
+	params := NewParams()
+	params.PageSize = 1024 * 1024
+	params.Debug = true
+
+	db, err := Create(params, NewMemDevice(16*params.PageSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := writeTestPages(t, db, nil, 1, 1)
+
+	// The read-only references do not mark the cached page
+	// read-only for the other users of the page.
+	err = db.View(func(tr *BaseTransaction) error {
+		ref0, err := tr.ReadablePage(ids[0])
+		if err != nil {
+			return err
+		}
+		defer ref0.Release()
+		ref1, err := tr.ReadablePage(ids[0])
+		if err != nil {
+			return err
+		}
+		defer ref1.Release()
+		if ref0 == ref1 {
+			t.Errorf("read-only references shared")
+		}
+		cached := db.cache.cached[ref0.pid]
+		if cached == nil || cached.readOnly {
+			t.Errorf("cached page marked read-only")
+		}
+		expectPanic(t, "Data", func() {
+			ref1.Data()
+		})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDebugCompression(t *testing.T) {
+	params := NewParams()
+	params.Debug = true
+	params.Compression = true
+
+	_, err := Create(params, NewMemDevice(16*params.PageSize))
+	if err == nil {
+		t.Errorf("Create succeeded with debug mode and compression")
+	}
+}
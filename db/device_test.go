@@ -0,0 +1,174 @@
+//
+// Copyright (c) 2024 Markku Rossi
+//
+// All rights reserved.
+//
+
+package db_test
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/markkurossi/shades/db"
+	"github.com/markkurossi/shades/db/dbtest"
+)
+
+func TestMemDeviceConformance(t *testing.T) {
+	dbtest.Run(t, dbtest.Config{
+		New: func(t *testing.T) db.Device {
+			return db.NewMemDevice(1024 * 1024)
+		},
+		Size: 1024 * 1024,
+	})
+}
+
+func TestFileConformance(t *testing.T) {
+	dbtest.Run(t, dbtest.Config{
+		New: func(t *testing.T) db.Device {
+			f, err := os.Create(filepath.Join(t.TempDir(), "test.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return f
+		},
+		Reopen: func(t *testing.T, device db.Device) db.Device {
+			f := device.(*os.File)
+			err := f.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			f, err = os.OpenFile(f.Name(), os.O_RDWR, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return f
+		},
+	})
+}
+
+func TestFileDeviceConformance(t *testing.T) {
+	dbtest.Run(t, dbtest.Config{
+		New: func(t *testing.T) db.Device {
+			dev, err := db.OpenFileDevice(
+				filepath.Join(t.TempDir(), "test.db"),
+				os.O_RDWR|os.O_CREATE)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return dev
+		},
+		Reopen: func(t *testing.T, device db.Device) db.Device {
+			dev := device.(*db.FileDevice)
+			err := dev.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			dev, err = db.OpenFileDevice(dev.Name(), os.O_RDWR)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return dev
+		},
+	})
+}
+
+func TestSegmentedDeviceConformance(t *testing.T) {
+	const segmentSize = 3000
+
+	var dir string
+	dbtest.Run(t, dbtest.Config{
+		New: func(t *testing.T) db.Device {
+			dir = t.TempDir()
+			dev, err := db.OpenSegmentedDevice(dir, segmentSize, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return dev
+		},
+		Reopen: func(t *testing.T, device db.Device) db.Device {
+			err := device.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			dev, err := db.OpenSegmentedDevice(dir, segmentSize, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return dev
+		},
+	})
+}
+
+func TestORAMDeviceConformance(t *testing.T) {
+	const blockSize = 1000
+	const numBlocks = 100
+
+	var mem *db.MemDevice
+	dbtest.Run(t, dbtest.Config{
+		New: func(t *testing.T) db.Device {
+			mem = db.NewMemDevice(4 * 1024 * 1024)
+			dev, err := db.NewORAMDevice(mem, make([]byte, 16),
+				blockSize, numBlocks)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return dev
+		},
+		Size: blockSize * numBlocks,
+		Reopen: func(t *testing.T, device db.Device) db.Device {
+			err := device.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			dev, err := db.OpenORAMDevice(mem, make([]byte, 16),
+				blockSize, numBlocks)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return dev
+		},
+	})
+}
+
+func TestRemoteDeviceConformance(t *testing.T) {
+	serve := func(t *testing.T, device db.Device) db.Device {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go db.ServeDevice(l, device)
+		t.Cleanup(func() {
+			l.Close()
+			device.Close()
+		})
+		dev, err := db.DialDevice("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return dev
+	}
+	t.Run("Mem", func(t *testing.T) {
+		dbtest.Run(t, dbtest.Config{
+			New: func(t *testing.T) db.Device {
+				return serve(t, db.NewMemDevice(1024*1024))
+			},
+			Size: 1024 * 1024,
+		})
+	})
+	t.Run("File", func(t *testing.T) {
+		dbtest.Run(t, dbtest.Config{
+			New: func(t *testing.T) db.Device {
+				dev, err := db.OpenFileDevice(
+					filepath.Join(t.TempDir(), "test.db"),
+					os.O_RDWR|os.O_CREATE)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return serve(t, dev)
+			},
+		})
+	})
+}
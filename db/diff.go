@@ -0,0 +1,262 @@
+//
+// Copyright (c) 2024 Markku Rossi
+//
+// All rights reserved.
+//
+
+package db
+
+import (
+	"slices"
+)
+
+// Changes describe the logical pages that changed between two
+// database generations.
+type Changes struct {
+	Added    []LogicalID
+	Removed  []LogicalID
+	Modified []LogicalID
+}
+
+// Diff returns the logical pages that changed between the database
+// generations genA and genB. The added pages are mapped in genB but
+// not in genA, the removed pages are mapped in genA but not in genB,
+// and the modified pages are mapped to different physical pages in
+// the generations. Since the commits are copy-on-write, the page
+// table subtrees that share the same physical page are skipped.
+func (db *DB) Diff(genA, genB uint64) (*Changes, error) {
+	err := db.flushPending()
+	if err != nil {
+		return nil, err
+	}
+	a, err := db.pt.rootAt(genA)
+	if err != nil {
+		return nil, err
+	}
+	b, err := db.pt.rootAt(genB)
+	if err != nil {
+		return nil, err
+	}
+	return diffRoots(db.device, a, b)
+}
+
+// diffRoots returns the logical pages that changed between the
+// database generations identified by the root pointers a and b.
+func diffRoots(device Device, a, b RootPointer) (*Changes, error) {
+	d := &differ{
+		device:    device,
+		pageSize:  int(a.PageSize),
+		perPage:   uint64(a.idsPerPage()),
+		entrySize: a.entrySize(),
+		changes:   new(Changes),
+	}
+	err := d.diff(a.PageTable, int(a.Depth), b.PageTable, int(b.Depth), 0)
+	if err != nil {
+		return nil, err
+	}
+	if a.Objects != b.Objects {
+		err = d.diffObjects(a.Objects, b.Objects)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return d.changes, nil
+}
+
+// diffObjects compares the object page tables of the object
+// directories a and b.
+func (d *differ) diffObjects(a, b PhysicalID) error {
+	objectsA := make(map[uint16]PhysicalID)
+	err := d.objects(objectsA, a)
+	if err != nil {
+		return err
+	}
+	objectsB := make(map[uint16]PhysicalID)
+	err = d.objects(objectsB, b)
+	if err != nil {
+		return err
+	}
+	var ids []uint16
+	for id := range objectsA {
+		ids = append(ids, id)
+	}
+	for id := range objectsB {
+		_, ok := objectsA[id]
+		if !ok {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+
+	for _, id := range ids {
+		ea := objectsA[id]
+		eb := objectsB[id]
+		if ea == eb {
+			continue
+		}
+		d.objectID = id
+		tableA, depthA := ea.treeRoot()
+		tableB, depthB := eb.treeRoot()
+		err = d.diff(tableA, depthA, tableB, depthB, 0)
+		if err != nil {
+			return err
+		}
+	}
+	d.objectID = 0
+
+	return nil
+}
+
+// objects collects the object page tables of the object directory
+// dir into the map result.
+func (d *differ) objects(result map[uint16]PhysicalID, dir PhysicalID) error {
+	table, depth := dir.treeRoot()
+	return d.leaves(table, depth, 0, func(key uint64, entry PhysicalID) {
+		result[uint16(key)] = entry
+	})
+}
+
+// leaves calls the function fn for all non-zero entries of the page
+// table tree rooted at pid.
+func (d *differ) leaves(pid PhysicalID, depth int, base uint64,
+	fn func(key uint64, entry PhysicalID)) error {
+
+	entries, err := d.entries(pid)
+	if err != nil {
+		return err
+	}
+	for i, entry := range entries {
+		if entry.Pagenum() == 0 {
+			continue
+		}
+		if depth > 0 {
+			err = d.leaves(entry, depth-1, base+uint64(i)*d.span(depth-1),
+				fn)
+			if err != nil {
+				return err
+			}
+		} else {
+			fn(base+uint64(i), entry)
+		}
+	}
+	return nil
+}
+
+type differ struct {
+	device    Device
+	pageSize  int
+	perPage   uint64
+	entrySize int
+	objectID  uint16
+	changes   *Changes
+}
+
+// span returns the number of logical pages mapped by a page table
+// page at the depth.
+func (d *differ) span(depth int) uint64 {
+	span := d.perPage
+	for ; depth > 0; depth-- {
+		span *= d.perPage
+	}
+	return span
+}
+
+// diff compares the page table trees a and b of possibly different
+// depths. The shallower tree maps only the first subtree of the deeper
+// tree.
+func (d *differ) diff(a PhysicalID, depthA int, b PhysicalID, depthB int,
+	base uint64) error {
+
+	if depthA == depthB {
+		return d.diffSame(a, b, depthA, base)
+	}
+	if depthA > depthB {
+		entries, err := d.entries(a)
+		if err != nil {
+			return err
+		}
+		err = d.diff(entries[0], depthA-1, b, depthB, base)
+		if err != nil {
+			return err
+		}
+		for i := 1; i < len(entries); i++ {
+			err = d.diffSame(entries[i], 0, depthA-1,
+				base+uint64(i)*d.span(depthA-1))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	entries, err := d.entries(b)
+	if err != nil {
+		return err
+	}
+	err = d.diff(a, depthA, entries[0], depthB-1, base)
+	if err != nil {
+		return err
+	}
+	for i := 1; i < len(entries); i++ {
+		err = d.diffSame(0, entries[i], depthB-1,
+			base+uint64(i)*d.span(depthB-1))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// diffSame compares the page table pages a and b at the same depth.
+func (d *differ) diffSame(a, b PhysicalID, depth int, base uint64) error {
+	if a == b {
+		return nil
+	}
+	entriesA, err := d.entries(a)
+	if err != nil {
+		return err
+	}
+	entriesB, err := d.entries(b)
+	if err != nil {
+		return err
+	}
+	for i := range entriesA {
+		ea := entriesA[i]
+		eb := entriesB[i]
+		if ea == eb {
+			continue
+		}
+		if depth > 0 {
+			err = d.diffSame(ea, eb, depth-1, base+uint64(i)*d.span(depth-1))
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		id := NewLogicalID(0, d.objectID, base+uint64(i))
+		if ea.Pagenum() == 0 {
+			d.changes.Added = append(d.changes.Added, id)
+		} else if eb.Pagenum() == 0 {
+			d.changes.Removed = append(d.changes.Removed, id)
+		} else {
+			d.changes.Modified = append(d.changes.Modified, id)
+		}
+	}
+	return nil
+}
+
+// entries returns the physical IDs of the page table page pid. The
+// zero page ID is an empty page table page.
+func (d *differ) entries(pid PhysicalID) ([]PhysicalID, error) {
+	result := make([]PhysicalID, d.perPage)
+	if pid.Pagenum() == 0 {
+		return result, nil
+	}
+	data, err := readPhysical(d.device, d.pageSize, pid)
+	if err != nil {
+		return nil, err
+	}
+	for i := range result {
+		result[i] = PhysicalID(bo.Uint64(data[i*d.entrySize:]))
+	}
+	return result, nil
+}
@@ -0,0 +1,82 @@
+//
+// Copyright (c) 2024 Markku Rossi
+//
+// All rights reserved.
+//
+
+package db
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	params := NewParams()
+	params.PageSize = 1024
+
+	db, err := Create(params, NewMemDevice(4*1024*1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gen0 := db.pt.committed().Generation
+
+	ids := writeTestPages(t, db, nil, 100, 1)
+	gen1 := db.pt.committed().Generation
+
+	// Grow the page table depth and modify two pages.
+	modified := []LogicalID{ids[3], ids[70]}
+	updated := writeTestPages(t, db, modified, 200, 2)
+	added := updated[len(modified):]
+	gen2 := db.pt.committed().Generation
+
+	if db.pt.committed().Depth == 0 {
+		t.Fatalf("page table depth did not grow")
+	}
+
+	changes, err := db.Diff(gen1, gen2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(changes.Added, added) {
+		t.Errorf("Added: got %v, expected %v", changes.Added, added)
+	}
+	if len(changes.Removed) != 0 {
+		t.Errorf("Removed: got %v, expected none", changes.Removed)
+	}
+	if !slices.Equal(changes.Modified, modified) {
+		t.Errorf("Modified: got %v, expected %v", changes.Modified, modified)
+	}
+
+	changes, err = db.Diff(gen2, gen1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(changes.Removed, added) {
+		t.Errorf("Removed: got %v, expected %v", changes.Removed, added)
+	}
+	if !slices.Equal(changes.Modified, modified) {
+		t.Errorf("Modified: got %v, expected %v", changes.Modified, modified)
+	}
+
+	changes, err = db.Diff(gen0, gen1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(changes.Added, ids) {
+		t.Errorf("Added: got %v, expected %v", changes.Added, ids)
+	}
+
+	changes, err = db.Diff(gen2, gen2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes.Added)+len(changes.Removed)+len(changes.Modified) != 0 {
+		t.Errorf("generation differs from itself: %v", changes)
+	}
+
+	_, err = db.Diff(gen2, gen2+1)
+	if err == nil {
+		t.Errorf("Diff with unknown generation succeeded")
+	}
+}
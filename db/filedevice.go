@@ -0,0 +1,55 @@
+//
+// Copyright (c) 2024 Markku Rossi
+//
+// All rights reserved.
+//
+
+package db
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// ErrLocked is returned when the database file is locked by another
+// writer.
+var ErrLocked = errors.New("database file is locked")
+
+// FileDevice implements a file-backed device. The read-write devices
+// hold an exclusive advisory lock on the file so that only one
+// process can open the database for writing. The read-only devices
+// don't take the lock and they can run concurrently with the writer.
+type FileDevice struct {
+	*os.File
+}
+
+// OpenFileDevice opens the database file as a device. The flag is
+// passed to os.OpenFile: os.O_RDONLY opens the file read-only,
+// os.O_RDWR read-write, and os.O_CREATE creates the file if it does
+// not exist. The writable devices return ErrLocked if another process
+// holds the file open for writing. The os.O_TRUNC truncates the file
+// only after the lock is taken.
+func OpenFileDevice(path string, flag int) (*FileDevice, error) {
+	f, err := os.OpenFile(path, flag&^os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		err = lockFile(f)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	if flag&os.O_TRUNC != 0 {
+		err = f.Truncate(0)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return &FileDevice{
+		File: f,
+	}, nil
+}
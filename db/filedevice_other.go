@@ -0,0 +1,25 @@
+//
+// Copyright (c) 2024 Markku Rossi
+//
+// All rights reserved.
+//
+
+//go:build !unix
+
+package db
+
+import (
+	"os"
+)
+
+const fileLocking = false
+
+// lockFile is a no-op on platforms without flock.
+func lockFile(f *os.File) error {
+	return nil
+}
+
+// syncDir is a no-op on platforms that can't sync directories.
+func syncDir(dir string) error {
+	return nil
+}
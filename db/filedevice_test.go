@@ -0,0 +1,216 @@
+//
+// Copyright (c) 2024 Markku Rossi
+//
+// All rights reserved.
+//
+
+package db
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileDeviceLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+
+	_, err := OpenFileDevice(path, os.O_RDWR)
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("missing file: got %v, expected %v", err, os.ErrNotExist)
+	}
+	writer, err := OpenFileDevice(path, os.O_RDWR|os.O_CREATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = OpenFileDevice(path, os.O_RDWR)
+	if fileLocking && !errors.Is(err, ErrLocked) {
+		t.Errorf("second writer: got %v, expected %v", err, ErrLocked)
+	}
+	reader, err := OpenFileDevice(path, os.O_RDONLY)
+	if err != nil {
+		t.Fatalf("reader: %v", err)
+	}
+	reader.Close()
+
+	err = writer.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer, err = OpenFileDevice(path, os.O_RDWR)
+	if err != nil {
+		t.Fatalf("writer after close: %v", err)
+	}
+	writer.Close()
+}
+
+func TestFileDeviceTruncateLocked(t *testing.T) {
+	if !fileLocking {
+		t.Skip("file locking not supported")
+	}
+	path := filepath.Join(t.TempDir(), "test.db")
+
+	writer, err := OpenFileDevice(path, os.O_RDWR|os.O_CREATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = writer.WriteAt([]byte("data"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = OpenFileDevice(path, os.O_RDWR|os.O_TRUNC)
+	if !errors.Is(err, ErrLocked) {
+		t.Errorf("truncating writer: got %v, expected %v", err, ErrLocked)
+	}
+	fi, err := writer.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != 4 {
+		t.Errorf("locked file truncated to %v bytes", fi.Size())
+	}
+	writer.Close()
+
+	writer, err = OpenFileDevice(path, os.O_RDWR|os.O_TRUNC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err = writer.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != 0 {
+		t.Errorf("file not truncated: size %v", fi.Size())
+	}
+	writer.Close()
+}
+
+func TestReadOnly(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+
+	params := NewParams()
+	params.PageSize = 1024
+
+	wdev, err := OpenFileDevice(path, os.O_RDWR|os.O_CREATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wdev.Close()
+	writer, err := Create(params, wdev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := writeTestPages(t, writer, nil, 10, 1)
+
+	rdev, err := OpenFileDevice(path, os.O_RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rdev.Close()
+	params.ReadOnly = true
+	reader, err := Open(params, rdev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyTestPages(t, reader, ids, 1)
+
+	_, err = reader.NewTransaction(true)
+	if !errors.Is(err, ErrReadOnly) {
+		t.Errorf("NewTransaction(true): got %v, expected %v", err, ErrReadOnly)
+	}
+	_, err = reader.NewConcurrentTransaction()
+	if !errors.Is(err, ErrReadOnly) {
+		t.Errorf("NewConcurrentTransaction: got %v, expected %v",
+			err, ErrReadOnly)
+	}
+	_, err = Create(params, NewMemDevice(1024*1024))
+	if !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Create: got %v, expected %v", err, ErrReadOnly)
+	}
+
+	changed, err := reader.Refresh()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed {
+		t.Errorf("Refresh changed generation without commits")
+	}
+
+	ids = writeTestPages(t, writer, ids, 5, 2)
+	verifyTestPages(t, reader, ids[:10], 1)
+
+	changed, err = reader.Refresh()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changed {
+		t.Errorf("Refresh did not change generation")
+	}
+	if reader.Root().Generation != writer.Root().Generation {
+		t.Errorf("reader generation %v, expected %v",
+			reader.Root().Generation, writer.Root().Generation)
+	}
+	verifyTestPages(t, reader, ids, 2)
+
+	tr, err := reader.NewTransaction(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = reader.Refresh()
+	if err == nil {
+		t.Errorf("Refresh succeeded with active transaction")
+	}
+	tr.Commit()
+}
+
+func TestReadOnlyWAL(t *testing.T) {
+	params := NewParams()
+	params.PageSize = 1024
+	params.WAL = true
+	params.WALSize = 64 * 1024
+
+	device := NewMemDevice(4 * 1024 * 1024)
+	writer, err := Create(params, device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := writeTestPages(t, writer, nil, 10, 1)
+
+	params.ReadOnly = true
+	reader, err := Open(params, device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyTestPages(t, reader, ids, 1)
+
+	err = reader.Checkpoint()
+	if !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Checkpoint: got %v, expected %v", err, ErrReadOnly)
+	}
+
+	ids = writeTestPages(t, writer, ids, 5, 2)
+	changed, err := reader.Refresh()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changed {
+		t.Errorf("Refresh did not change generation")
+	}
+	verifyTestPages(t, reader, ids, 2)
+
+	err = writer.Checkpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids = writeTestPages(t, writer, ids, 0, 3)
+	_, err = reader.Refresh()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reader.Root().Generation != writer.Root().Generation {
+		t.Errorf("reader generation %v, expected %v",
+			reader.Root().Generation, writer.Root().Generation)
+	}
+	verifyTestPages(t, reader, ids, 3)
+}
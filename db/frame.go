@@ -0,0 +1,52 @@
+//
+// Copyright (c) 2024 Markku Rossi
+//
+// All rights reserved.
+//
+
+package db
+
+import (
+	"fmt"
+	"io"
+)
+
+// FrameHeaderSize defines the size of the frame header of the
+// replication and block device protocols. The frames start with the
+// frame type and the payload length, followed by the payload.
+const FrameHeaderSize = 5
+
+// maxFramePayload specifies the maximum frame payload size: the
+// largest page and its device offset.
+const maxFramePayload = 1024*1024 + 8
+
+func writeFrame(w io.Writer, t byte, payload []byte) error {
+	buf := make([]byte, FrameHeaderSize, FrameHeaderSize+len(payload))
+	buf[0] = t
+	bo.PutUint32(buf[1:], uint32(len(payload)))
+	buf = append(buf, payload...)
+
+	_, err := w.Write(buf)
+	return err
+}
+
+func readFrame(r io.Reader) (byte, []byte, error) {
+	var hdr [FrameHeaderSize]byte
+	_, err := io.ReadFull(r, hdr[:])
+	if err != nil {
+		return 0, nil, err
+	}
+	length := bo.Uint32(hdr[1:])
+	if length > maxFramePayload {
+		return 0, nil, fmt.Errorf("frame too long: %v", length)
+	}
+	payload := make([]byte, length)
+	_, err = io.ReadFull(r, payload)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	return hdr[0], payload, nil
+}
@@ -0,0 +1,279 @@
+//
+// Copyright (c) 2024 Markku Rossi
+//
+// All rights reserved.
+//
+
+package db
+
+import (
+	"fmt"
+)
+
+// Root history page offsets. The history page holds the retained
+// root pointers, newest first, and a link to the next, older, history
+// page. The entry size is the size of the root pointers in the page
+// and it selects their layout.
+const (
+	HistOfsCount     = 0
+	HistOfsEntrySize = 2
+	HistOfsNext      = 8
+	HistOfsEntries   = 16
+)
+
+// NewTransactionAt starts a read-only transaction that views the
+// retained database generation. The transaction does not conflict
+// with the base transactions.
+func (db *DB) NewTransactionAt(generation uint64) (*BaseTransaction, error) {
+	err := db.flushPending()
+	if err != nil {
+		return nil, err
+	}
+	root, err := db.pt.rootAt(generation)
+	if err != nil {
+		return nil, err
+	}
+	return &BaseTransaction{
+		cache: db.cache,
+		pt:    db.pt,
+		root:  &root,
+	}, nil
+}
+
+// pushHistory adds the current committed root pointer into the root
+// history of the transaction.
+func (pt *PageTable) pushHistory(tr *BaseTransaction) error {
+	window := pt.db.params.RetainGenerations
+	size := pt.root1.size()
+	capacity := (pt.root1.payloadSize() - HistOfsEntries) / size
+
+	var count int
+	var next PhysicalID
+	var old []byte
+	var oldSize int
+
+	if pt.root0.Snapshots != 0 {
+		ref, err := pt.db.cache.Get(pt.root0.Snapshots)
+		if err != nil {
+			return err
+		}
+		defer ref.release()
+		old = ref.Read()
+
+		count, oldSize, next, err = pt.parseHistory(pt.root0.Snapshots, old,
+			pt.root0.payloadSize())
+		if err != nil {
+			return err
+		}
+		if count >= capacity && window > capacity {
+			// Chain the full history page and cut the chain after
+			// the retained generations.
+			count = 0
+			next, err = pt.trimHistory(tr, pt.root0.Snapshots, window-1)
+			if err != nil {
+				return err
+			}
+		} else if limit := min(window, capacity) - 1; count > limit {
+			count = limit
+		}
+		if window <= capacity {
+			next = 0
+		}
+	}
+
+	pid, err := pt.newPhysicalID()
+	if err != nil {
+		return err
+	}
+	ref, err := pt.db.cache.New(pid, nil)
+	if err != nil {
+		pt.freePhysicalID(pid)
+		return err
+	}
+	tr.writable[pid] = 0
+	ref.label(tr, PageTypeHistory, 0)
+	buf := ref.Data()
+
+	bo.PutUint16(buf[HistOfsCount:], uint16(count+1))
+	bo.PutUint16(buf[HistOfsEntrySize:], uint16(size))
+	bo.PutUint64(buf[HistOfsNext:], uint64(next))
+	// The root pointers are stored in the format version of the
+	// transaction, which differs from their own version only in the
+	// upgrade transaction.
+	prev := pt.root0
+	prev.Version = pt.root1.Version
+	pt.formatRootPointer(&prev, buf[HistOfsEntries:HistOfsEntries+size])
+	if count > 0 && oldSize == size {
+		copy(buf[HistOfsEntries+size:],
+			old[HistOfsEntries:HistOfsEntries+count*size])
+	} else if count > 0 {
+		// The database was upgraded and the old entries are
+		// converted into the new root pointer layout.
+		for i := 0; i < count; i++ {
+			ofs := HistOfsEntries + i*oldSize
+			rp, err := pt.parseRootPointer(old[ofs : ofs+oldSize])
+			if err != nil {
+				ref.release()
+				return err
+			}
+			rp.Version = pt.root1.Version
+			ofs = HistOfsEntries + (i+1)*size
+			pt.formatRootPointer(&rp, buf[ofs:ofs+size])
+		}
+	}
+	ref.release()
+
+	pt.root1.Snapshots = pid
+
+	return nil
+}
+
+// trimHistory returns a history chain, which holds at most keep
+// newest root pointers of the chain starting from the page pid. The
+// committed history pages are never modified and the pages whose
+// count or link changes are copied into new pages.
+func (pt *PageTable) trimHistory(tr *BaseTransaction, pid PhysicalID,
+	keep int) (PhysicalID, error) {
+
+	if pid == 0 || keep <= 0 {
+		return 0, nil
+	}
+	ref, err := pt.db.cache.Get(pid)
+	if err != nil {
+		return 0, err
+	}
+	defer ref.release()
+	buf := ref.Read()
+
+	count, _, next, err := pt.parseHistory(pid, buf, pt.root0.payloadSize())
+	if err != nil {
+		return 0, err
+	}
+	trimmed, err := pt.trimHistory(tr, next, keep-count)
+	if err != nil {
+		return 0, err
+	}
+	if count <= keep && trimmed == next {
+		return pid, nil
+	}
+
+	newPid, err := pt.newPhysicalID()
+	if err != nil {
+		return 0, err
+	}
+	newRef, err := pt.db.cache.New(newPid, nil)
+	if err != nil {
+		pt.freePhysicalID(newPid)
+		return 0, err
+	}
+	tr.writable[newPid] = 0
+	newRef.label(tr, PageTypeHistory, 0)
+	data := newRef.Data()
+	copy(data, buf)
+	bo.PutUint16(data[HistOfsCount:], uint16(min(count, keep)))
+	bo.PutUint64(data[HistOfsNext:], uint64(trimmed))
+	newRef.release()
+
+	return newPid, nil
+}
+
+// rootAt returns the committed root pointer of the generation. The
+// generation must be the latest committed generation or it must be
+// retained in the root history.
+func (pt *PageTable) rootAt(generation uint64) (RootPointer, error) {
+	root := pt.committed()
+	if root.Generation == generation {
+		return root, nil
+	}
+	window := pt.db.params.RetainGenerations
+	pageSize := int(root.PageSize)
+
+	for pid := root.Snapshots; pid != 0 && window > 0; {
+		buf, err := readPhysical(pt.db.device, pageSize, pid)
+		if err != nil {
+			return RootPointer{}, err
+		}
+		count, size, next, err := pt.parseHistory(pid, buf,
+			root.payloadSize())
+		if err != nil {
+			return RootPointer{}, err
+		}
+		for i := 0; i < count && window > 0; i++ {
+			ofs := HistOfsEntries + i*size
+			rp, err := pt.parseRootPointer(buf[ofs : ofs+size])
+			if err != nil {
+				return RootPointer{}, err
+			}
+			if rp.Generation != generation {
+				window--
+				continue
+			}
+			err = root.checkRetained(rp)
+			if err != nil {
+				return RootPointer{}, err
+			}
+			return rp, nil
+		}
+		pid = next
+	}
+	return RootPointer{}, fmt.Errorf("generation %v not retained", generation)
+}
+
+// checkRetained checks that the retained root pointer old has the
+// geometry of the committed root pointer rp. The retained root
+// pointers are validated like the committed ones when they are parsed
+// but the validation can't compare them against the database.
+func (rp RootPointer) checkRetained(old RootPointer) error {
+	if old.PageSize != rp.PageSize {
+		return fmt.Errorf("generation %v: invalid page size %v",
+			old.Generation, old.PageSize)
+	}
+	if old.Flags&rootFlagsLayout != rp.Flags&rootFlagsLayout {
+		return fmt.Errorf("generation %v: invalid flags %04x",
+			old.Generation, old.Flags)
+	}
+	if old.Generation >= rp.Generation ||
+		old.NextPhysical > rp.NextPhysical {
+		return fmt.Errorf("generation %v: invalid retained root pointer",
+			old.Generation)
+	}
+	return nil
+}
+
+// parseHistory parses the header of the history page pid. It returns
+// the number of root pointers in the page, the size of the root
+// pointers, and the link to the next history page. The history pages
+// are allocated after the older pages of the chain so the links point
+// to lower page numbers, which bounds the walks of the chain. The
+// history pages are never compressed and the links have no meta bits.
+func (pt *PageTable) parseHistory(pid PhysicalID, buf []byte,
+	payloadSize int) (int, int, PhysicalID, error) {
+
+	size, err := pt.histEntrySize(buf)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	count := min(int(bo.Uint16(buf[HistOfsCount:])),
+		(payloadSize-HistOfsEntries)/size)
+	if count == 0 {
+		return 0, 0, 0, fmt.Errorf("history page %v: no root pointers", pid)
+	}
+	next := PhysicalID(bo.Uint64(buf[HistOfsNext:]))
+	if next.Meta() != 0 || next.Pagenum() >= pid.Pagenum() {
+		return 0, 0, 0, fmt.Errorf("history page %v: invalid link %v",
+			pid, next)
+	}
+	return count, size, next, nil
+}
+
+// histEntrySize returns the size of the root pointers in the history
+// page. The upgraded databases can have history pages of the older
+// format versions.
+func (pt *PageTable) histEntrySize(buf []byte) (int, error) {
+	size := int(bo.Uint16(buf[HistOfsEntrySize:]))
+	_, _, ok := layoutOf(size)
+	if !ok {
+		return 0, fmt.Errorf("invalid history entry size %v", size)
+	}
+	return size, nil
+}
@@ -0,0 +1,226 @@
+//
+// Copyright (c) 2024 Markku Rossi
+//
+// All rights reserved.
+//
+
+package db
+
+import (
+	"testing"
+)
+
+func TestTimeTravel(t *testing.T) {
+	for _, window := range []int{4, 30} {
+		params := NewParams()
+		params.PageSize = 1024
+		params.RetainGenerations = window
+
+		device := NewMemDevice(1024 * 1024)
+		db, err := Create(params, device)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := writeTestPages(t, db, nil, 1, 0)
+
+		var gens []uint64
+		for i := 1; i <= 40; i++ {
+			writeTestPages(t, db, ids, 0, byte(i))
+			gens = append(gens, db.pt.committed().Generation)
+		}
+		db, err = Open(params, device)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i, gen := range gens {
+			tr, err := db.NewTransactionAt(gen)
+			retained := len(gens)-1-i <= window
+			if !retained {
+				if err == nil {
+					t.Errorf("window %v: generation %v retained",
+						window, gen)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatalf("window %v: generation %v: %v", window, gen, err)
+			}
+			_, _, err = tr.NewPage()
+			if err == nil {
+				t.Errorf("NewPage succeeded in historical transaction")
+			}
+			ref, err := tr.ReadablePage(ids[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ref.Read()[8] != byte(i+1) {
+				t.Errorf("generation %v: got %v, expected %v",
+					gen, ref.Read()[8], i+1)
+			}
+			ref.Release()
+			err = tr.Commit()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestHistoryTrim(t *testing.T) {
+	params := NewParams()
+	params.PageSize = 1024
+	params.RetainGenerations = 10
+
+	device := NewMemDevice(1024 * 1024)
+	db, err := Create(params, device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := writeTestPages(t, db, nil, 1, 0)
+	for i := 1; i <= 100; i++ {
+		writeTestPages(t, db, ids, 0, byte(i))
+	}
+
+	root := db.pt.committed()
+	capacity := (root.payloadSize() - HistOfsEntries) / root.size()
+	var entries int
+	for pid := root.Snapshots; pid != 0; {
+		buf, err := readPhysical(device, params.PageSize, pid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries += int(bo.Uint16(buf[HistOfsCount:]))
+		pid = PhysicalID(bo.Uint64(buf[HistOfsNext:]))
+	}
+	if entries < params.RetainGenerations ||
+		entries >= params.RetainGenerations+capacity {
+		t.Errorf("history holds %v entries, window %v, capacity %v",
+			entries, params.RetainGenerations, capacity)
+	}
+	first := root.Generation - uint64(params.RetainGenerations)
+	for gen := first; gen < root.Generation; gen++ {
+		tr, err := db.NewTransactionAt(gen)
+		if err != nil {
+			t.Fatalf("generation %v: %v", gen, err)
+		}
+		tr.Commit()
+	}
+}
+
+func TestHistoryCorrupted(t *testing.T) {
+	for _, tc := range []struct {
+		chained bool
+		count   int
+		next    func(pid PhysicalID) PhysicalID
+	}{
+		{false, 0, func(pid PhysicalID) PhysicalID { return 0 }},
+		{false, 0, func(pid PhysicalID) PhysicalID { return pid }},
+		{false, 1, func(pid PhysicalID) PhysicalID { return pid }},
+		{false, 1, func(pid PhysicalID) PhysicalID { return pid + 1 }},
+		{true, 0, func(pid PhysicalID) PhysicalID { return pid }},
+		{true, 1, func(pid PhysicalID) PhysicalID { return pid }},
+	} {
+		params := NewParams()
+		params.PageSize = 1024
+		params.RetainGenerations = 30
+
+		device := NewMemDevice(1024 * 1024)
+		db, err := Create(params, device)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := writeTestPages(t, db, nil, 1, 0)
+		for i := 1; i <= 10; i++ {
+			writeTestPages(t, db, ids, 0, byte(i))
+		}
+		root := db.pt.committed()
+		pid := root.Snapshots
+		buf := device.buf[pid.Pagenum()*uint64(params.PageSize):]
+		if tc.chained {
+			// Corrupt the older page that is trimmed when the head
+			// page fills.
+			count := int(bo.Uint16(buf[HistOfsCount:]))
+			capacity := (params.PageSize - HistOfsEntries) / RootPtrSize
+			for i := count; i < capacity; i++ {
+				writeTestPages(t, db, ids, 0, byte(i))
+			}
+			root = db.pt.committed()
+			buf = device.buf[root.Snapshots.Pagenum()*
+				uint64(params.PageSize):]
+			pid = PhysicalID(bo.Uint64(buf[HistOfsNext:]))
+			if pid == 0 {
+				t.Fatalf("history not chained")
+			}
+			buf = device.buf[pid.Pagenum()*uint64(params.PageSize):]
+		}
+		bo.PutUint16(buf[HistOfsCount:], uint16(tc.count))
+		bo.PutUint64(buf[HistOfsNext:], uint64(tc.next(pid)))
+
+		db, err = Open(params, device)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.NewTransactionAt(2)
+		if err == nil {
+			t.Errorf("count %v, next %v: NewTransactionAt succeeded",
+				tc.count, tc.next(pid))
+		}
+		err = db.Update(func(tr *BaseTransaction) error {
+			ref, err := tr.WritablePage(ids[0])
+			if err != nil {
+				return err
+			}
+			ref.Release()
+			return nil
+		})
+		if err == nil {
+			t.Errorf("count %v, next %v: commit succeeded",
+				tc.count, tc.next(pid))
+		}
+	}
+}
+
+func TestHistoryRetainedGeometry(t *testing.T) {
+	for _, corrupt := range []func(buf []byte){
+		func(buf []byte) {
+			bo.PutUint32(buf[RootPtrOfsPageSize:], 8192)
+		},
+		func(buf []byte) {
+			flags := bo.Uint16(buf[RootPtrOfsFlags:])
+			bo.PutUint16(buf[RootPtrOfsFlags:], flags|RootFlagPageHeaders)
+		},
+		func(buf []byte) {
+			next := bo.Uint64(buf[RootPtrOfsNextPhysial:])
+			bo.PutUint64(buf[RootPtrOfsNextPhysial:], next+1000)
+		},
+	} {
+		params := NewParams()
+		params.PageSize = 1024
+		params.RetainGenerations = 30
+
+		device := NewMemDevice(1024 * 1024)
+		db, err := Create(params, device)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := writeTestPages(t, db, nil, 10, 1)
+		writeTestPages(t, db, ids, 0, 2)
+
+		root := db.pt.committed()
+		buf := device.buf[root.Snapshots.Pagenum()*uint64(params.PageSize):]
+		entry := buf[HistOfsEntries : HistOfsEntries+RootPtrSize]
+		generation := bo.Uint64(entry[RootPtrOfsGeneration:])
+		corrupt(entry)
+		fixRootChecksums(db.pt, entry, RootPtrSize)
+
+		db, err = Open(params, device)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.NewTransactionAt(generation)
+		if err == nil {
+			t.Errorf("NewTransactionAt(%v) succeeded", generation)
+		}
+	}
+}
@@ -8,6 +8,7 @@ package db
 
 import (
 	"fmt"
+	"io"
 )
 
 // MemDevice implements memory device.
@@ -29,11 +30,17 @@ func (mem *MemDevice) Close() error {
 
 // ReadAt implements Device.ReadAt.
 func (mem *MemDevice) ReadAt(b []byte, off int64) (n int, err error) {
-	if int(off)+len(b) > len(mem.buf) {
-		return 0, fmt.Errorf("reading %v bytes out of range [0...%v[",
-			int(off)+len(b)-len(mem.buf), len(mem.buf))
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %v", off)
 	}
-	return copy(b, mem.buf[off:]), nil
+	if off >= int64(len(mem.buf)) {
+		return 0, io.EOF
+	}
+	n = copy(b, mem.buf[off:])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
 }
 
 // Sync implements Device.Sync.
@@ -43,9 +50,10 @@ func (mem *MemDevice) Sync() error {
 
 // WriteAt implements Device.WriteAt.
 func (mem *MemDevice) WriteAt(b []byte, off int64) (n int, err error) {
-	if int(off)+len(b) > len(mem.buf) {
-		return 0, fmt.Errorf("writing %v bytes out of range [0...%v[",
-			int(off)+len(b)-len(mem.buf), len(mem.buf))
+	if off < 0 || off > int64(len(mem.buf)) ||
+		int64(len(b)) > int64(len(mem.buf))-off {
+		return 0, fmt.Errorf("writing %v bytes at %v out of range [0...%v[",
+			len(b), off, len(mem.buf))
 	}
 	return copy(mem.buf[off:], b), nil
 }
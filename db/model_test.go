@@ -0,0 +1,397 @@
+//
+// Copyright (c) 2024 Markku Rossi
+//
+// All rights reserved.
+//
+
+package db
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"math/rand"
+	"slices"
+	"testing"
+)
+
+var modelSeed = flag.Int64("model.seed", 0,
+	"run the model test only with the seed")
+
+var errCrashed = errors.New("device crashed")
+
+// crashDevice implements a growable memory device that simulates
+// crashes. The writes after the last Sync are pending and a crash
+// reverts a random subset of them. The device can also be set to fail
+// all writes after a number of writes.
+type crashDevice struct {
+	buf       []byte
+	pending   []pendingWrite
+	failAfter int
+}
+
+type pendingWrite struct {
+	off int64
+	old []byte
+}
+
+func (dev *crashDevice) Close() error {
+	return nil
+}
+
+func (dev *crashDevice) ReadAt(b []byte, off int64) (int, error) {
+	if off >= int64(len(dev.buf)) {
+		return 0, io.EOF
+	}
+	n := copy(b, dev.buf[off:])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (dev *crashDevice) Sync() error {
+	if dev.failAfter < 0 {
+		return errCrashed
+	}
+	dev.pending = dev.pending[:0]
+	return nil
+}
+
+func (dev *crashDevice) WriteAt(b []byte, off int64) (int, error) {
+	if dev.failAfter < 0 {
+		return 0, errCrashed
+	}
+	if dev.failAfter > 0 {
+		dev.failAfter--
+		if dev.failAfter == 0 {
+			dev.failAfter = -1
+		}
+	}
+	end := off + int64(len(b))
+	if end > int64(len(dev.buf)) {
+		dev.buf = append(dev.buf, make([]byte, end-int64(len(dev.buf)))...)
+	}
+	dev.pending = append(dev.pending, pendingWrite{
+		off: off,
+		old: slices.Clone(dev.buf[off:end]),
+	})
+	return copy(dev.buf[off:], b), nil
+}
+
+// crash reverts a random subset of the pending writes.
+func (dev *crashDevice) crash(rng *rand.Rand) {
+	for i := len(dev.pending) - 1; i >= 0; i-- {
+		if rng.Intn(2) == 0 {
+			w := dev.pending[i]
+			copy(dev.buf[w.off:], w.old)
+		}
+	}
+	dev.pending = dev.pending[:0]
+	dev.failAfter = 0
+}
+
+// model runs random operations against the database and checks the
+// results against the in-memory model of logical pages. The model
+// maps the logical pages to the fill bytes of their data.
+type model struct {
+	t         *testing.T
+	rng       *rand.Rand
+	params    Params
+	device    *crashDevice
+	db        *DB
+	tr        *BaseTransaction
+	committed map[LogicalID]byte
+	pending   map[LogicalID]byte
+	maxDepth  uint16
+}
+
+func (m *model) fatalf(format string, a ...interface{}) {
+	m.t.Helper()
+	m.t.Fatalf("page size %v: %s", m.params.PageSize, fmt.Sprintf(format, a...))
+}
+
+func (m *model) fill(ref *PageRef, id LogicalID, value byte) {
+	buf := ref.Data()
+	bo.PutUint64(buf, uint64(id))
+	for i := 8; i < len(buf); i++ {
+		buf[i] = value
+	}
+	ref.Release()
+}
+
+func (m *model) check(ref *PageRef, id LogicalID, value byte) {
+	m.t.Helper()
+	defer ref.Release()
+	buf := ref.Read()
+	if LogicalID(bo.Uint64(buf)) != id {
+		m.fatalf("page %v: invalid ID %v", id, LogicalID(bo.Uint64(buf)))
+	}
+	for i := 8; i < len(buf); i++ {
+		if buf[i] != value {
+			m.fatalf("page %v: data[%v]=%v, expected %v", id, i, buf[i], value)
+		}
+	}
+}
+
+// randomID returns a random logical ID from the pages.
+func (m *model) randomID(pages map[LogicalID]byte) LogicalID {
+	ids := slices.Sorted(maps.Keys(pages))
+	return ids[m.rng.Intn(len(ids))]
+}
+
+func (m *model) begin() {
+	if m.tr != nil {
+		return
+	}
+	tr, err := m.db.NewTransaction(true)
+	if err != nil {
+		m.fatalf("NewTransaction: %v", err)
+	}
+	m.tr = tr
+	m.pending = maps.Clone(m.committed)
+}
+
+func (m *model) newPage() {
+	m.begin()
+	ref, id, err := m.tr.NewPage()
+	if err != nil {
+		m.fatalf("NewPage: %v", err)
+	}
+	if _, ok := m.pending[id]; ok {
+		m.fatalf("NewPage returned mapped page %v", id)
+	}
+	value := byte(m.rng.Intn(256))
+	m.fill(ref, id, value)
+	m.pending[id] = value
+}
+
+func (m *model) writePage() {
+	m.begin()
+	if len(m.pending) == 0 {
+		m.newPage()
+		return
+	}
+	id := m.randomID(m.pending)
+	ref, err := m.tr.WritablePage(id)
+	if err != nil {
+		m.fatalf("WritablePage(%v): %v", id, err)
+	}
+	m.check(ref, id, m.pending[id])
+
+	ref, err = m.tr.WritablePage(id)
+	if err != nil {
+		m.fatalf("WritablePage(%v): %v", id, err)
+	}
+	value := byte(m.rng.Intn(256))
+	m.fill(ref, id, value)
+	m.pending[id] = value
+}
+
+func (m *model) readPage() {
+	pages := m.committed
+	if m.tr != nil {
+		pages = m.pending
+	}
+	if len(pages) == 0 {
+		return
+	}
+	id := m.randomID(pages)
+	if m.tr != nil {
+		ref, err := m.tr.ReadablePage(id)
+		if err != nil {
+			m.fatalf("ReadablePage(%v): %v", id, err)
+		}
+		m.check(ref, id, pages[id])
+		return
+	}
+	err := m.db.View(func(tr *BaseTransaction) error {
+		ref, err := tr.ReadablePage(id)
+		if err != nil {
+			return err
+		}
+		m.check(ref, id, pages[id])
+		return nil
+	})
+	if err != nil {
+		m.fatalf("View: %v", err)
+	}
+}
+
+func (m *model) commit() {
+	if m.tr == nil {
+		return
+	}
+	err := m.tr.Commit()
+	if err != nil {
+		m.fatalf("Commit: %v", err)
+	}
+	m.tr = nil
+	m.committed = m.pending
+	m.maxDepth = max(m.maxDepth, m.db.Root().Depth)
+}
+
+func (m *model) abort() {
+	if m.tr == nil {
+		return
+	}
+	m.tr.Abort()
+	m.tr = nil
+}
+
+func (m *model) reopen() {
+	m.abort()
+	m.open()
+}
+
+func (m *model) open() {
+	db, err := Open(m.params, m.device)
+	if err != nil {
+		m.fatalf("Open: %v", err)
+	}
+	m.db = db
+	m.verify()
+}
+
+// crash drops the database with its active transaction, reverts a
+// random subset of the unsynced writes, and reopens the database.
+func (m *model) crash() {
+	m.tr = nil
+	m.device.crash(m.rng)
+	m.open()
+}
+
+// crashCommit crashes the device during the commit of the active
+// transaction. The reopened database must hold the generation before
+// or after the commit.
+func (m *model) crashCommit() {
+	m.begin()
+	gen := m.db.Root().Generation
+	m.device.failAfter = 1 + m.rng.Intn(8)
+	err := m.tr.Commit()
+	m.tr = nil
+	if err == nil {
+		// All writes fit before the failure.
+		m.committed = m.pending
+		m.device.failAfter = 0
+		return
+	}
+	m.device.crash(m.rng)
+	db, err := Open(m.params, m.device)
+	if err != nil {
+		m.fatalf("Open: %v", err)
+	}
+	m.db = db
+	switch db.Root().Generation {
+	case gen:
+	case gen + 1:
+		m.committed = m.pending
+	default:
+		m.fatalf("generation %v after crash, expected %v or %v",
+			db.Root().Generation, gen, gen+1)
+	}
+	m.verify()
+}
+
+// verify checks all committed pages.
+func (m *model) verify() {
+	m.t.Helper()
+	err := m.db.View(func(tr *BaseTransaction) error {
+		for _, id := range slices.Sorted(maps.Keys(m.committed)) {
+			ref, err := tr.ReadablePage(id)
+			if err != nil {
+				return err
+			}
+			m.check(ref, id, m.committed[id])
+		}
+		return nil
+	})
+	if err != nil {
+		m.fatalf("verify: %v", err)
+	}
+}
+
+func runModel(t *testing.T, seed int64, pageSize, steps int) uint16 {
+	params := NewParams()
+	params.PageSize = pageSize
+	params.RetainGenerations = 0
+
+	m := &model{
+		t:         t,
+		rng:       rand.New(rand.NewSource(seed)),
+		params:    params,
+		device:    new(crashDevice),
+		committed: make(map[LogicalID]byte),
+	}
+	db, err := Create(params, m.device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.db = db
+
+	ops := []struct {
+		weight int
+		fn     func()
+	}{
+		{30, m.newPage},
+		{25, m.writePage},
+		{15, m.readPage},
+		{10, m.commit},
+		{3, m.abort},
+		{1, m.reopen},
+		{1, m.crash},
+		{2, m.crashCommit},
+	}
+	var total int
+	for _, op := range ops {
+		total += op.weight
+	}
+	for i := 0; i < steps; i++ {
+		r := m.rng.Intn(total)
+		for _, op := range ops {
+			if r < op.weight {
+				op.fn()
+				break
+			}
+			r -= op.weight
+		}
+	}
+	m.commit()
+	m.reopen()
+
+	return m.maxDepth
+}
+
+func TestModel(t *testing.T) {
+	seeds := []int64{1, 2, 3}
+	if *modelSeed != 0 {
+		seeds = []int64{*modelSeed}
+	}
+	configs := []struct {
+		pageSize int
+		steps    int
+	}{
+		{1024, 1500},
+		{4 * 1024, 1000},
+		{64 * 1024, 300},
+		{1024 * 1024, 60},
+	}
+	if testing.Short() {
+		configs = configs[:2]
+	}
+	for _, config := range configs {
+		var depth uint16
+		for _, seed := range seeds {
+			name := fmt.Sprintf("%v/%v", config.pageSize, seed)
+			t.Run(name, func(t *testing.T) {
+				depth = max(depth, runModel(t, seed, config.pageSize,
+					config.steps))
+			})
+		}
+		if config.pageSize == 1024 && depth == 0 {
+			t.Errorf("page table depth did not grow")
+		}
+	}
+}
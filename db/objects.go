@@ -0,0 +1,168 @@
+//
+// Copyright (c) 2024 Markku Rossi
+//
+// All rights reserved.
+//
+
+package db
+
+import (
+	"fmt"
+)
+
+// NewObjectPage allocates a new page for the object objectID. The
+// pages of the object are mapped by the object's own page table,
+// which is created when the first page of the object is allocated.
+// The page numbers of the object pages start from 1 and grow
+// sequentially.
+func (tr *BaseTransaction) NewObjectPage(objectID uint16) (
+	*PageRef, LogicalID, error) {
+
+	tr.pt.db.m.Lock()
+	defer tr.pt.db.m.Unlock()
+
+	if !tr.rw {
+		return nil, 0, fmt.Errorf("read-only transaction")
+	}
+	err := tr.pt.checkObjectID(objectID)
+	if err != nil {
+		return nil, 0, err
+	}
+	id, err := tr.pt.allocObjectID(tr, objectID)
+	if err != nil {
+		return nil, 0, err
+	}
+	ref, id, err := tr.newPage(id)
+	if err != nil {
+		return nil, 0, err
+	}
+	return tr.track(ref, false), id, nil
+}
+
+// DropObject removes the object objectID and its page table from the
+// database. The object pages and the object page table pages are not
+// reachable from the generations committed after the transaction.
+func (tr *BaseTransaction) DropObject(objectID uint16) error {
+	tr.pt.db.m.Lock()
+	defer tr.pt.db.m.Unlock()
+
+	if !tr.rw {
+		return fmt.Errorf("read-only transaction")
+	}
+	err := tr.pt.checkObjectID(objectID)
+	if err != nil {
+		return err
+	}
+	return tr.pt.dropObject(tr, objectID)
+}
+
+// checkObjectID checks that the object page tables are enabled and
+// that the objectID is a valid object ID.
+func (pt *PageTable) checkObjectID(objectID uint16) error {
+	if pt.root0.Flags&RootFlagObjectTables == 0 {
+		return fmt.Errorf("object tables not enabled")
+	}
+	if objectID == 0 || objectID&0xc000 != 0 {
+		return fmt.Errorf("invalid object ID %v", objectID)
+	}
+	return nil
+}
+
+// object returns the root and depth of the page table of the object
+// objectID. The function returns a zero root if the object does not
+// exist.
+func (pt *PageTable) object(tr *BaseTransaction, objectID uint16) (
+	PhysicalID, int, error) {
+
+	root := pt.rootFor(tr)
+	dir, dirDepth := root.Objects.treeRoot()
+	entry, _, err := pt.lookupTree(tr, root, dir, dirDepth, nil,
+		uint64(objectID))
+	if err != nil {
+		return 0, 0, err
+	}
+	table, depth := entry.treeRoot()
+	return table, depth, nil
+}
+
+// allocObjectID allocates a new logical ID for the object
+// objectID. The ID follows the last mapped page of the object.
+func (pt *PageTable) allocObjectID(tr *BaseTransaction, objectID uint16) (
+	LogicalID, error) {
+
+	table, depth, err := pt.object(tr, objectID)
+	if err != nil {
+		return 0, err
+	}
+	var last uint64
+	if table != 0 {
+		last, err = pt.lastMapped(tr, table, depth)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return NewLogicalID(0, objectID, last+1), nil
+}
+
+// lastMapped returns the largest mapped key of the page table tree
+// rooted at table.
+func (pt *PageTable) lastMapped(tr *BaseTransaction, table PhysicalID,
+	depth int) (uint64, error) {
+
+	root := pt.rootFor(tr)
+	perPage := root.idsPerPage()
+	entrySize := root.entrySize()
+
+	var key uint64
+	for ; depth >= 0; depth-- {
+		ref, err := pt.db.cache.Get(table)
+		if err != nil {
+			return 0, err
+		}
+		buf := ref.Read()
+		idx := perPage - 1
+		for ; idx > 0; idx-- {
+			if PhysicalID(bo.Uint64(buf[idx*entrySize:])).Pagenum() != 0 {
+				break
+			}
+		}
+		table = PhysicalID(bo.Uint64(buf[idx*entrySize:]))
+		ref.release()
+
+		key = key*uint64(perPage) + uint64(idx)
+		if table.Pagenum() == 0 {
+			// Empty subtree.
+			for ; depth > 0; depth-- {
+				key *= uint64(perPage)
+			}
+			break
+		}
+	}
+	return key, nil
+}
+
+func (pt *PageTable) dropObject(tr *BaseTransaction, objectID uint16) error {
+	if tr.concurrent {
+		return fmt.Errorf("DropObject not supported in concurrent transactions")
+	}
+	table, _, err := pt.object(tr, objectID)
+	if err != nil {
+		return err
+	}
+	if table == 0 {
+		return fmt.Errorf("unknown object %v", objectID)
+	}
+	err = pt.setObject(tr, objectID, 0)
+	if err != nil {
+		return err
+	}
+	for id := range tr.written {
+		if id.ObjectID() == objectID {
+			delete(tr.written, id)
+		}
+	}
+	tr.dropped = append(tr.dropped, objectID)
+	clear(pt.tlb)
+
+	return nil
+}
@@ -0,0 +1,197 @@
+//
+// Copyright (c) 2024 Markku Rossi
+//
+// All rights reserved.
+//
+
+package db
+
+import (
+	"slices"
+	"testing"
+)
+
+func writeObjectPages(t testing.TB, db *DB, objectID uint16, count int,
+	value byte) []LogicalID {
+
+	tr, err := db.NewTransaction(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []LogicalID
+	for i := 0; i < count; i++ {
+		ref, id, err := tr.NewObjectPage(objectID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id.ObjectID() != objectID {
+			t.Fatalf("NewObjectPage: got object %v, expected %v",
+				id.ObjectID(), objectID)
+		}
+		buf := ref.Data()
+		bo.PutUint64(buf, uint64(id))
+		for i := 8; i < len(buf); i++ {
+			buf[i] = value
+		}
+		ref.Release()
+		ids = append(ids, id)
+	}
+	err = tr.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ids
+}
+
+func objectDepth(t *testing.T, db *DB, objectID uint16) int {
+	tr, err := db.NewTransaction(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Commit()
+
+	table, depth, err := db.pt.object(tr, objectID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if table == 0 {
+		t.Fatalf("object %v not found", objectID)
+	}
+	return depth
+}
+
+func TestObjectTables(t *testing.T) {
+	params := NewParams()
+	params.PageSize = 1024
+	params.ObjectTables = true
+
+	device := NewMemDevice(4 * 1024 * 1024)
+	db, err := Create(params, device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	global := writeTestPages(t, db, nil, 10, 1)
+	large := writeObjectPages(t, db, 1, 300, 2)
+	small := writeObjectPages(t, db, 2, 5, 3)
+
+	if large[0].Pagenum() != 1 || small[0].Pagenum() != 1 {
+		t.Errorf("object pages start from %v and %v, expected 1",
+			large[0].Pagenum(), small[0].Pagenum())
+	}
+	if db.pt.committed().Depth != 0 {
+		t.Errorf("global page table depth %v, expected 0",
+			db.pt.committed().Depth)
+	}
+	if objectDepth(t, db, 1) != 1 {
+		t.Errorf("object 1 depth %v, expected 1", objectDepth(t, db, 1))
+	}
+	if objectDepth(t, db, 2) != 0 {
+		t.Errorf("object 2 depth %v, expected 0", objectDepth(t, db, 2))
+	}
+
+	db, err = Open(params, device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyTestPages(t, db, global, 1)
+	verifyTestPages(t, db, large, 2)
+	verifyTestPages(t, db, small, 3)
+
+	more := writeObjectPages(t, db, 2, 2, 4)
+	if more[0].Pagenum() != 6 {
+		t.Errorf("object page number %v, expected 6", more[0].Pagenum())
+	}
+
+	// Drop the large object.
+	gen := db.pt.committed().Generation
+	tr, err := db.NewTransaction(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tr.DropObject(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tr.DropObject(3)
+	if err == nil {
+		t.Errorf("dropped unknown object")
+	}
+	err = tr.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tr, err = db.NewTransaction(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tr.ReadablePage(large[0])
+	if err == nil {
+		t.Errorf("dropped object page is readable")
+	}
+	err = tr.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyTestPages(t, db, global, 1)
+	verifyTestPages(t, db, small, 3)
+	verifyTestPages(t, db, more, 4)
+
+	changes, err := db.Diff(gen, db.pt.committed().Generation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(changes.Removed, large) {
+		t.Errorf("Removed: got %v, expected %v", changes.Removed, large)
+	}
+	if len(changes.Added) != 0 || len(changes.Modified) != 0 {
+		t.Errorf("unexpected changes: %v, %v", changes.Added, changes.Modified)
+	}
+
+	// The dropped object starts from an empty page table.
+	recreated := writeObjectPages(t, db, 1, 1, 5)
+	if recreated[0] != large[0] {
+		t.Errorf("recreated object page %v, expected %v",
+			recreated[0], large[0])
+	}
+
+	backup := NewMemDevice(4 * 1024 * 1024)
+	err = db.Backup(backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored, err := Restore(params, backup, NewMemDevice(4*1024*1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyTestPages(t, restored, global, 1)
+	verifyTestPages(t, restored, small, 3)
+	verifyTestPages(t, restored, more, 4)
+	verifyTestPages(t, restored, recreated, 5)
+}
+
+func TestObjectTablesDisabled(t *testing.T) {
+	params := NewParams()
+	params.PageSize = 1024
+
+	db, err := Create(params, NewMemDevice(1024*1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr, err := db.NewTransaction(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = tr.NewObjectPage(1)
+	if err == nil {
+		t.Errorf("NewObjectPage succeeded without object tables")
+	}
+	tr.Abort()
+
+	params.ObjectTables = true
+	params.AuthKey = make([]byte, 16)
+	_, err = Create(params, NewMemDevice(1024*1024))
+	if err == nil {
+		t.Errorf("Create succeeded with object tables and AuthKey")
+	}
+}
@@ -0,0 +1,543 @@
+//
+// Copyright (c) 2024 Markku Rossi
+//
+// All rights reserved.
+//
+
+package db
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"sync"
+)
+
+// ORAMBucketSize defines the number of blocks in an ORAM bucket.
+const ORAMBucketSize = 4
+
+// ORAMStashSize defines the maximum number of stash blocks that the
+// device state can hold. The state has a fixed size so that its size
+// does not reveal the number of blocks in the stash.
+const ORAMStashSize = 64
+
+const oramDummy = ^uint64(0)
+
+// ORAM state offsets. The state holds the position map, the current
+// slots and the versions of the buckets, and the stash blocks.
+const (
+	ORAMStateOfsSeq       = 0
+	ORAMStateOfsBlockSize = 8
+	ORAMStateOfsNumBlocks = 12
+	ORAMStateOfsStash     = 20
+	ORAMStateOfsPositions = 24
+)
+
+// ORAMDevice implements the Path ORAM oblivious RAM over an
+// underlying device. The device stores blocks in a binary tree of
+// encrypted buckets and each block access reads and writes one
+// uniformly random path of the tree so the storage host does not
+// learn which blocks are accessed.
+//
+// The position map and the stash are kept in the client memory and
+// Sync stores them, encrypted, into one of the two state slots in the
+// beginning of the underlying device. Each bucket has two slots and
+// the bucket writes go to the slot that the last synced state does
+// not reference. This way the accesses after Sync don't modify the
+// tree of the synced state and the device opens from the last synced
+// state after a crash.
+//
+// The buckets are authenticated with their node index and version,
+// and the state with its slot, so the storage host can't move the
+// buckets or replace them with their earlier copies. The version
+// combines the sync sequence number and a write counter of the
+// sequence.
+type ORAMDevice struct {
+	m          sync.Mutex
+	device     Device
+	aead       cipher.AEAD
+	blockSize  int
+	numBlocks  uint64
+	height     int
+	bucketSize int
+	stateSize  int
+	seq        uint64
+	position   []uint64
+	current    []byte
+	synced     []byte
+	version    []uint64
+	writes     uint64
+	stash      map[uint64][]byte
+	bucket     []byte
+}
+
+// NewORAMDevice creates a new ORAM device with numBlocks blocks of
+// blockSize bytes. The device encrypts the buckets with the AES key
+// and stores them in the underlying device. The function initializes
+// all buckets of the underlying device.
+func NewORAMDevice(device Device, key []byte, blockSize int,
+	numBlocks uint64) (*ORAMDevice, error) {
+
+	oram, err := newORAMDevice(device, key, blockSize, numBlocks)
+	if err != nil {
+		return nil, err
+	}
+	for i := range oram.position {
+		oram.position[i], err = oram.randomLeaf()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Initialize buckets with dummy blocks.
+	for i := uint64(0); i < oram.numBuckets(); i++ {
+		err = oram.writeBucket(i, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = oram.Sync()
+	if err != nil {
+		return nil, err
+	}
+
+	return oram, nil
+}
+
+// OpenORAMDevice opens the ORAM device from the underlying device.
+// The arguments must match the ones used to create the device. The
+// device is opened from its last synced state.
+func OpenORAMDevice(device Device, key []byte, blockSize int,
+	numBlocks uint64) (*ORAMDevice, error) {
+
+	oram, err := newORAMDevice(device, key, blockSize, numBlocks)
+	if err != nil {
+		return nil, err
+	}
+	var state []byte
+	for slot := 0; slot < 2; slot++ {
+		plain, err := oram.readState(slot)
+		if err != nil {
+			continue
+		}
+		if state == nil || bo.Uint64(plain[ORAMStateOfsSeq:]) >
+			bo.Uint64(state[ORAMStateOfsSeq:]) {
+			state = plain
+		}
+	}
+	if state == nil {
+		return nil, fmt.Errorf("no valid ORAM state found")
+	}
+	err = oram.parseState(state)
+	if err != nil {
+		return nil, err
+	}
+	// Start a new sequence so that the bucket versions written after
+	// the last sync are not reused.
+	err = oram.Sync()
+	if err != nil {
+		return nil, err
+	}
+	return oram, nil
+}
+
+func newORAMDevice(device Device, key []byte, blockSize int,
+	numBlocks uint64) (*ORAMDevice, error) {
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if numBlocks == 0 {
+		return nil, fmt.Errorf("invalid number of blocks: %v", numBlocks)
+	}
+	height := bits.Len64(numBlocks - 1)
+	if height == 0 {
+		height = 1
+	}
+	plainSize := ORAMBucketSize * (8 + blockSize)
+
+	oram := &ORAMDevice{
+		device:     device,
+		aead:       aead,
+		blockSize:  blockSize,
+		numBlocks:  numBlocks,
+		height:     height,
+		bucketSize: aead.NonceSize() + plainSize + aead.Overhead(),
+		position:   make([]uint64, numBlocks),
+		stash:      make(map[uint64][]byte),
+		bucket:     make([]byte, plainSize),
+	}
+	numBuckets := oram.numBuckets()
+	oram.current = make([]byte, (numBuckets+7)/8)
+	oram.synced = make([]byte, len(oram.current))
+	oram.version = make([]uint64, numBuckets)
+	oram.stateSize = aead.NonceSize() + oram.plainStateSize() +
+		aead.Overhead()
+
+	return oram, nil
+}
+
+// numBuckets returns the number of buckets in the tree.
+func (oram *ORAMDevice) numBuckets() uint64 {
+	return uint64(2)<<oram.height - 1
+}
+
+// plainStateSize returns the size of the unencrypted device state.
+func (oram *ORAMDevice) plainStateSize() int {
+	return ORAMStateOfsPositions + int(oram.numBlocks)*8 +
+		len(oram.current) + len(oram.version)*8 +
+		ORAMStashSize*(8+oram.blockSize)
+}
+
+// Close implements Device.Close. The device is synced before it is
+// closed.
+func (oram *ORAMDevice) Close() error {
+	err := oram.Sync()
+	closeErr := oram.device.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// Sync implements Device.Sync. The function syncs the buckets of the
+// underlying device and then stores the position map and the stash
+// into the state slot which does not hold the last synced state.
+func (oram *ORAMDevice) Sync() error {
+	oram.m.Lock()
+	defer oram.m.Unlock()
+
+	err := oram.device.Sync()
+	if err != nil {
+		return err
+	}
+	if len(oram.stash) > ORAMStashSize {
+		return fmt.Errorf("ORAM stash overflow: %v blocks", len(oram.stash))
+	}
+	plain := make([]byte, oram.plainStateSize())
+	bo.PutUint64(plain[ORAMStateOfsSeq:], oram.seq+1)
+	bo.PutUint32(plain[ORAMStateOfsBlockSize:], uint32(oram.blockSize))
+	bo.PutUint64(plain[ORAMStateOfsNumBlocks:], oram.numBlocks)
+	bo.PutUint32(plain[ORAMStateOfsStash:], uint32(len(oram.stash)))
+	ofs := ORAMStateOfsPositions
+	for _, leaf := range oram.position {
+		bo.PutUint64(plain[ofs:], leaf)
+		ofs += 8
+	}
+	ofs += copy(plain[ofs:], oram.current)
+	for _, version := range oram.version {
+		bo.PutUint64(plain[ofs:], version)
+		ofs += 8
+	}
+	for addr, block := range oram.stash {
+		bo.PutUint64(plain[ofs:], addr)
+		copy(plain[ofs+8:], block)
+		ofs += 8 + oram.blockSize
+	}
+
+	nonceSize := oram.aead.NonceSize()
+	buf := make([]byte, nonceSize, oram.stateSize)
+	_, err = rand.Read(buf)
+	if err != nil {
+		return err
+	}
+	slot := int((oram.seq + 1) % 2)
+	buf = oram.aead.Seal(buf, buf[:nonceSize], plain, stateAD(slot))
+	_, err = oram.device.WriteAt(buf, int64(slot)*int64(oram.stateSize))
+	if err != nil {
+		return err
+	}
+	err = oram.device.Sync()
+	if err != nil {
+		return err
+	}
+	oram.seq++
+	oram.writes = 0
+	copy(oram.synced, oram.current)
+
+	return nil
+}
+
+// stateAD returns the associated data of the state slot.
+func stateAD(slot int) []byte {
+	var ad [8]byte
+	bo.PutUint64(ad[:], uint64(slot))
+	return ad[:]
+}
+
+// bucketAD returns the associated data of the bucket node with the
+// version.
+func bucketAD(node, version uint64) []byte {
+	var ad [16]byte
+	bo.PutUint64(ad[0:], node)
+	bo.PutUint64(ad[8:], version)
+	return ad[:]
+}
+
+// readState reads and decrypts the device state from the state slot.
+func (oram *ORAMDevice) readState(slot int) ([]byte, error) {
+	buf := make([]byte, oram.stateSize)
+	_, err := oram.device.ReadAt(buf, int64(slot)*int64(oram.stateSize))
+	if err != nil {
+		return nil, err
+	}
+	nonceSize := oram.aead.NonceSize()
+	return oram.aead.Open(nil, buf[:nonceSize], buf[nonceSize:],
+		stateAD(slot))
+}
+
+// parseState sets the position map, the bucket slots, and the stash
+// from the device state.
+func (oram *ORAMDevice) parseState(plain []byte) error {
+	blockSize := int(bo.Uint32(plain[ORAMStateOfsBlockSize:]))
+	numBlocks := bo.Uint64(plain[ORAMStateOfsNumBlocks:])
+	if blockSize != oram.blockSize || numBlocks != oram.numBlocks {
+		return fmt.Errorf("ORAM geometry mismatch: got %vx%v, expected %vx%v",
+			numBlocks, blockSize, oram.numBlocks, oram.blockSize)
+	}
+	count := int(bo.Uint32(plain[ORAMStateOfsStash:]))
+	if count > ORAMStashSize {
+		return fmt.Errorf("invalid ORAM stash size %v", count)
+	}
+	oram.seq = bo.Uint64(plain[ORAMStateOfsSeq:])
+
+	ofs := ORAMStateOfsPositions
+	for i := range oram.position {
+		oram.position[i] = bo.Uint64(plain[ofs:])
+		if oram.position[i] >= uint64(1)<<oram.height {
+			return fmt.Errorf("invalid ORAM position %v", oram.position[i])
+		}
+		ofs += 8
+	}
+	ofs += copy(oram.current, plain[ofs:])
+	copy(oram.synced, oram.current)
+	for i := range oram.version {
+		oram.version[i] = bo.Uint64(plain[ofs:])
+		ofs += 8
+	}
+
+	for i := 0; i < count; i++ {
+		addr := bo.Uint64(plain[ofs:])
+		if addr >= oram.numBlocks {
+			return fmt.Errorf("invalid ORAM stash block %v", addr)
+		}
+		oram.stash[addr] = bytes.Clone(plain[ofs+8 : ofs+8+oram.blockSize])
+		ofs += 8 + oram.blockSize
+	}
+	return nil
+}
+
+// ReadAt implements Device.ReadAt.
+func (oram *ORAMDevice) ReadAt(b []byte, off int64) (n int, err error) {
+	size := int64(oram.numBlocks) * int64(oram.blockSize)
+	if off >= size {
+		return 0, io.EOF
+	}
+	if off >= 0 && int64(len(b)) > size-off {
+		n, err = oram.ReadAt(b[:size-off], off)
+		if err == nil {
+			err = io.EOF
+		}
+		return n, err
+	}
+	return oram.rw(b, off, func(block, data []byte) {
+		copy(data, block)
+	})
+}
+
+// WriteAt implements Device.WriteAt.
+func (oram *ORAMDevice) WriteAt(b []byte, off int64) (n int, err error) {
+	return oram.rw(b, off, func(block, data []byte) {
+		copy(block, data)
+	})
+}
+
+func (oram *ORAMDevice) rw(b []byte, off int64,
+	fn func(block, data []byte)) (int, error) {
+
+	oram.m.Lock()
+	defer oram.m.Unlock()
+
+	size := int64(oram.numBlocks) * int64(oram.blockSize)
+	if off < 0 || off > size || int64(len(b)) > size-off {
+		return 0, fmt.Errorf("access %v bytes at %v out of range [0...%v[",
+			len(b), off, size)
+	}
+	var n int
+	for n < len(b) {
+		addr := uint64(off) / uint64(oram.blockSize)
+		ofs := int(uint64(off) % uint64(oram.blockSize))
+		l := min(len(b)-n, oram.blockSize-ofs)
+
+		err := oram.access(addr, func(block []byte) {
+			fn(block[ofs:ofs+l], b[n:n+l])
+		})
+		if err != nil {
+			return n, err
+		}
+		n += l
+		off += int64(l)
+	}
+	return n, nil
+}
+
+// access executes the Path ORAM access for the block addr. The
+// function fn reads or modifies the block data.
+func (oram *ORAMDevice) access(addr uint64, fn func(block []byte)) error {
+	leaf := oram.position[addr]
+	var err error
+	oram.position[addr], err = oram.randomLeaf()
+	if err != nil {
+		return err
+	}
+
+	// Read the path into the stash.
+	for level := 0; level <= oram.height; level++ {
+		err = oram.readBucket(oram.node(leaf, level))
+		if err != nil {
+			return err
+		}
+	}
+
+	block, ok := oram.stash[addr]
+	if !ok {
+		block = make([]byte, oram.blockSize)
+		oram.stash[addr] = block
+	}
+	fn(block)
+
+	// Write the path back, evicting stash blocks as deep as possible.
+	for level := oram.height; level >= 0; level-- {
+		node := oram.node(leaf, level)
+		var evict []uint64
+		for a := range oram.stash {
+			if len(evict) >= ORAMBucketSize {
+				break
+			}
+			if oram.node(oram.position[a], level) == node {
+				evict = append(evict, a)
+			}
+		}
+		err = oram.writeBucket(node, evict)
+		if err != nil {
+			return err
+		}
+		for _, a := range evict {
+			delete(oram.stash, a)
+		}
+	}
+	return nil
+}
+
+// node returns the bucket index of the path to leaf at the level.
+func (oram *ORAMDevice) node(leaf uint64, level int) uint64 {
+	return uint64(1)<<level - 1 + leaf>>(oram.height-level)
+}
+
+func (oram *ORAMDevice) randomLeaf() (uint64, error) {
+	var buf [8]byte
+	_, err := rand.Read(buf[:])
+	if err != nil {
+		return 0, err
+	}
+	return bo.Uint64(buf[:]) & (uint64(1)<<oram.height - 1), nil
+}
+
+// bucketOffset returns the offset of the bucket slot in the
+// underlying device.
+func (oram *ORAMDevice) bucketOffset(node uint64, slot int) int64 {
+	return 2*int64(oram.stateSize) +
+		(2*int64(node)+int64(slot))*int64(oram.bucketSize)
+}
+
+// bucketSlot returns the slot of the bucket in the slot bitmap.
+func bucketSlot(bitmap []byte, node uint64) int {
+	return int(bitmap[node/8]>>(node%8)) & 1
+}
+
+func (oram *ORAMDevice) readBucket(node uint64) error {
+	buf := make([]byte, oram.bucketSize)
+	_, err := oram.device.ReadAt(buf,
+		oram.bucketOffset(node, bucketSlot(oram.current, node)))
+	if err != nil {
+		return err
+	}
+	nonceSize := oram.aead.NonceSize()
+	plain, err := oram.aead.Open(oram.bucket[:0], buf[:nonceSize],
+		buf[nonceSize:], bucketAD(node, oram.version[node]))
+	if err != nil {
+		return fmt.Errorf("bucket %v: %v", node, err)
+	}
+	for i := 0; i < ORAMBucketSize; i++ {
+		ofs := i * (8 + oram.blockSize)
+		addr := bo.Uint64(plain[ofs:])
+		if addr == oramDummy {
+			continue
+		}
+		if addr >= oram.numBlocks {
+			return fmt.Errorf("bucket %v: invalid block %v", node, addr)
+		}
+		_, ok := oram.stash[addr]
+		if ok {
+			// The stash holds the latest copy of the block.
+			continue
+		}
+		block := make([]byte, oram.blockSize)
+		copy(block, plain[ofs+8:])
+		oram.stash[addr] = block
+	}
+	return nil
+}
+
+func (oram *ORAMDevice) writeBucket(node uint64, blocks []uint64) error {
+	plain := oram.bucket
+	for i := 0; i < ORAMBucketSize; i++ {
+		ofs := i * (8 + oram.blockSize)
+		data := plain[ofs+8 : ofs+8+oram.blockSize]
+		if i < len(blocks) {
+			bo.PutUint64(plain[ofs:], blocks[i])
+			copy(data, oram.stash[blocks[i]])
+		} else {
+			bo.PutUint64(plain[ofs:], oramDummy)
+			clear(data)
+		}
+	}
+	if oram.writes == math.MaxUint32 {
+		return fmt.Errorf("ORAM write counter overflow, Sync required")
+	}
+	oram.writes++
+	version := (oram.seq+1)<<32 | oram.writes
+
+	nonceSize := oram.aead.NonceSize()
+	buf := make([]byte, nonceSize, oram.bucketSize)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return err
+	}
+	buf = oram.aead.Seal(buf, buf[:nonceSize], plain,
+		bucketAD(node, version))
+
+	// Keep the bucket of the synced state intact.
+	slot := 1 - bucketSlot(oram.synced, node)
+	_, err = oram.device.WriteAt(buf, oram.bucketOffset(node, slot))
+	if err != nil {
+		return err
+	}
+	if slot == 1 {
+		oram.current[node/8] |= 1 << (node % 8)
+	} else {
+		oram.current[node/8] &^= 1 << (node % 8)
+	}
+	oram.version[node] = version
+	return nil
+}
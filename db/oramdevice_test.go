@@ -0,0 +1,197 @@
+//
+// Copyright (c) 2024 Markku Rossi
+//
+// All rights reserved.
+//
+
+package db
+
+import (
+	"bytes"
+	"testing"
+)
+
+type readRecordingDevice struct {
+	*MemDevice
+	reads []int64
+}
+
+func (dev *readRecordingDevice) ReadAt(b []byte, off int64) (int, error) {
+	dev.reads = append(dev.reads, off)
+	return dev.MemDevice.ReadAt(b, off)
+}
+
+func TestORAMDevice(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	const blockSize = 1024
+	const numBlocks = 256
+
+	device := &readRecordingDevice{
+		MemDevice: NewMemDevice(8 * 1024 * 1024),
+	}
+	oram, err := NewORAMDevice(device, key, blockSize, numBlocks)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	params := NewParams()
+	params.PageSize = blockSize
+	db, err := Create(params, oram)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := writeTestPages(t, db, nil, 100, 1)
+	writeTestPages(t, db, ids[:10], 0, 2)
+
+	db, err = Open(params, oram)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyTestPages(t, db, ids[:10], 2)
+	verifyTestPages(t, db, ids[10:], 1)
+
+	// Repeated accesses to the same block read random paths.
+	paths := make(map[int64]bool)
+	buf := make([]byte, blockSize)
+	for i := 0; i < 16; i++ {
+		device.reads = nil
+		_, err = oram.ReadAt(buf, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(device.reads) != oram.height+1 {
+			t.Fatalf("access read %v buckets, expected %v",
+				len(device.reads), oram.height+1)
+		}
+		paths[device.reads[len(device.reads)-1]] = true
+	}
+	if len(paths) < 2 {
+		t.Errorf("accesses read the same path")
+	}
+
+	// Unaligned access.
+	data := []byte("unaligned data crossing block boundary")
+	_, err = oram.WriteAt(data, blockSize-10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(data))
+	_, err = oram.ReadAt(got, blockSize-10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("ReadAt: got %q, expected %q", got, data)
+	}
+	_, err = oram.ReadAt(buf, numBlocks*blockSize)
+	if err == nil {
+		t.Errorf("out of range read succeeded")
+	}
+
+	// The underlying device must not contain plaintext data.
+	if bytes.Contains(device.buf, data) {
+		t.Errorf("plaintext found from the underlying device")
+	}
+}
+
+func TestORAMDeviceReopen(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	const blockSize = 1024
+	const numBlocks = 256
+
+	device := NewMemDevice(8 * 1024 * 1024)
+	oram, err := NewORAMDevice(device, key, blockSize, numBlocks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	params := NewParams()
+	params.PageSize = blockSize
+	db, err := Create(params, oram)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := writeTestPages(t, db, nil, 100, 1)
+
+	// The accesses after the last sync move the blocks in the tree
+	// and the device is not closed: the committed pages are read
+	// from the synced state.
+	verifyTestPages(t, db, ids, 1)
+	data := make([]byte, numBlocks*blockSize)
+	_, err = oram.WriteAt(data, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oram, err = OpenORAMDevice(device, key, blockSize, numBlocks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(params, oram)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyTestPages(t, db, ids, 1)
+	err = oram.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = OpenORAMDevice(device, []byte("fedcba9876543210"), blockSize,
+		numBlocks)
+	if err == nil {
+		t.Errorf("ORAM device opened with wrong key")
+	}
+	_, err = OpenORAMDevice(device, key, blockSize, numBlocks/2)
+	if err == nil {
+		t.Errorf("ORAM device opened with wrong geometry")
+	}
+}
+
+func TestORAMDeviceReplay(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	const blockSize = 1024
+	const numBlocks = 256
+
+	device := NewMemDevice(8 * 1024 * 1024)
+	oram, err := NewORAMDevice(device, key, blockSize, numBlocks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, blockSize)
+	buf[0] = 1
+	_, err = oram.WriteAt(buf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := bytes.Clone(device.buf)
+	buf[0] = 2
+	_, err = oram.WriteAt(buf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Replace the root bucket with its earlier copy.
+	start := oram.bucketOffset(0, 0)
+	end := oram.bucketOffset(1, 0)
+	saved := bytes.Clone(device.buf[start:end])
+	copy(device.buf[start:end], old[start:end])
+	_, err = oram.ReadAt(buf, 0)
+	if err == nil {
+		t.Errorf("replayed bucket not detected")
+	}
+	copy(device.buf[start:end], saved)
+	err = oram.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Swap the state slots.
+	size := oram.stateSize
+	slot0 := bytes.Clone(device.buf[:size])
+	copy(device.buf[:size], device.buf[size:2*size])
+	copy(device.buf[size:2*size], slot0)
+	_, err = OpenORAMDevice(device, key, blockSize, numBlocks)
+	if err == nil {
+		t.Errorf("swapped state slots not detected")
+	}
+}
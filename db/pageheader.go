@@ -0,0 +1,344 @@
+//
+// Copyright (c) 2024 Markku Rossi
+//
+// All rights reserved.
+//
+
+package db
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"sort"
+)
+
+// PageType defines the page types of the self-describing page
+// headers.
+type PageType byte
+
+// Page types.
+const (
+	PageTypeNone PageType = iota
+	PageTypeData
+	PageTypePageTable
+	PageTypeHistory
+)
+
+var pageTypes = map[PageType]string{
+	PageTypeNone:      "none",
+	PageTypeData:      "data",
+	PageTypePageTable: "pagetable",
+	PageTypeHistory:   "history",
+}
+
+func (t PageType) String() string {
+	name, ok := pageTypes[t]
+	if ok {
+		return name
+	}
+	return fmt.Sprintf("{PageType %d}", t)
+}
+
+// PageHeaderMagic defines the page header magic number.
+const PageHeaderMagic = uint32(0x53686450)
+
+// Page header offsets. The page header is stored at the end of the
+// page.
+const (
+	PageHdrOfsMagic      = 0
+	PageHdrOfsType       = 4
+	PageHdrOfsLogicalID  = 8
+	PageHdrOfsGeneration = 16
+	PageHdrOfsNonce      = 24
+	PageHdrOfsParent     = 32
+	PageHdrOfsChecksum   = 40
+	PageHeaderSize       = 56
+)
+
+// PageHeader defines the self-describing page header. The Nonce
+// identifies the transaction which wrote the page and the root
+// pointer records the nonce of its latest committed transaction. The
+// Parent is the nonce of the committed root pointer when the page was
+// written.
+type PageHeader struct {
+	Type       PageType
+	LogicalID  LogicalID
+	Generation uint64
+	Nonce      uint64
+	Parent     uint64
+}
+
+// newNonce creates a random transaction nonce.
+func newNonce() (uint64, error) {
+	var buf [8]byte
+	_, err := rand.Read(buf[:])
+	if err != nil {
+		return 0, err
+	}
+	return bo.Uint64(buf[:]), nil
+}
+
+// label sets the page type and logical ID of the page header. The
+// page header nonce is taken from the transaction tr, which is nil
+// for the pages of the initial root pointer.
+func (ref *PageRef) label(tr *BaseTransaction, t PageType, id LogicalID) {
+	ref.pageType = t
+	ref.id = id
+	ref.nonce = 0
+	if tr != nil {
+		ref.nonce = tr.nonce
+	}
+}
+
+// seal formats the page header of the page. The header generation
+// is the next generation to be committed.
+func (ref *PageRef) seal() {
+	if !ref.db.headers || ref.pid == RootBlock ||
+		ref.pageType == PageTypeNone {
+		return
+	}
+	pt := ref.db.pt
+	ofs := len(ref.data) - PageHeaderSize
+	hdr := ref.data[ofs:]
+
+	clear(hdr)
+	bo.PutUint32(hdr[PageHdrOfsMagic:], PageHeaderMagic)
+	hdr[PageHdrOfsType] = byte(ref.pageType)
+	bo.PutUint64(hdr[PageHdrOfsLogicalID:], uint64(ref.id))
+	bo.PutUint64(hdr[PageHdrOfsGeneration:], pt.root0.Generation+1)
+	bo.PutUint64(hdr[PageHdrOfsNonce:], ref.nonce)
+	bo.PutUint64(hdr[PageHdrOfsParent:], pt.root0.Nonce)
+
+	pt.hash.Data(ref.data[:ofs+PageHdrOfsChecksum], hdr[:PageHdrOfsChecksum])
+}
+
+// parsePageHeader parses and verifies the page header of the page.
+func (pt *PageTable) parsePageHeader(page []byte) (PageHeader, error) {
+	ofs := len(page) - PageHeaderSize
+	hdr := page[ofs:]
+
+	if bo.Uint32(hdr[PageHdrOfsMagic:]) != PageHeaderMagic {
+		return PageHeader{}, fmt.Errorf("invalid page header magic")
+	}
+	var checksum [16]byte
+	pt.hash.Data(page[:ofs+PageHdrOfsChecksum], checksum[:0])
+	if !bytes.Equal(checksum[:], hdr[PageHdrOfsChecksum:]) {
+		return PageHeader{}, fmt.Errorf("invalid page header checksum")
+	}
+	return PageHeader{
+		Type:       PageType(hdr[PageHdrOfsType]),
+		LogicalID:  LogicalID(bo.Uint64(hdr[PageHdrOfsLogicalID:])),
+		Generation: bo.Uint64(hdr[PageHdrOfsGeneration:]),
+		Nonce:      bo.Uint64(hdr[PageHdrOfsNonce:]),
+		Parent:     bo.Uint64(hdr[PageHdrOfsParent:]),
+	}, nil
+}
+
+// Recover rebuilds the page table of a database with page headers by
+// scanning the device. For each logical page, Recover maps the newest
+// data page whose generation is not newer than the latest valid root
+// pointer and whose nonce belongs to a committed transaction: the
+// nonce is recorded by the root pointer or it is the parent of a page
+// header. This way the pages of the aborted transactions are not
+// mapped. If the root block is lost, the device is scanned until it
+// returns an error, the page size is taken from the parameters, and
+// the newest transaction is trusted. The compressed pages are
+// recovered from the page headers of their decompressed data.
+func Recover(params Params, device Device) (*DB, error) {
+	if params.ReadOnly {
+		return nil, ErrReadOnly
+	}
+	limit := ^uint64(0)
+	maxGen := ^uint64(0)
+	root, err := readRoot(params, device)
+	if err == nil {
+		params.PageSize = int(root.PageSize)
+		limit = root.NextPhysical
+		maxGen = root.Generation
+		params.ObjectTables = root.Flags&RootFlagObjectTables != 0
+	}
+	params.PageHeaders = true
+
+	db, err := newDB(params, device)
+	if err != nil {
+		return nil, err
+	}
+	pt := db.pt
+
+	type mapping struct {
+		pid PhysicalID
+		hdr PageHeader
+	}
+	var found []mapping
+	var next uint64 = 1
+
+	// The nonces of the committed transactions. The pages record the
+	// nonce of the committed root pointer when they were written.
+	committed := make(map[uint64]bool)
+	var newest PageHeader
+	if maxGen != ^uint64(0) {
+		committed[root.Nonce] = true
+	}
+
+	add := func(pid PhysicalID, data []byte) {
+		hdr, err := pt.parsePageHeader(data)
+		if err != nil {
+			return
+		}
+		next = pid.Pagenum() + 1
+		if hdr.Generation > maxGen {
+			return
+		}
+		committed[hdr.Parent] = true
+		if hdr.Generation >= newest.Generation {
+			newest = hdr
+		}
+		if hdr.Type != PageTypeData || hdr.LogicalID.Pagenum() == 0 {
+			return
+		}
+		found = append(found, mapping{
+			pid: pid,
+			hdr: hdr,
+		})
+	}
+
+	buf := make([]byte, params.PageSize)
+	for pagenum := uint64(1); pagenum < limit; pagenum++ {
+		_, err := device.ReadAt(buf, int64(pagenum)*int64(params.PageSize))
+		if err != nil {
+			break
+		}
+		_, err = pt.parsePageHeader(buf)
+		if err == nil {
+			add(NewPhysicalID(0, pagenum), buf)
+			continue
+		}
+		class, slots := decompressSlots(buf)
+		for slot, data := range slots {
+			if data == nil {
+				continue
+			}
+			meta := PIDMetaCompressed |
+				uint16(class)<<PIDMetaSizeClassShift | uint16(slot)
+			add(NewPhysicalID(meta, pagenum), data)
+		}
+	}
+	if maxGen == ^uint64(0) {
+		// Without the root pointer, the newest transaction is
+		// trusted.
+		committed[newest.Nonce] = true
+	}
+
+	// Map the newest pages of the committed transactions.
+	pages := make(map[LogicalID]mapping)
+	var generation uint64
+	for _, m := range found {
+		if !committed[m.hdr.Nonce] {
+			continue
+		}
+		old, ok := pages[m.hdr.LogicalID]
+		if ok && old.hdr.Generation > m.hdr.Generation {
+			continue
+		}
+		pages[m.hdr.LogicalID] = m
+		generation = max(generation, m.hdr.Generation)
+	}
+	var compressed bool
+	for _, m := range pages {
+		if m.pid.Compressed() {
+			compressed = true
+		}
+	}
+	var userData, nonce uint64
+	if maxGen != ^uint64(0) {
+		generation = max(generation, maxGen)
+		next = max(next, limit)
+		userData = root.UserData
+		nonce = root.Nonce
+	} else {
+		nonce = newest.Nonce
+	}
+
+	var ids []LogicalID
+	var nextLogical uint64 = 1
+	for id := range pages {
+		ids = append(ids, id)
+		if params.ObjectTables && id.ObjectID() != 0 {
+			continue
+		}
+		nextLogical = max(nextLogical, id.Pagenum()+1)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+
+	// Create a new root pointer with an empty page table above all
+	// scanned pages.
+
+	pt.rootBlock, err = db.cache.New(RootBlock, nil)
+	if err != nil {
+		return nil, err
+	}
+	_ = pt.rootBlock.Data()
+
+	db.headers = true
+	pt.root0 = RootPointer{
+		Magic:        RootPtrMagic,
+		Flags:        RootFlagPageHeaders,
+		PageSize:     uint32(params.PageSize),
+		Generation:   generation,
+		NextPhysical: next + 1,
+		NextLogical:  nextLogical,
+		PageTable:    NewPhysicalID(0, next),
+		UserData:     userData,
+		Version:      FormatVersion,
+		Nonce:        nonce,
+	}
+	if params.ObjectTables {
+		pt.root0.Flags |= RootFlagObjectTables
+	}
+	if compressed {
+		pt.root0.Flags |= RootFlagCompressed
+	}
+	ref, err := db.cache.New(pt.root0.PageTable, nil)
+	if err != nil {
+		return nil, err
+	}
+	ref.label(nil, PageTypePageTable, 0)
+	_ = ref.Data()
+	if pt.mac != nil {
+		pt.root0.Flags |= RootFlagAuthenticated
+		pt.root0.PageTableMAC = pt.macPage(ref.Read())
+	}
+	ref.release()
+
+	tr, err := db.NewTransaction(true)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		pid := pages[id].pid
+		err = pt.set(tr, id, pid)
+		if err != nil {
+			tr.Abort()
+			return nil, err
+		}
+		if pt.mac != nil {
+			// Trust the recovered pages and compute their MACs.
+			ref, err := db.cache.Get(pid)
+			if err != nil {
+				tr.Abort()
+				return nil, err
+			}
+			pt.flushedPage(ref)
+			ref.release()
+			tr.writable[pid] = 0
+		}
+	}
+	err = tr.Commit()
+	if err != nil {
+		return nil, err
+	}
+	return db, nil
+}
@@ -0,0 +1,212 @@
+//
+// Copyright (c) 2024 Markku Rossi
+//
+// All rights reserved.
+//
+
+package db
+
+import (
+	"testing"
+)
+
+func TestPageHeaders(t *testing.T) {
+	params := NewParams()
+	params.PageSize = 1024
+	params.PageHeaders = true
+
+	device := NewMemDevice(1024 * 1024)
+	db, err := Create(params, device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := writeTestPages(t, db, nil, 200, 1)
+	updated := writeTestPages(t, db, ids[:5:5], 10, 2)
+	if db.pt.committed().Depth == 0 {
+		t.Fatalf("page table depth did not grow")
+	}
+
+	// Write and flush an uncommitted modification.
+	tr, err := db.NewTransaction(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := tr.WritablePage(ids[10])
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := ref.Data()
+	if len(buf) != params.PageSize-PageHeaderSize {
+		t.Errorf("page payload size %v, expected %v",
+			len(buf), params.PageSize-PageHeaderSize)
+	}
+	buf[8] = 3
+	ref.Release()
+	err = db.cache.flush(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Destroy the page table.
+	root := db.pt.committed()
+	pid := root.PageTable
+	for i := 0; i < params.PageSize; i++ {
+		device.buf[int(pid.Pagenum())*params.PageSize+i] = 0
+	}
+
+	db, err = Recover(params, device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyTestPages(t, db, ids[5:], 1)
+	verifyTestPages(t, db, updated, 2)
+
+	db, err = Open(params, device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyTestPages(t, db, ids[5:], 1)
+	verifyTestPages(t, db, updated, 2)
+
+	// Recover without the root block.
+	for i := 0; i < params.PageSize; i++ {
+		device.buf[i] = 0
+	}
+	small := NewMemDevice(int(db.pt.committed().NextPhysical)*
+		params.PageSize + 64*1024)
+	copy(small.buf, device.buf)
+
+	db, err = Recover(params, small)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyTestPages(t, db, updated, 2)
+}
+
+func TestRecoverAborted(t *testing.T) {
+	params := NewParams()
+	params.PageSize = 1024
+	params.PageHeaders = true
+
+	device := NewMemDevice(1024 * 1024)
+	db, err := Create(params, device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.pt.root0.UserData = 42
+	ids := writeTestPages(t, db, nil, 20, 1)
+
+	// Flush the pages of an aborted transaction. The next commit has
+	// the same generation and the active concurrent transaction keeps
+	// their physical pages allocated.
+	other, err := db.NewConcurrentTransaction()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr, err := db.NewTransaction(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range ids[:10] {
+		ref, err := tr.WritablePage(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ref.Data()[8] = 3
+		ref.Release()
+	}
+	err = db.cache.flush(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr.Abort()
+	updated := writeTestPages(t, db, ids[10:11:11], 0, 2)
+	other.Abort()
+
+	// Destroy the page table.
+	pid := db.pt.committed().PageTable
+	for i := 0; i < params.PageSize; i++ {
+		device.buf[int(pid.Pagenum())*params.PageSize+i] = 0
+	}
+
+	db, err = Recover(params, device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyTestPages(t, db, ids[:10], 1)
+	verifyTestPages(t, db, updated, 2)
+	verifyTestPages(t, db, ids[11:], 1)
+	if db.Root().UserData != 42 {
+		t.Errorf("recovered UserData %v, expected 42", db.Root().UserData)
+	}
+}
+
+func TestRecoverAuthenticated(t *testing.T) {
+	params := NewParams()
+	params.PageSize = 1024
+	params.PageHeaders = true
+	params.AuthKey = []byte("0123456789abcdef")
+
+	device := NewMemDevice(1024 * 1024)
+	db, err := Create(params, device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := writeTestPages(t, db, nil, 20, 1)
+
+	root := db.pt.committed()
+	pid := root.PageTable
+	for i := 0; i < params.PageSize; i++ {
+		device.buf[int(pid.Pagenum())*params.PageSize+i] = 0
+	}
+	db, err = Recover(params, device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.Root().Version != FormatVersion {
+		t.Errorf("recovered version %v, expected %v",
+			db.Root().Version, FormatVersion)
+	}
+	db, err = Open(params, device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyTestPages(t, db, ids, 1)
+}
+
+func TestRecoverCompressed(t *testing.T) {
+	params := NewParams()
+	params.PageSize = 1024
+	params.PageHeaders = true
+	params.Compression = true
+
+	device := NewMemDevice(1024 * 1024)
+	db, err := Create(params, device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := writeTestPages(t, db, nil, 20, 1)
+	updated := writeTestPages(t, db, ids[:5:5], 0, 2)
+
+	root := db.pt.committed()
+	pid := root.PageTable
+	for i := 0; i < params.PageSize; i++ {
+		device.buf[int(pid.Pagenum())*params.PageSize+i] = 0
+	}
+	db, err = Recover(params, device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.Root().Flags&RootFlagCompressed == 0 {
+		t.Errorf("compressed pages not recovered")
+	}
+	verifyTestPages(t, db, ids[5:], 1)
+	verifyTestPages(t, db, updated, 2)
+
+	db, err = Open(params, device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyTestPages(t, db, ids[5:], 1)
+	verifyTestPages(t, db, updated, 2)
+}
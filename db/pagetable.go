@@ -10,7 +10,11 @@ import (
 	"bytes"
 	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"math"
+	"sync"
 	"time"
 
 	"github.com/markkurossi/shades/crypto"
@@ -30,6 +34,16 @@ const (
 	PIDPagenumMask uint64 = 0x0000ffffffffffff
 )
 
+// PhysicalID meta field values. The compressed pages are stored in
+// size class slots of PageSize>>SizeClass bytes. The slot field
+// specifies the slot index inside the physical page.
+const (
+	PIDMetaCompressed     uint16 = 0x8000
+	PIDMetaSizeClassMask  uint16 = 0x3000
+	PIDMetaSizeClassShift        = 12
+	PIDMetaSlotMask       uint16 = 0x00ff
+)
+
 // NewPhysicalID creates a new physical page ID from the arguments.
 func NewPhysicalID(meta uint16, pagenum uint64) PhysicalID {
 	if pagenum&PIDMetaMask != 0 {
@@ -48,6 +62,35 @@ func (pid PhysicalID) Pagenum() uint64 {
 	return uint64(pid) & PIDPagenumMask
 }
 
+// Compressed tests if the physical page ID refers to a compressed
+// page slot.
+func (pid PhysicalID) Compressed() bool {
+	return pid.Meta()&PIDMetaCompressed != 0
+}
+
+// SizeClass returns the size class of the compressed page slot.
+func (pid PhysicalID) SizeClass() int {
+	return int(pid.Meta()&PIDMetaSizeClassMask) >> PIDMetaSizeClassShift
+}
+
+// Slot returns the slot index of the compressed page slot.
+func (pid PhysicalID) Slot() int {
+	return int(pid.Meta() & PIDMetaSlotMask)
+}
+
+// newTreeRoot encodes the root page and depth of an object page
+// table into an object directory entry. The depth is stored in the
+// Meta field.
+func newTreeRoot(table PhysicalID, depth int) PhysicalID {
+	return NewPhysicalID(uint16(depth), table.Pagenum())
+}
+
+// treeRoot decodes the root page and depth of the object page table
+// from the object directory entry pid.
+func (pid PhysicalID) treeRoot() (PhysicalID, int) {
+	return NewPhysicalID(0, pid.Pagenum()), int(pid.Meta())
+}
+
 func (pid PhysicalID) String() string {
 	return fmt.Sprintf("%04x:%012x", pid.Meta(), pid.Pagenum())
 }
@@ -102,24 +145,125 @@ const (
 
 	// RootPtrMagic defines the root pointer magic number.
 	RootPtrMagic = uint64(0x7b5368616465737d)
+
+	// FormatVersion defines the on-disk format version of the new
+	// databases. Each root pointer layout has its own format version
+	// and the version 0 predates the version field:
+	//
+	//   - 0: the original root pointer (96 bytes)
+	//   - 1: object directory, write-ahead log, page table MAC,
+	//     version, compatibility flags, and page nonce (152 bytes)
+	//
+	// The databases keep their format version until they are
+	// upgraded with DB.Upgrade.
+	FormatVersion uint16 = 1
+)
+
+// Root pointer offsets of the current format version.
+const (
+	RootPtrOfsMagic        = 0
+	RootPtrOfsFlags        = 8
+	RootPtrOfsDepth        = 10
+	RootPtrOfsPageSize     = 12
+	RootPtrOfsTimestamp    = 16
+	RootPtrOfsGeneration   = 24
+	RootPtrOfsNextPhysial  = 32
+	RootPtrOfsNextLogical  = 40
+	RootPtrOfsPageTable    = 48
+	RootPtrOfsFreelist     = 56
+	RootPtrOfsSnapshots    = 64
+	RootPtrOfsUserData     = 72
+	RootPtrOfsObjects      = 80
+	RootPtrOfsLog          = 88
+	RootPtrOfsLogPages     = 96
+	RootPtrOfsPageTableMAC = 104
+	RootPtrOfsVersion      = 120
+	RootPtrOfsCompatFlags  = 122
+	RootPtrOfsReserved     = 124
+	RootPtrOfsNonce        = 128
+	RootPtrOfsChecksum     = 136
+	RootPtrSize            = 152
 )
 
-// Root pointer offsets.
+// rootLayout defines the root pointer layout of a format version. All
+// layouts share the fields up to the UserData and they end with the
+// checksum. The zero offsets mark the fields which the layout does not
+// have.
+type rootLayout struct {
+	size         int
+	objects      int
+	log          int
+	logPages     int
+	pageTableMAC int
+	version      int
+	nonce        int
+	checksum     int
+}
+
+// rootLayouts define the root pointer layouts, indexed by the format
+// version.
+var rootLayouts = []rootLayout{
+	{
+		size:     96,
+		checksum: 80,
+	},
+	{
+		size:         RootPtrSize,
+		objects:      RootPtrOfsObjects,
+		log:          RootPtrOfsLog,
+		logPages:     RootPtrOfsLogPages,
+		pageTableMAC: RootPtrOfsPageTableMAC,
+		version:      RootPtrOfsVersion,
+		nonce:        RootPtrOfsNonce,
+		checksum:     RootPtrOfsChecksum,
+	},
+}
+
+// layoutOf returns the format version and the layout of the root
+// pointers of the size.
+func layoutOf(size int) (uint16, *rootLayout, bool) {
+	for i := range rootLayouts {
+		if rootLayouts[i].size == size {
+			return uint16(i), &rootLayouts[i], true
+		}
+	}
+	return 0, nil, false
+}
+
+// Root pointer flags. The flags specify the required features of the
+// database and the database can't be opened by an engine which does
+// not implement all of them. The page checksums are part of the page
+// headers and the keyed MACs part of the authenticated mode. The
+// encryption is a property of the device, like the ORAMDevice, and
+// not of the database format. The Freelist field is reserved and it
+// is always zero so the freelist layout has no flag; a freelist
+// implementation must add one.
 const (
-	RootPtrOfsMagic       = 0
-	RootPtrOfsFlags       = 8
-	RootPtrOfsDepth       = 10
-	RootPtrOfsPageSize    = 12
-	RootPtrOfsTimestamp   = 16
-	RootPtrOfsGeneration  = 24
-	RootPtrOfsNextPhysial = 32
-	RootPtrOfsNextLogical = 40
-	RootPtrOfsPageTable   = 48
-	RootPtrOfsFreelist    = 56
-	RootPtrOfsSnapshots   = 64
-	RootPtrOfsUserData    = 72
-	RootPtrOfsChecksum    = 80
-	RootPtrSize           = 96
+	// RootFlagAuthenticated specifies that the page table entries
+	// hold MACs of their child pages and that the root pointer is
+	// authenticated with a keyed MAC.
+	RootFlagAuthenticated uint16 = 0x0001
+
+	// RootFlagPageHeaders specifies that all pages, except the root
+	// block, end with a self-describing page header.
+	RootFlagPageHeaders uint16 = 0x0002
+
+	// RootFlagObjectTables specifies that the pages of non-zero
+	// ObjectIDs are mapped by per-object page tables.
+	RootFlagObjectTables uint16 = 0x0004
+
+	// RootFlagCompressed specifies that the page table can map
+	// compressed pages. The flag is maintained only in the version 1
+	// and newer databases.
+	RootFlagCompressed uint16 = 0x0010
+
+	rootFlagsKnown = RootFlagAuthenticated | RootFlagPageHeaders |
+		RootFlagObjectTables | RootFlagCompressed
+
+	// rootFlagsLayout defines the flags which select the page table
+	// layout. They are fixed when the database is created.
+	rootFlagsLayout = RootFlagAuthenticated | RootFlagPageHeaders |
+		RootFlagObjectTables
 )
 
 // RootPtrPadding defines the padding data, which is used to pad the
@@ -127,15 +271,44 @@ const (
 var RootPtrPadding = []rune("mtr@iki.fi~")
 
 // PageTable maps logical page numbers to physical page numbers. This
-// mapping is based on LogicalID.Pagenum(), meaning that the Meta and
-// ObjectID fields are not stored in the page table; instead, they
-// must be managed by higher-level objects and data structures.
+// mapping is based on LogicalID.Pagenum(), meaning that the Meta
+// field is not stored in the page table; instead, it must be managed
+// by higher-level objects and data structures. If the object page
+// tables are enabled, the pages of each non-zero ObjectID are mapped
+// by a separate page table, which has its own depth and page number
+// space. The object page tables are found from the object directory,
+// which is a page table keyed by the ObjectID. Otherwise the ObjectID
+// is ignored and all pages share the global page table.
 type PageTable struct {
 	db        *DB
+	m         sync.Mutex
 	root0     RootPointer
 	root1     RootPointer
 	rootBlock *PageRef
 	hash      *crypto.PRF
+	mac       *crypto.PRF
+	tlb       map[LogicalID]translation
+
+	// The MACs of the uncommitted pages flushed to the device in the
+	// authenticated mode.
+	flushed map[PhysicalID][MACSize]byte
+
+	// The page allocators are shared between all transactions. The
+	// freePhysical holds the page numbers of the physical pages that
+	// were allocated but are not referenced from the page table.
+	nextPhysical uint64
+	nextLogical  uint64
+	freePhysical []uint64
+
+	// Active concurrent transactions.
+	concurrent map[*BaseTransaction]bool
+
+	// Active read-only transactions of the committed root.
+	readers map[*BaseTransaction]bool
+
+	// Write-ahead log state.
+	logOffset int64
+	replaying bool
 }
 
 // NewPageTable creates a new page table for the database.
@@ -143,7 +316,19 @@ func NewPageTable(db *DB) (*PageTable, error) {
 	var err error
 
 	pt := &PageTable{
-		db: db,
+		db:         db,
+		tlb:        make(map[LogicalID]translation),
+		flushed:    make(map[PhysicalID][MACSize]byte),
+		concurrent: make(map[*BaseTransaction]bool),
+		readers:    make(map[*BaseTransaction]bool),
+	}
+
+	if db != nil && len(db.params.AuthKey) > 0 {
+		pt.hash, pt.mac, err = newAuthPRFs(db.params.AuthKey)
+		if err != nil {
+			return nil, err
+		}
+		return pt, nil
 	}
 
 	var hashKey [16]byte
@@ -171,7 +356,7 @@ func (pt *PageTable) Init() error {
 		return err
 	}
 	_ = ref.Data()
-	ref.Release()
+	defer ref.release()
 
 	pt.root0 = RootPointer{
 		Magic:        RootPtrMagic,
@@ -182,43 +367,180 @@ func (pt *PageTable) Init() error {
 		NextLogical:  1, // 0 is reserved for unallocated pages
 		PageTable:    pageTable,
 		Freelist:     0,
+		Timestamp:    uint64(time.Now().UnixNano()),
+		Version:      FormatVersion,
+	}
+	if pt.db.params.PageHeaders {
+		pt.root0.Flags |= RootFlagPageHeaders
+		pt.db.headers = true
+		ref.label(nil, PageTypePageTable, 0)
+	}
+	if pt.db.params.ObjectTables {
+		pt.root0.Flags |= RootFlagObjectTables
+	}
+	if pt.db.params.Compression {
+		pt.root0.Flags |= RootFlagCompressed
+	}
+	if pt.db.params.WAL {
+		err = pt.initLog()
+		if err != nil {
+			return err
+		}
+	}
+	if pt.mac != nil {
+		pt.root0.Flags |= RootFlagAuthenticated
+		pt.root0.PageTableMAC = pt.macPage(ref.Read())
 	}
 
 	pt.formatRootBlock(&pt.root0, pt.rootBlock.Data())
 
-	err = pt.db.cache.flush()
+	return pt.sync(nil)
+}
+
+// Open reads the page table table from the device.
+func (pt *PageTable) Open() error {
+	var err error
+
+	pt.rootBlock, err = pt.db.cache.Get(RootBlock)
 	if err != nil {
 		return err
 	}
-	err = pt.db.device.Sync()
+
+	err = pt.parseRootBlock(pt.rootBlock.Read())
+	if err != nil {
+		return err
+	}
+	if pt.root0.authenticated() && pt.mac == nil {
+		return fmt.Errorf("authenticated database requires AuthKey")
+	}
+	err = pt.validateDevice()
 	if err != nil {
 		return err
 	}
+	pt.db.headers = pt.root0.Flags&RootFlagPageHeaders != 0
+	if pt.root0.Log != 0 {
+		err = pt.replayLog()
+		if err != nil {
+			return err
+		}
+	}
+	return pt.checkRollback()
+}
 
+// checkRollback checks that the authenticated committed root is not
+// older than the generation the caller has seen.
+func (pt *PageTable) checkRollback() error {
+	if !pt.root0.authenticated() {
+		return nil
+	}
+	if uint64(pt.root0.Generation) < pt.db.params.AuthGeneration {
+		return fmt.Errorf("%w: generation %v, expected at least %v",
+			ErrRollback, pt.root0.Generation, pt.db.params.AuthGeneration)
+	}
 	return nil
 }
 
-// Open reads the page table table from the device.
-func (pt *PageTable) Open() error {
-	var err error
+// refresh re-reads the root block from the device and moves the
+// committed root pointer to the latest generation of the device. The
+// write-ahead log is replayed again since the writer may have
+// appended new records into it. The function returns true if the
+// committed generation changed.
+func (pt *PageTable) refresh() (bool, error) {
+	if pt.root1.Generation > pt.root0.Generation || len(pt.concurrent) > 0 ||
+		len(pt.readers) > 0 {
+		return false, ErrTransactionActive
+	}
+	old := pt.root0
 
-	pt.rootBlock, err = pt.db.cache.Get(RootBlock)
+	err := pt.rootBlock.read()
 	if err != nil {
-		return err
+		return false, err
 	}
-
+	pt.m.Lock()
 	err = pt.parseRootBlock(pt.rootBlock.Read())
+	pt.m.Unlock()
+	if err != nil {
+		return false, err
+	}
+	if pt.root0.Log != 0 {
+		// The replayed pages are rewritten by the writer after
+		// the checkpoints.
+		pt.db.cache.purge()
+		pt.logOffset = 0
+	}
+	pt.root1 = pt.root0
+	clear(pt.tlb)
+
+	if pt.root0.Log != 0 {
+		err = pt.replayLog()
+		if err != nil {
+			return false, err
+		}
+	}
+	return pt.root0.Generation != old.Generation, nil
+}
+
+// sync writes all dirty pages, except the pages of other active
+// concurrent transactions, to the device. The root block is
+// written and synced only after all other pages are stable so that a
+// crash never leaves a root pointer referencing unwritten pages.
+func (pt *PageTable) sync(tr *BaseTransaction) error {
+	err := pt.db.cache.flush(pt.flushable(tr))
 	if err != nil {
 		return err
 	}
-	return nil
+	err = pt.db.device.Sync()
+	if err != nil {
+		return err
+	}
+	err = pt.rootBlock.flush()
+	if err != nil {
+		return err
+	}
+	return pt.db.device.Sync()
+}
+
+// flushable returns a function that tests if the page pid can be
+// flushed while committing the transaction tr. The pages of the other
+// active concurrent transactions are not flushed since they can be
+// modified concurrently with the commit.
+func (pt *PageTable) flushable(tr *BaseTransaction) func(pid PhysicalID) bool {
+	return func(pid PhysicalID) bool {
+		for other := range pt.concurrent {
+			if other == tr {
+				continue
+			}
+			_, ok := other.writable[pid]
+			if ok {
+				return false
+			}
+		}
+		return true
+	}
 }
 
 func (pt *PageTable) formatRootBlock(root *RootPointer, buf []byte) {
+	size := root.size()
+	pt.formatRootPointer(root, buf[:size])
 
-	root.Timestamp = uint64(time.Now().UnixNano())
+	var i int = size
+	for ; i+size < len(buf); i += size {
+		copy(buf[i:], buf[0:size])
+	}
+	for ; i < len(buf); i++ {
+		buf[i] = byte(RootPtrPadding[i%len(RootPtrPadding)])
+	}
+}
 
-	// Format the first root pointer.
+// formatRootPointer formats the root pointer into the buffer. The
+// length of the buffer selects the root pointer layout and the fields
+// missing from the layout are not stored.
+func (pt *PageTable) formatRootPointer(root *RootPointer, buf []byte) {
+	_, layout, ok := layoutOf(len(buf))
+	if !ok {
+		panic(fmt.Sprintf("invalid root pointer size %v", len(buf)))
+	}
+	clear(buf)
 	bo.PutUint64(buf[RootPtrOfsMagic:], root.Magic)
 	bo.PutUint16(buf[RootPtrOfsFlags:], root.Flags)
 	bo.PutUint16(buf[RootPtrOfsDepth:], root.Depth)
@@ -231,16 +553,24 @@ func (pt *PageTable) formatRootBlock(root *RootPointer, buf []byte) {
 	bo.PutUint64(buf[RootPtrOfsFreelist:], uint64(root.Freelist))
 	bo.PutUint64(buf[RootPtrOfsSnapshots:], uint64(root.Snapshots))
 	bo.PutUint64(buf[RootPtrOfsUserData:], root.UserData)
-
-	pt.hash.Data(buf[0:RootPtrOfsChecksum], buf[:RootPtrOfsChecksum])
-
-	var i int = RootPtrSize
-	for ; i+RootPtrSize < pt.db.params.PageSize; i += RootPtrSize {
-		copy(buf[i:], buf[0:RootPtrSize])
+	if layout.objects != 0 {
+		bo.PutUint64(buf[layout.objects:], uint64(root.Objects))
 	}
-	for ; i < pt.db.params.PageSize; i++ {
-		buf[i] = byte(RootPtrPadding[i%len(RootPtrPadding)])
+	if layout.log != 0 {
+		bo.PutUint64(buf[layout.log:], uint64(root.Log))
+		bo.PutUint64(buf[layout.logPages:], root.LogPages)
+	}
+	if layout.pageTableMAC != 0 {
+		copy(buf[layout.pageTableMAC:], root.PageTableMAC[:])
+	}
+	if layout.version != 0 {
+		bo.PutUint16(buf[layout.version:], root.Version)
+		bo.PutUint16(buf[layout.version+2:], root.CompatFlags)
 	}
+	if layout.nonce != 0 {
+		bo.PutUint64(buf[layout.nonce:], root.Nonce)
+	}
+	pt.hash.Data(buf[0:layout.checksum], buf[:layout.checksum])
 }
 
 func (pt *PageTable) parseRootBlock(buf []byte) error {
@@ -248,19 +578,32 @@ func (pt *PageTable) parseRootBlock(buf []byte) error {
 		fmt.Printf("RootBlock:\n%s", hex.Dump(buf))
 	}
 	var root RootPointer
-
-	for i := 0; i+RootPtrSize < len(buf); i += RootPtrSize {
-		gen := bo.Uint64(buf[i+RootPtrOfsGeneration:])
-		if gen <= root.Generation {
-			continue
-		}
-		rp, err := pt.parseRootPointer(buf[i : i+RootPtrSize])
-		if err != nil {
-			continue
+	var invalid error
+
+	// The root block holds the copies of the root pointer of the
+	// database format version. A torn root block write of an
+	// upgrade can leave the root pointers of two versions.
+	for i := len(rootLayouts) - 1; i >= 0; i-- {
+		size := rootLayouts[i].size
+		for i := 0; i+size < len(buf); i += size {
+			gen := bo.Uint64(buf[i+RootPtrOfsGeneration:])
+			if gen <= root.Generation {
+				continue
+			}
+			rp, err := pt.parseRootPointer(buf[i : i+size])
+			if err != nil {
+				if err != errRootChecksum {
+					invalid = err
+				}
+				continue
+			}
+			root = rp
 		}
-		root = rp
 	}
 	if root.Generation == 0 {
+		if invalid != nil {
+			return invalid
+		}
 		return fmt.Errorf("no valid root pointer found")
 	}
 	pt.root0 = root
@@ -271,14 +614,23 @@ func (pt *PageTable) parseRootBlock(buf []byte) error {
 	return nil
 }
 
+var errRootChecksum = errors.New("invalid root pointer checksum")
+
+// parseRootPointer parses the root pointer from the buffer. The length
+// of the buffer selects the root pointer layout.
 func (pt *PageTable) parseRootPointer(buf []byte) (RootPointer, error) {
 	var checksum [16]byte
 
-	pt.hash.Data(buf[0:RootPtrOfsChecksum], checksum[:0])
-	if bytes.Compare(checksum[:], buf[RootPtrOfsChecksum:]) != 0 {
-		return RootPointer{}, fmt.Errorf("invalid root pointer checksum")
+	version, layout, ok := layoutOf(len(buf))
+	if !ok {
+		return RootPointer{}, fmt.Errorf("invalid root pointer size %v",
+			len(buf))
+	}
+	pt.hash.Data(buf[0:layout.checksum], checksum[:0])
+	if bytes.Compare(checksum[:], buf[layout.checksum:]) != 0 {
+		return RootPointer{}, errRootChecksum
 	}
-	return RootPointer{
+	rp := RootPointer{
 		Magic:        bo.Uint64(buf[RootPtrOfsMagic:]),
 		Flags:        bo.Uint16(buf[RootPtrOfsFlags:]),
 		Depth:        bo.Uint16(buf[RootPtrOfsDepth:]),
@@ -291,62 +643,311 @@ func (pt *PageTable) parseRootPointer(buf []byte) (RootPointer, error) {
 		Freelist:     PhysicalID(bo.Uint64(buf[RootPtrOfsFreelist:])),
 		Snapshots:    PhysicalID(bo.Uint64(buf[RootPtrOfsSnapshots:])),
 		UserData:     bo.Uint64(buf[RootPtrOfsUserData:]),
-	}, nil
+		Version:      version,
+	}
+	if layout.objects != 0 {
+		rp.Objects = PhysicalID(bo.Uint64(buf[layout.objects:]))
+	}
+	if layout.log != 0 {
+		rp.Log = PhysicalID(bo.Uint64(buf[layout.log:]))
+		rp.LogPages = bo.Uint64(buf[layout.logPages:])
+	}
+	if layout.pageTableMAC != 0 {
+		copy(rp.PageTableMAC[:], buf[layout.pageTableMAC:])
+	}
+	if layout.version != 0 {
+		rp.Version = bo.Uint16(buf[layout.version:])
+		if rp.Version < version {
+			return RootPointer{}, fmt.Errorf("invalid format version %v",
+				rp.Version)
+		}
+		rp.CompatFlags = bo.Uint16(buf[layout.version+2:])
+	}
+	if layout.nonce != 0 {
+		rp.Nonce = bo.Uint64(buf[layout.nonce:])
+	}
+	copy(rp.Checksum[:], buf[layout.checksum:])
+
+	err := rp.validate()
+	if err != nil {
+		return RootPointer{}, err
+	}
+	return rp, nil
+}
+
+// validate checks the root pointer fields against the format
+// invariants. The checksum only detects corruption so the fields of
+// untrusted root pointers must be validated before they are used.
+func (rp RootPointer) validate() error {
+	if rp.Magic != RootPtrMagic {
+		return fmt.Errorf("invalid root pointer magic %x", rp.Magic)
+	}
+	if rp.PageSize < 1024 || rp.PageSize > 1024*1024 ||
+		rp.PageSize&(rp.PageSize-1) != 0 {
+		return fmt.Errorf("invalid page size %v", rp.PageSize)
+	}
+	if rp.Version > FormatVersion {
+		return fmt.Errorf("%w: format version %v",
+			ErrUnsupportedFormat, rp.Version)
+	}
+	if rp.Flags&^rootFlagsKnown != 0 {
+		return fmt.Errorf("%w: required features %04x",
+			ErrUnsupportedFormat, rp.Flags&^rootFlagsKnown)
+	}
+	if int(rp.Depth) > rp.maxDepth() {
+		return fmt.Errorf("invalid page table depth %v", rp.Depth)
+	}
+	if rp.Generation == 0 {
+		return fmt.Errorf("invalid generation 0")
+	}
+	if rp.NextPhysical < 2 || rp.NextPhysical > PIDPagenumMask {
+		return fmt.Errorf("invalid next physical page %v", rp.NextPhysical)
+	}
+	if rp.NextLogical < 1 || rp.NextLogical > IDPagenumMask {
+		return fmt.Errorf("invalid next logical page %v", rp.NextLogical)
+	}
+	page := func(name string, pid PhysicalID, required bool) error {
+		if pid == 0 && !required {
+			return nil
+		}
+		if pid.Meta() != 0 || pid.Pagenum() == 0 ||
+			pid.Pagenum() >= rp.NextPhysical {
+			return fmt.Errorf("invalid %s page %v", name, pid)
+		}
+		return nil
+	}
+	err := page("page table", rp.PageTable, true)
+	if err != nil {
+		return err
+	}
+	err = page("snapshots", rp.Snapshots, false)
+	if err != nil {
+		return err
+	}
+	err = page("freelist", rp.Freelist, false)
+	if err != nil {
+		return err
+	}
+	if rp.Objects != 0 {
+		if rp.Flags&RootFlagObjectTables == 0 {
+			return fmt.Errorf("object directory without object tables")
+		}
+		dir, depth := rp.Objects.treeRoot()
+		if depth > rp.maxDepth() {
+			return fmt.Errorf("invalid object directory depth %v", depth)
+		}
+		err = page("object directory", dir, true)
+		if err != nil {
+			return err
+		}
+	}
+	if rp.Log != 0 || rp.LogPages != 0 {
+		err = page("log", rp.Log, true)
+		if err != nil {
+			return err
+		}
+		if rp.LogPages == 0 ||
+			rp.LogPages > rp.NextPhysical-rp.Log.Pagenum() {
+			return fmt.Errorf("invalid log size %v", rp.LogPages)
+		}
+	}
+	return nil
+}
+
+// validateDevice checks that the pages referenced by the committed
+// root pointer are stored in the device. The device size is taken
+// from its Size method if it has one, and otherwise the highest
+// referenced page is read. The pages up to NextPhysical are not
+// required since the write-ahead log pages after the end of the
+// device are not written until the log reaches them.
+func (pt *PageTable) validateDevice() error {
+	var last PhysicalID
+	for _, pid := range []PhysicalID{
+		pt.root0.PageTable, pt.root0.Snapshots, pt.root0.Objects, pt.root0.Log,
+	} {
+		if pid.Pagenum() > last.Pagenum() {
+			last = pid
+		}
+	}
+	pageSize := uint64(pt.root0.PageSize)
+	if last.Pagenum() > math.MaxInt64/pageSize {
+		return fmt.Errorf("page %v after the end of the device", last)
+	}
+	sized, ok := pt.db.device.(interface{ Size() int64 })
+	if ok {
+		if last.Pagenum() >= uint64(sized.Size())/pageSize {
+			return fmt.Errorf("page %v after the end of the device", last)
+		}
+		return nil
+	}
+	var buf [1]byte
+	_, err := pt.db.device.ReadAt(buf[:], int64(last.Pagenum()*pageSize))
+	if err == io.EOF {
+		return fmt.Errorf("page %v after the end of the device", last)
+	}
+	return err
+}
+
+// committed returns the latest committed root pointer. It is safe to
+// call committed concurrently with transactions.
+func (pt *PageTable) committed() RootPointer {
+	pt.m.Lock()
+	defer pt.m.Unlock()
+	return pt.root0
 }
 
 func (pt *PageTable) newTransaction(rw bool) (*BaseTransaction, error) {
+	if !rw {
+		// The read-only transactions read the committed root and
+		// they do not claim root1 from the read-write transactions.
+		root := pt.root0
+		tr := &BaseTransaction{
+			pt:   pt,
+			root: &root,
+		}
+		pt.readers[tr] = true
+		return tr, nil
+	}
 	if pt.root1.Generation > pt.root0.Generation {
 		return nil, fmt.Errorf("base transaction already started")
 	}
+	nonce, err := newNonce()
+	if err != nil {
+		return nil, err
+	}
+	pt.initAlloc()
 	pt.root1 = pt.root0
 	pt.root1.Generation++
 
-	tr := &BaseTransaction{
-		pt: pt,
-		rw: rw,
+	return &BaseTransaction{
+		pt:       pt,
+		rw:       true,
+		writable: make(map[PhysicalID]PhysicalID),
+		written:  make(map[LogicalID]PhysicalID),
+		nonce:    nonce,
+	}, nil
+}
+
+// initAlloc resets the page allocators to the committed root pointer
+// if there are no active transactions.
+func (pt *PageTable) initAlloc() {
+	if pt.root1.Generation > pt.root0.Generation || len(pt.concurrent) > 0 {
+		return
 	}
-	if rw {
-		tr.writable = make(map[PhysicalID]PhysicalID)
+	pt.nextPhysical = pt.root0.NextPhysical
+	pt.nextLogical = pt.root0.NextLogical
+
+	// Drop the free pages which are past the committed pages.
+	free := pt.freePhysical[:0]
+	for _, pagenum := range pt.freePhysical {
+		if pagenum < pt.nextPhysical {
+			free = append(free, pagenum)
+		}
 	}
-	return tr, nil
+	pt.freePhysical = free
 }
 
 func (pt *PageTable) commit(tr *BaseTransaction) error {
-	if !tr.rw {
-		pt.root1.Generation = pt.root0.Generation
+	if tr.concurrent {
+		return pt.commitConcurrent(tr)
+	}
+	if tr.root != nil {
+		// Read-only transaction.
+		delete(pt.readers, tr)
 		return nil
 	}
 
 	fmt.Printf("PageTable.commit: root0:\n%v\n", pt.root0)
 	fmt.Printf("root1:\n%v\n", pt.root1)
 
+	if pt.db.params.Compression {
+		err := pt.compressPages(tr)
+		if err != nil {
+			return err
+		}
+		// The older format versions stay readable by the engines
+		// predating the feature flags.
+		if pt.root1.Version > 0 {
+			pt.root1.Flags |= RootFlagCompressed
+		}
+	}
+
+	if pt.db.params.RetainGenerations > 0 {
+		err := pt.pushHistory(tr)
+		if err != nil {
+			return err
+		}
+	}
+	if pt.root1.authenticated() {
+		err := pt.authenticate(tr)
+		if err != nil {
+			return err
+		}
+	}
+	if len(tr.writable) > 0 {
+		pt.root1.Nonce = tr.nonce
+	}
+	pt.root1.Timestamp = uint64(time.Now().UnixNano())
+	pt.root1.NextPhysical = pt.nextPhysical
+	pt.root1.NextLogical = pt.nextLogical
+
+	if pt.root1.Log != 0 {
+		return pt.commitLog(tr)
+	}
+	return pt.commitRoot(tr)
+}
+
+// commitRoot writes the pages of the transaction tr and the root
+// pointer root1 to the device and makes root1 the committed root.
+func (pt *PageTable) commitRoot(tr *BaseTransaction) error {
 	buf := pt.rootBlock.Data()
 	pt.formatRootBlock(&pt.root1, buf)
 
-	err := pt.db.cache.flush()
-	if err != nil {
-		return err
-	}
-	err = pt.db.device.Sync()
+	err := pt.sync(tr)
 	if err != nil {
 		return err
 	}
-
-	pt.root0 = pt.root1
+	pt.publish()
 
 	return nil
 }
 
+// publish makes root1 the committed root.
+func (pt *PageTable) publish() {
+	pt.m.Lock()
+	pt.root0 = pt.root1
+	pt.m.Unlock()
+	clear(pt.tlb)
+}
+
 func (pt *PageTable) abort(tr *BaseTransaction) error {
+	if tr.root != nil && !tr.concurrent {
+		delete(pt.readers, tr)
+		return nil
+	}
+	pt.forgetFlushed(tr)
+	// Drop the pages of the transaction since their physical IDs
+	// will be allocated again.
+	for pid := range tr.writable {
+		pt.db.cache.drop(pid)
+	}
+	if tr.concurrent {
+		delete(pt.concurrent, tr)
+		return nil
+	}
 	pt.root1.Generation = pt.root0.Generation
+	clear(pt.tlb)
 	return nil
 }
 
 func (pt *PageTable) allocLogicalID() (LogicalID, error) {
 	// XXX LogicalID freelist.
 
-	pagenum := pt.root1.NextLogical
-	pt.root1.NextLogical++
+	pagenum := pt.nextLogical
+	if pagenum > IDPagenumMask {
+		return 0, fmt.Errorf("logical page IDs exhausted")
+	}
+	pt.nextLogical++
 
 	return NewLogicalID(0, 0, pagenum), nil
 }
@@ -356,73 +957,242 @@ func (pt *PageTable) freeLogicalID(id LogicalID) error {
 }
 
 func (pt *PageTable) allocPhysicalID() (PhysicalID, error) {
-	// XXX PhysicalID freelist
+	if len(pt.freePhysical) > 0 {
+		pagenum := pt.freePhysical[len(pt.freePhysical)-1]
+		pt.freePhysical = pt.freePhysical[:len(pt.freePhysical)-1]
+		return NewPhysicalID(0, pagenum), nil
+	}
+	return pt.newPhysicalID()
+}
 
-	pagenum := pt.root1.NextPhysical
-	pt.root1.NextPhysical++
+// newPhysicalID allocates a physical page after all allocated pages.
+func (pt *PageTable) newPhysicalID() (PhysicalID, error) {
+	pagenum := pt.nextPhysical
+	if pagenum > PIDPagenumMask {
+		return 0, fmt.Errorf("physical page IDs exhausted")
+	}
+	pt.nextPhysical++
 
 	return NewPhysicalID(0, pagenum), nil
 }
 
+// freePhysicalID returns the physical page pid to the allocator. The
+// page must not be referenced from the page table. The cached page is
+// dropped without flushing it. The free pages are not persisted so
+// the pages which are free when the database is closed are lost.
 func (pt *PageTable) freePhysicalID(pid PhysicalID) error {
-	return fmt.Errorf("PageTable.freePhysicalID not implemented yet")
+	pagenum := pid.Pagenum()
+	if pid.Compressed() || pagenum == 0 || pagenum >= pt.nextPhysical {
+		return fmt.Errorf("invalid physical ID %v", pid)
+	}
+	pt.db.cache.drop(pid)
+	delete(pt.flushed, pid)
+	pt.freePhysical = append(pt.freePhysical, pagenum)
+	return nil
 }
 
 // Get maps the logical ID to its current physical ID.
 func (pt *PageTable) get(tr *BaseTransaction, id LogicalID) (
 	PhysicalID, error) {
 
-	pagenum := id.Pagenum()
+	pid, _, err := pt.translate(tr, id)
+	return pid, err
+}
+
+// translation defines a translation cache entry. The mac is the MAC
+// of the physical page, or nil if the page table is not
+// authenticated.
+type translation struct {
+	pid PhysicalID
+	mac []byte
+}
 
-	if pagenum >= uint64(pt.root1.numPages()) {
-		return 0, fmt.Errorf("unmapped page %v", id)
+// translate returns the physical ID and its MAC for the logical ID
+// id. The translations of the current generation are cached in the
+// translation cache.
+func (pt *PageTable) translate(tr *BaseTransaction, id LogicalID) (
+	PhysicalID, []byte, error) {
+
+	// The TLB caches the translations of root1. The read-only
+	// transactions of the committed root use it when no read-write
+	// transaction has modified root1.
+	useTLB := tr == nil || tr.root == nil ||
+		(!tr.rw && tr.root.Generation == pt.root0.Generation &&
+			pt.root1.Generation <= pt.root0.Generation)
+	if useTLB {
+		t, ok := pt.tlb[pt.tlbKey(id)]
+		if ok {
+			return t.pid, t.mac, nil
+		}
 	}
 
-	perPage := uint64(pt.root1.idsPerPage())
+	pid, mac, err := pt.lookup(tr, id)
+	if err != nil {
+		return 0, nil, err
+	}
+	if useTLB {
+		mac = bytes.Clone(mac)
+		pt.cacheTranslation(id, translation{
+			pid: pid,
+			mac: mac,
+		})
+	}
 
-	var perID uint64 = 1
-	var depth int
-	for depth = int(pt.root1.Depth); depth > 0; depth-- {
-		perID *= perPage
+	return pid, mac, nil
+}
+
+// lookup traverses the page table of the transaction and returns the
+// physical ID and its MAC for the logical ID id. The MAC is nil if
+// the page table is not authenticated. The page table pages are
+// verified against their MACs when they are loaded from the device.
+func (pt *PageTable) lookup(tr *BaseTransaction, id LogicalID) (
+	PhysicalID, []byte, error) {
+
+	root := pt.rootFor(tr)
+
+	table := root.PageTable
+	depth := int(root.Depth)
+	var mac []byte
+	if root.authenticated() {
+		mac = root.PageTableMAC[:]
+	}
+
+	objectID := root.objectID(id)
+	if objectID != 0 {
+		// Find the object's page table from the object directory.
+		dir, dirDepth := root.Objects.treeRoot()
+		entry, _, err := pt.lookupTree(tr, root, dir, dirDepth, nil,
+			uint64(objectID))
+		if err != nil {
+			return 0, nil, err
+		}
+		if entry == 0 {
+			return 0, nil, fmt.Errorf("unmapped page %v", id)
+		}
+		table, depth = entry.treeRoot()
+	}
+
+	pid, mac, err := pt.lookupTree(tr, root, table, depth, mac, id.Pagenum())
+	if err != nil {
+		return 0, nil, err
+	}
+	if pid.Pagenum() == 0 {
+		return 0, nil, fmt.Errorf("unmapped page %v", id)
 	}
+	return pid, mac, nil
+}
+
+// lookupTree traverses the page table tree rooted at table and
+// returns the entry and its MAC for the key. The mac is the MAC of the
+// tree root, or nil if the page table is not authenticated. The
+// function returns a zero entry if the key is not mapped.
+func (pt *PageTable) lookupTree(tr *BaseTransaction, root *RootPointer,
+	table PhysicalID, depth int, mac []byte, key uint64) (
+	PhysicalID, []byte, error) {
+
+	if depth > root.maxDepth() {
+		return 0, nil, fmt.Errorf("invalid page table depth %v", depth)
+	}
+	if table.Pagenum() == 0 || key >= root.span(depth) {
+		return 0, nil, nil
+	}
+	perPage := uint64(root.idsPerPage())
+	entrySize := uint64(root.entrySize())
+
+	perID := root.span(depth) / perPage
 
 	// Traverse page table.
 
-	pageTable := pt.root1.PageTable
-	ref, err := pt.db.cache.Get(pageTable)
+	ref, err := pt.db.cache.Get(table)
 	if err != nil {
-		return 0, err
+		return 0, nil, err
+	}
+	if mac != nil {
+		err = pt.verify(tr, ref, mac)
+		if err != nil {
+			ref.release()
+			return 0, nil, err
+		}
 	}
 
-	for depth = int(pt.root1.Depth); depth > 0; depth-- {
-		idx := pagenum / perID
-		pagenum = pagenum % perID
+	for ; depth > 0; depth-- {
+		idx := key / perID
+		key = key % perID
 
 		perID /= perPage
 
 		buf := ref.Read()
-		pageTable = PhysicalID(bo.Uint64(buf[idx*8:]))
-		ref.Release()
+		if idx >= uint64(len(buf))/entrySize {
+			ref.release()
+			return 0, nil, fmt.Errorf("page table %v: invalid index %v",
+				table, idx)
+		}
+		table = PhysicalID(bo.Uint64(buf[idx*entrySize:]))
+		if mac != nil {
+			mac = make([]byte, MACSize)
+			copy(mac, buf[idx*entrySize+8:])
+		}
+		ref.release()
 
-		if pageTable.Pagenum() == 0 {
-			return 0, fmt.Errorf("unmapped page %v", id)
+		if table.Pagenum() == 0 {
+			return 0, nil, nil
 		}
 
-		ref, err = pt.db.cache.Get(pageTable)
+		ref, err = pt.db.cache.Get(table)
 		if err != nil {
-			return 0, err
+			return 0, nil, err
+		}
+		if mac != nil {
+			err = pt.verify(tr, ref, mac)
+			if err != nil {
+				ref.release()
+				return 0, nil, err
+			}
 		}
 	}
 
 	buf := ref.Read()
-	pid := PhysicalID(bo.Uint64(buf[pagenum*8:]))
-	ref.Release()
+	if key >= uint64(len(buf))/entrySize {
+		ref.release()
+		return 0, nil, fmt.Errorf("page table %v: invalid index %v",
+			table, key)
+	}
+	entry := PhysicalID(bo.Uint64(buf[key*entrySize:]))
+	if mac != nil {
+		mac = make([]byte, MACSize)
+		copy(mac, buf[key*entrySize+8:])
+	}
+	ref.release()
 
-	if pid.Pagenum() == 0 {
-		return 0, fmt.Errorf("unmapped page %v", id)
+	return entry, mac, nil
+}
+
+// rootFor returns the root pointer of the transaction tr.
+func (pt *PageTable) rootFor(tr *BaseTransaction) *RootPointer {
+	if tr != nil && tr.root != nil {
+		return tr.root
 	}
+	return &pt.root1
+}
+
+// tlbKey returns the translation cache key of the logical ID id. The
+// ObjectID is part of the key only if the object page tables are
+// enabled.
+func (pt *PageTable) tlbKey(id LogicalID) LogicalID {
+	return NewLogicalID(0, pt.root0.objectID(id), id.Pagenum())
+}
 
-	return pid, nil
+// cacheTranslation adds the mapping from the logical ID id to the
+// physical ID pid into the translation cache. The cache is cleared
+// when it grows beyond its maximum size.
+func (pt *PageTable) cacheTranslation(id LogicalID, t translation) {
+	if pt.db.params.TLBSize <= 0 {
+		return
+	}
+	if len(pt.tlb) >= pt.db.params.TLBSize {
+		clear(pt.tlb)
+	}
+	pt.tlb[pt.tlbKey(id)] = t
 }
 
 // Set updates the mapping from the logical ID id to the physical ID
@@ -434,89 +1204,156 @@ func (pt *PageTable) set(tr *BaseTransaction, id LogicalID,
 	if pagenum == 0 {
 		panic("mapping logical page 0")
 	}
+	delete(pt.tlb, pt.tlbKey(id))
+
+	root := pt.rootFor(tr)
+	objectID := root.objectID(id)
+	if objectID == 0 {
+		var mac []byte
+		if root.authenticated() {
+			mac = root.PageTableMAC[:]
+		}
+		depth := int(root.Depth)
+		err := pt.setTree(tr, &root.PageTable, &depth, mac, pagenum, pid)
+		root.Depth = uint16(depth)
+		return err
+	}
 
-	for pagenum >= uint64(pt.root1.numPages()) {
-		// Increase page table depth.
-		pageTable, err := pt.allocPhysicalID()
+	// Update the object's page table and its entry in the object
+	// directory.
+	dir, dirDepth := root.Objects.treeRoot()
+	entry, _, err := pt.lookupTree(tr, root, dir, dirDepth, nil,
+		uint64(objectID))
+	if err != nil {
+		return err
+	}
+	table, depth := entry.treeRoot()
+	err = pt.setTree(tr, &table, &depth, nil, pagenum, pid)
+	if err != nil {
+		return err
+	}
+	return pt.setObject(tr, objectID, newTreeRoot(table, depth))
+}
+
+// setObject sets the object directory entry of the object objectID.
+func (pt *PageTable) setObject(tr *BaseTransaction, objectID uint16,
+	entry PhysicalID) error {
+
+	root := pt.rootFor(tr)
+	dir, dirDepth := root.Objects.treeRoot()
+	err := pt.setTree(tr, &dir, &dirDepth, nil, uint64(objectID), entry)
+	if err != nil {
+		return err
+	}
+	root.Objects = newTreeRoot(dir, dirDepth)
+	return nil
+}
+
+// setTree maps the key to the entry value in the page table tree
+// rooted at table. The tree is created if table is zero, and it is
+// grown until it covers the key. The table and depth are updated to
+// the root and depth of the modified tree. The mac is the MAC of the
+// current tree root, or nil if the page table is not authenticated.
+func (pt *PageTable) setTree(tr *BaseTransaction, table *PhysicalID,
+	depth *int, mac []byte, key uint64, value PhysicalID) error {
+
+	root := pt.rootFor(tr)
+	if *depth > root.maxDepth() {
+		return fmt.Errorf("invalid page table depth %v", *depth)
+	}
+	if table.Pagenum() == 0 {
+		pageTable, ref, err := pt.newTablePage(tr)
 		if err != nil {
 			return err
 		}
-		ref, err := pt.db.cache.New(pageTable, nil)
+		ref.release()
+		*table = pageTable
+		*depth = 0
+	}
+
+	for key >= root.span(*depth) {
+		// Increase page table depth.
+		pageTable, ref, err := pt.newTablePage(tr)
 		if err != nil {
-			pt.freePhysicalID(pageTable)
 			return err
 		}
-		tr.writable[pageTable] = 0
 		buf := ref.Data()
-		bo.PutUint64(buf, uint64(pt.root1.PageTable))
-		ref.Release()
+		bo.PutUint64(buf, uint64(*table))
+		if mac != nil {
+			copy(buf[8:], mac)
+		}
+		ref.release()
 
-		pt.root1.PageTable = pageTable
-		pt.root1.Depth++
+		*table = pageTable
+		*depth++
 	}
 
-	perPage := uint64(pt.root1.idsPerPage())
+	perPage := uint64(root.idsPerPage())
+	entrySize := uint64(root.entrySize())
 
-	var perID uint64 = 1
-	var depth int
-	for depth = int(pt.root1.Depth); depth > 0; depth-- {
-		perID *= perPage
-	}
+	perID := root.span(*depth) / perPage
 
 	// Traverse page table.
 
-	pageTable := pt.root1.PageTable
-	ref, pageTable, err := pt.writable(tr, pageTable)
+	ref, pageTable, err := pt.writable(tr, *table)
 	if err != nil {
 		return err
 	}
-	pt.root1.PageTable = pageTable
+	*table = pageTable
 
-	for depth = int(pt.root1.Depth); depth > 0; depth-- {
-		idx := pagenum / perID
-		pagenum = pagenum % perID
+	for d := *depth; d > 0; d-- {
+		idx := key / perID
+		key = key % perID
 
 		perID /= perPage
 
 		buf := ref.Data()
-		pageTable = PhysicalID(bo.Uint64(buf[idx*8:]))
+		pageTable = PhysicalID(bo.Uint64(buf[idx*entrySize:]))
 
 		var nref *PageRef
 		if pageTable.Pagenum() == 0 {
 			// On-demand allocate missing page table pages.
-			pageTable, err = pt.allocPhysicalID()
-			if err != nil {
-				ref.Release()
-				return err
-			}
-			nref, err = pt.db.cache.New(pageTable, nil)
-			if err != nil {
-				pt.freePhysicalID(pageTable)
-				ref.Release()
-				return err
-			}
-			tr.writable[pageTable] = 0
-
+			pageTable, nref, err = pt.newTablePage(tr)
 		} else {
 			nref, pageTable, err = pt.writable(tr, pageTable)
-			if err != nil {
-				ref.Release()
-				return err
-			}
 		}
-		bo.PutUint64(buf[idx*8:], uint64(pageTable))
-		ref.Release()
+		if err != nil {
+			ref.release()
+			return err
+		}
+		bo.PutUint64(buf[idx*entrySize:], uint64(pageTable))
+		ref.release()
 
 		ref = nref
 	}
 
 	buf := ref.Data()
-	bo.PutUint64(buf[pagenum*8:], uint64(pid))
-	ref.Release()
+	bo.PutUint64(buf[key*entrySize:], uint64(value))
+	ref.release()
 
 	return nil
 }
 
+// newTablePage allocates a new empty page table page for the
+// transaction.
+func (pt *PageTable) newTablePage(tr *BaseTransaction) (
+	PhysicalID, *PageRef, error) {
+
+	pid, err := pt.allocPhysicalID()
+	if err != nil {
+		return 0, nil, err
+	}
+	ref, err := pt.db.cache.New(pid, nil)
+	if err != nil {
+		pt.freePhysicalID(pid)
+		return 0, nil, err
+	}
+	tr.writable[pid] = 0
+	ref.label(tr, PageTypePageTable, 0)
+	_ = ref.Data()
+	return pid, ref, nil
+}
+
 func (pt *PageTable) writable(tr *BaseTransaction, pid PhysicalID) (
 	*PageRef, PhysicalID, error) {
 	_, ok := tr.writable[pid]
@@ -539,7 +1376,7 @@ func (pt *PageTable) writable(tr *BaseTransaction, pid PhysicalID) (
 		pt.freePhysicalID(newPid)
 		return nil, 0, err
 	}
-	defer oldRef.Release()
+	defer oldRef.release()
 
 	newRef, err := pt.db.cache.New(newPid, oldRef.Read())
 	if err != nil {
@@ -547,13 +1384,17 @@ func (pt *PageTable) writable(tr *BaseTransaction, pid PhysicalID) (
 		return nil, 0, err
 	}
 	tr.writable[newPid] = pid
+	newRef.label(tr, PageTypePageTable, 0)
 
 	return newRef, newPid, nil
 }
 
 // RootPointer implements the database root, which contains
 // information about the database state, snapshots, and high-level
-// data. It is written atomically to the first storage page.
+// data. It is written atomically to the first storage page. The Flags
+// specify the required features of the database. The CompatFlags
+// specify the optional features, which the engines may ignore; the
+// unknown compatible flags are preserved over commits.
 type RootPointer struct {
 	Magic        uint64
 	Flags        uint16
@@ -567,11 +1408,92 @@ type RootPointer struct {
 	Freelist     PhysicalID
 	Snapshots    PhysicalID
 	UserData     uint64
+	Objects      PhysicalID
+	Log          PhysicalID
+	LogPages     uint64
+	PageTableMAC [MACSize]byte
+	Version      uint16
+	CompatFlags  uint16
+	Nonce        uint64
 	Checksum     [16]byte
 }
 
+// size returns the size of the root pointer in the root block.
+func (rp RootPointer) size() int {
+	return rootLayouts[min(int(rp.Version), len(rootLayouts)-1)].size
+}
+
+// sameGeneration tests if the root pointers identify the same
+// generation of the same database. The copies of the generation in
+// the backups and in the follower devices have their own root history
+// so the root pointers are compared by the fields that the copies
+// keep.
+func (rp RootPointer) sameGeneration(o RootPointer) bool {
+	return rp.Generation == o.Generation &&
+		rp.NextPhysical == o.NextPhysical &&
+		rp.Timestamp == o.Timestamp &&
+		rp.PageTable == o.PageTable
+}
+
+func (rp RootPointer) authenticated() bool {
+	return rp.Flags&RootFlagAuthenticated != 0
+}
+
+// objectID returns the ObjectID of the logical ID id, or 0 if the
+// object page tables are not enabled.
+func (rp RootPointer) objectID(id LogicalID) uint16 {
+	if rp.Flags&RootFlagObjectTables == 0 {
+		return 0
+	}
+	return id.ObjectID()
+}
+
+// entrySize returns the size of the page table entries in bytes.
+func (rp RootPointer) entrySize() int {
+	if rp.authenticated() {
+		return 8 + MACSize
+	}
+	return 8
+}
+
+// payloadSize returns the number of usable bytes in the pages.
+func (rp RootPointer) payloadSize() int {
+	if rp.Flags&RootFlagPageHeaders != 0 {
+		return int(rp.PageSize) - PageHeaderSize
+	}
+	return int(rp.PageSize)
+}
+
 func (rp RootPointer) idsPerPage() int {
-	return int(rp.PageSize / 8)
+	return rp.payloadSize() / rp.entrySize()
+}
+
+// span returns the number of entries mapped by a page table tree of
+// the depth.
+func (rp RootPointer) span(depth int) uint64 {
+	perPage := uint64(rp.idsPerPage())
+	span := perPage
+
+	for ; depth > 0; depth-- {
+		span *= perPage
+	}
+	return span
+}
+
+// maxDepth returns the page table depth that maps all page numbers.
+func (rp RootPointer) maxDepth() int {
+	perPage := uint64(rp.idsPerPage())
+	if perPage < 2 {
+		return 0
+	}
+	var depth int
+	for span := perPage; span <= PIDPagenumMask; depth++ {
+		if span > PIDPagenumMask/perPage {
+			return depth + 1
+		}
+		span *= perPage
+	}
+	return depth
 }
 
 func (rp RootPointer) numPages() int {
@@ -594,10 +1516,18 @@ func (rp RootPointer) String() string {
 	row.Column("Magic")
 	row.Column(fmt.Sprintf("%x", rp.Magic))
 
+	row = tab.Row()
+	row.Column("Version")
+	row.Column(fmt.Sprintf("%v", rp.Version))
+
 	row = tab.Row()
 	row.Column("Flags")
 	row.Column(fmt.Sprintf("%016b", rp.Flags))
 
+	row = tab.Row()
+	row.Column("CompatFlags")
+	row.Column(fmt.Sprintf("%016b", rp.CompatFlags))
+
 	row = tab.Row()
 	row.Column("Depth")
 	row.Column(fmt.Sprintf("%v", rp.Depth))
@@ -638,5 +1568,21 @@ func (rp RootPointer) String() string {
 	row.Column("UserData")
 	row.Column(fmt.Sprintf("%v", rp.UserData))
 
+	row = tab.Row()
+	row.Column("Objects")
+	row.Column(fmt.Sprintf("%v", rp.Objects))
+
+	row = tab.Row()
+	row.Column("Log")
+	row.Column(fmt.Sprintf("%v", rp.Log))
+
+	row = tab.Row()
+	row.Column("LogPages")
+	row.Column(fmt.Sprintf("%v", rp.LogPages))
+
+	row = tab.Row()
+	row.Column("Nonce")
+	row.Column(fmt.Sprintf("%016x", rp.Nonce))
+
 	return tab.String()
 }
@@ -7,6 +7,7 @@
 package db
 
 import (
+	"bytes"
 	"fmt"
 	"math/rand"
 	"os"
@@ -211,3 +212,336 @@ func TestPageTableLevels(t *testing.T) {
 		}
 	}
 }
+
+func TestPageTableTLB(t *testing.T) {
+	params := NewParams()
+	params.PageSize = 1024
+
+	db, err := Create(params, NewMemDevice(1024*1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr, err := db.NewTransaction(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, id, err := tr.NewPage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref.Release()
+	err = tr.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tr, err = db.NewTransaction(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid0, err := db.pt.get(tr, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.pt.tlb[id].pid != pid0 {
+		t.Errorf("translation not cached")
+	}
+	ref, err = tr.WritablePage(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref.Release()
+	pid1, err := db.pt.get(tr, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pid1 == pid0 {
+		t.Errorf("stale translation after set: %v", pid1)
+	}
+	err = tr.Abort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(db.pt.tlb) != 0 {
+		t.Errorf("translation cache not invalidated at abort")
+	}
+}
+
+// formatFixture describes a database written by the engine of an
+// older format version. The fixtures hold 8 data pages, created and
+// updated in 3 rounds of 1 transaction each. The first bytes of the
+// pages hold the text "page <index> round <round>". The round r is
+// committed as the generation r+1.
+type formatFixture struct {
+	file    string
+	version uint16
+	params  func(params *Params)
+}
+
+var formatFixtures = []formatFixture{
+	{
+		file:    "testdata/format-v0.shades",
+		version: 0,
+	},
+}
+
+// openFixture opens the fixture database into a memory device.
+func openFixture(t *testing.T, fixture formatFixture) (*DB, *MemDevice) {
+	data, err := os.ReadFile(fixture.file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	device := NewMemDevice(1024 * 1024)
+	_, err = device.WriteAt(data, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := Open(fixtureParams(fixture), device)
+	if err != nil {
+		t.Fatalf("%s: %v", fixture.file, err)
+	}
+	return db, device
+}
+
+// fixtureParams returns the parameters for opening the fixture
+// database.
+func fixtureParams(fixture formatFixture) Params {
+	params := NewParams()
+	if fixture.params != nil {
+		fixture.params(&params)
+	}
+	return params
+}
+
+// verifyFixture verifies that the transaction views the fixture pages
+// of the round.
+func verifyFixture(t *testing.T, tr *BaseTransaction, fixture formatFixture,
+	round int) {
+
+	for i := 0; i < 8; i++ {
+		id := NewLogicalID(0, 0, uint64(i+1))
+		ref, err := tr.ReadablePage(id)
+		if err != nil {
+			t.Fatalf("%s: page %v: %v", fixture.file, id, err)
+		}
+		expected := fmt.Sprintf("page %d round %d", i, round)
+		if !bytes.HasPrefix(ref.Read(), []byte(expected)) {
+			t.Errorf("%s: page %v: got %q, expected %q", fixture.file, id,
+				ref.Read()[:len(expected)], expected)
+		}
+		ref.Release()
+	}
+}
+
+// updateFixture writes the fixture pages of the round.
+func updateFixture(t *testing.T, db *DB, fixture formatFixture, round int) {
+	err := db.Update(func(tr *BaseTransaction) error {
+		for i := 0; i < 8; i++ {
+			id := NewLogicalID(0, 0, uint64(i+1))
+			ref, err := tr.WritablePage(id)
+			if err != nil {
+				return err
+			}
+			data := ref.Data()
+			clear(data)
+			copy(data, fmt.Sprintf("page %d round %d", i, round))
+			ref.Release()
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("%s: round %v: %v", fixture.file, round, err)
+	}
+}
+
+func TestFormatFixtures(t *testing.T) {
+	for _, fixture := range formatFixtures {
+		db, device := openFixture(t, fixture)
+		if db.Root().Version != fixture.version {
+			t.Errorf("%s: version %v, expected %v", fixture.file,
+				db.Root().Version, fixture.version)
+		}
+		err := db.View(func(tr *BaseTransaction) error {
+			verifyFixture(t, tr, fixture, 3)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The new generations are written in the fixture format.
+		updateFixture(t, db, fixture, 4)
+		err = db.Checkpoint()
+		if err != nil {
+			t.Fatal(err)
+		}
+		size := rootLayouts[fixture.version].size
+		_, err = db.pt.parseRootPointer(device.buf[:size])
+		if err != nil {
+			t.Errorf("%s: root pointer layout: %v", fixture.file, err)
+		}
+
+		db, err = Open(fixtureParams(fixture), device)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if db.Root().Version != fixture.version {
+			t.Errorf("%s: version %v after update", fixture.file,
+				db.Root().Version)
+		}
+		err = db.View(func(tr *BaseTransaction) error {
+			verifyFixture(t, tr, fixture, 4)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// fixRootChecksums sets the checksums of the root pointers of the
+// size in the buffer so that the fuzzed fields reach the root pointer
+// validation.
+func fixRootChecksums(pt *PageTable, buf []byte, size int) {
+	_, layout, _ := layoutOf(size)
+	ofs := layout.checksum
+	for i := 0; i+size <= len(buf); i += size {
+		pt.hash.Data(buf[i:i+ofs], buf[i:i+ofs])
+	}
+}
+
+// FuzzPages fuzzes the page table and history pages of a database. The
+// fuzzed data replaces the beginning of the root page table page and
+// the head history page so that the inputs stay small and the lookups
+// and history walks parse the fuzzed pages directly.
+func FuzzPages(f *testing.F) {
+	params := Params{
+		PageSize:          1024,
+		CacheSize:         fuzzCacheSize,
+		RetainGenerations: 30,
+	}
+	device := NewMemDevice(1024 * 1024)
+	db, err := Create(params, device)
+	if err != nil {
+		f.Fatal(err)
+	}
+	ids := writeTestPages(f, db, nil, 200, 1)
+	for i := 0; i < 10; i++ {
+		writeTestPages(f, db, ids[i*20:i*20+3], 0, byte(i))
+	}
+	root := db.Root()
+	image := device.buf[:root.NextPhysical*uint64(params.PageSize)]
+	tableOfs := root.PageTable.Pagenum() * uint64(params.PageSize)
+	histOfs := root.Snapshots.Pagenum() * uint64(params.PageSize)
+	hist := image[histOfs:]
+	histLen := HistOfsEntries + int(bo.Uint16(hist[HistOfsCount:]))*RootPtrSize
+
+	table := bytes.TrimRight(image[tableOfs:tableOfs+1024], "\x00")
+	f.Add(root.Generation-1, table, hist[:histLen])
+	f.Add(root.Generation-8, table, hist[:HistOfsEntries+RootPtrSize])
+	f.Add(uint64(1), table[:8], hist[:HistOfsEntries])
+
+	f.Fuzz(func(t *testing.T, generation uint64, table, hist []byte) {
+		device := NewMemDevice(len(image))
+		copy(device.buf, image)
+		copy(device.buf[tableOfs:], table[:min(len(table), 1024)])
+		buf := device.buf[histOfs : histOfs+1024]
+		copy(buf, hist[:min(len(hist), 1024)])
+		fixRootChecksums(db.pt, buf[HistOfsEntries:], RootPtrSize)
+
+		params := params
+		params.TLBSize = 0
+		db, err := Open(params, device)
+		if err != nil {
+			return
+		}
+		tr, err := db.NewTransactionAt(generation)
+		if err == nil {
+			readTestPages(tr, ids)
+			tr.Commit()
+		}
+		db.View(func(tr *BaseTransaction) error {
+			readTestPages(tr, ids)
+			return nil
+		})
+		db.Update(func(tr *BaseTransaction) error {
+			ref, err := tr.WritablePage(ids[0])
+			if err != nil {
+				return err
+			}
+			ref.Release()
+			return nil
+		})
+	})
+}
+
+// readTestPages reads the pages with the transaction and ignores the
+// errors.
+func readTestPages(tr *BaseTransaction, ids []LogicalID) {
+	for _, id := range ids {
+		ref, err := tr.ReadablePage(id)
+		if err == nil {
+			ref.Release()
+		}
+	}
+}
+
+func FuzzParseRootBlock(f *testing.F) {
+	params := NewParams()
+	params.PageSize = 1024
+	pt, err := NewPageTable(&DB{
+		params: params,
+	})
+	if err != nil {
+		f.Fatal(err)
+	}
+	root := RootPointer{
+		Magic:        RootPtrMagic,
+		PageSize:     1024,
+		Generation:   1,
+		NextPhysical: 2,
+		NextLogical:  1,
+		PageTable:    NewPhysicalID(0, 1),
+		Version:      FormatVersion,
+	}
+	buf := make([]byte, params.PageSize)
+	pt.formatRootBlock(&root, buf)
+	f.Add(buf)
+	f.Add(buf[:RootPtrSize+1])
+	f.Add([]byte{})
+
+	for version := range FormatVersion {
+		root.Version = version
+		buf = make([]byte, params.PageSize)
+		pt.formatRootBlock(&root, buf)
+		f.Add(buf)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, layout := range append([]rootLayout{{}}, rootLayouts...) {
+			size := layout.size
+			if size > 0 {
+				data = append([]byte(nil), data...)
+				fixRootChecksums(pt, data, size)
+			}
+			err := pt.parseRootBlock(data)
+			if err != nil {
+				continue
+			}
+			root := pt.root0
+			err = root.validate()
+			if err != nil {
+				t.Fatalf("parsed invalid root pointer: %v", err)
+			}
+			buf := make([]byte, root.size()+1)
+			pt.formatRootPointer(&root, buf[:root.size()])
+			err = pt.parseRootBlock(buf)
+			if err != nil {
+				t.Fatalf("formatted root pointer: %v", err)
+			}
+			if pt.root0 != root {
+				t.Fatalf("root pointer round trip: %v != %v", pt.root0, root)
+			}
+		}
+	})
+}
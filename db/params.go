@@ -6,15 +6,118 @@
 
 package db
 
+// DefaultCacheSize specifies the default size of the page cache in
+// bytes.
+const DefaultCacheSize = 128 * 1024 * 1024
+
 // Params define the database parameters.
 type Params struct {
 	PageSize int
+
+	// CacheSize specifies the size of the page cache in bytes. The
+	// value 0 selects DefaultCacheSize.
+	CacheSize int
+
+	// FlushWorkers specifies the number of parallel I/O workers used
+	// when writing dirty pages to the device. Values smaller than 2
+	// write pages sequentially.
+	FlushWorkers int
+
+	// MaxWriteSize specifies the maximum number of bytes the cache
+	// writes to the device with a single coalesced write.
+	MaxWriteSize int
+
+	// TLBSize specifies the maximum number of logical to physical
+	// page translations that the page table caches. The value 0
+	// disables the translation cache.
+	TLBSize int
+
+	// ReadAhead specifies the number of pages that are prefetched
+	// when a transaction reads logical pages sequentially. The value
+	// 0 disables the read-ahead.
+	ReadAhead int
+
+	// Compression enables transparent data page compression. The
+	// data pages are compressed when the transaction commits and
+	// the compressed pages are packed into smaller physical slots.
+	Compression bool
+
+	// RetainGenerations specifies the number of past committed
+	// generations that are retained in the root history and can be
+	// viewed with DB.NewTransactionAt. The root history is cut after
+	// the retained generations when its head page fills. The physical
+	// pages are never reused so the pages of the retained generations
+	// stay valid.
+	RetainGenerations int
+
+	// AuthKey enables the authenticated mode for new databases and
+	// specifies the key for authenticating the root pointer and the
+	// page table. The key must be a valid AES key. The authenticated
+	// mode detects modified pages. Rolling back the whole device to
+	// an earlier authentic state is detected with AuthGeneration.
+	AuthKey []byte
+
+	// AuthGeneration specifies the latest committed generation of an
+	// authenticated database that the caller has seen, for example
+	// from a trusted monotonic counter. Opening the database fails
+	// with ErrRollback if the authenticated root pointer is older
+	// than AuthGeneration. The zero value disables the check.
+	AuthGeneration uint64
+
+	// PageHeaders enables self-describing page headers for new
+	// databases. The headers allow rebuilding the page table with
+	// Recover.
+	PageHeaders bool
+
+	// ObjectTables enables the per-object page tables for new
+	// databases. The pages of each non-zero LogicalID.ObjectID are
+	// mapped by a separate page table so that small objects do not
+	// grow the global page table. The object page tables can't be
+	// used with the authenticated mode.
+	ObjectTables bool
+
+	// Debug enables the page reference debug checks. In debug mode,
+	// the acquisition stacks of the page references are recorded and
+	// the transactions report their page references that are still
+	// pinned when they end. The released pages are written to the
+	// device and their buffers are poisoned to detect the accesses
+	// after release. Since the pages are flushed on release, the
+	// debug mode can't be used with compression. The Data calls
+	// through the references of ReadablePage are rejected unless the
+	// page is written in the transaction.
+	Debug bool
+
+	// WAL enables the write-ahead log mode for new databases. In WAL
+	// mode, the commits append the page deltas of the transactions
+	// into the log and sync only the log. The logged changes are
+	// written into the shadow pages by Checkpoint and replayed when
+	// the database is opened. The WAL mode can't be used with
+	// compression or with the authenticated mode.
+	WAL bool
+
+	// WALSize specifies the size of the write-ahead log in bytes.
+	WALSize int
+
+	// ReadOnly opens the database in read-only mode. The read-only
+	// databases reject read-write transactions and never write to
+	// the device. They can be opened concurrently with a writer
+	// process and moved to the generations committed by the writer
+	// with DB.Refresh.
+	ReadOnly bool
 }
 
 // NewParams creates a new parameter object with the system default
 // values.
 func NewParams() Params {
 	return Params{
-		PageSize: 16 * 1024,
+		PageSize:     16 * 1024,
+		CacheSize:    DefaultCacheSize,
+		FlushWorkers: 1,
+		MaxWriteSize: 1024 * 1024,
+		TLBSize:      64 * 1024,
+		ReadAhead:    32,
+
+		RetainGenerations: 16,
+		WALSize:           4 * 1024 * 1024,
 	}
 }
@@ -0,0 +1,246 @@
+//
+// Copyright (c) 2024 Markku Rossi
+//
+// All rights reserved.
+//
+
+package db
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// Block device protocol frame types. The client sends request frames
+// and the server replies to each request with a response frame. The
+// read requests hold the device offset and the read length, and the
+// write requests hold the device offset and the data. The OK response
+// holds the read data. The EOF response holds the data before the end
+// of the device, and the error response holds the error message.
+const (
+	BlockFrameRead  byte = 1
+	BlockFrameWrite byte = 2
+	BlockFrameSync  byte = 3
+
+	BlockFrameOK    byte = 0x80
+	BlockFrameEOF   byte = 0x81
+	BlockFrameError byte = 0x82
+)
+
+// blockMaxIO specifies the maximum number of bytes transferred with a
+// single request. The larger reads and writes are split into multiple
+// requests.
+const blockMaxIO = 1024 * 1024
+
+// ServeDevice serves the device to the block device clients
+// connecting to the listener l. The requests of all clients are
+// serialized. ServeDevice returns when the listener is closed.
+func ServeDevice(l net.Listener, device Device) error {
+	var m sync.Mutex
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go func() {
+			serveDeviceConn(conn, device, &m)
+			conn.Close()
+		}()
+	}
+}
+
+// serveDeviceConn serves the block device requests from the
+// connection conn until the client closes it.
+func serveDeviceConn(conn io.ReadWriter, device Device, m *sync.Mutex) error {
+	for {
+		t, payload, err := readFrame(conn)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		m.Lock()
+		t, payload = serveDeviceRequest(device, t, payload)
+		m.Unlock()
+
+		err = writeFrame(conn, t, payload)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// serveDeviceRequest executes the block device request and returns
+// its response.
+func serveDeviceRequest(device Device, t byte, payload []byte) (
+	byte, []byte) {
+
+	var err error
+	var off int64
+	if len(payload) >= 8 {
+		off = int64(bo.Uint64(payload))
+		if off < 0 {
+			return BlockFrameError, []byte("invalid offset")
+		}
+	}
+
+	switch t {
+	case BlockFrameRead:
+		if len(payload) != 12 {
+			err = fmt.Errorf("invalid read request")
+			break
+		}
+		length := bo.Uint32(payload[8:])
+		if length > blockMaxIO {
+			err = fmt.Errorf("read request too long: %v", length)
+			break
+		}
+		buf := make([]byte, length)
+		var n int
+		n, err = device.ReadAt(buf, off)
+		if err == io.EOF {
+			return BlockFrameEOF, buf[:n]
+		}
+		if err == nil {
+			return BlockFrameOK, buf
+		}
+
+	case BlockFrameWrite:
+		if len(payload) < 8 {
+			err = fmt.Errorf("invalid write request")
+			break
+		}
+		_, err = device.WriteAt(payload[8:], off)
+
+	case BlockFrameSync:
+		err = device.Sync()
+
+	default:
+		err = fmt.Errorf("invalid request %v", t)
+	}
+	if err != nil {
+		return BlockFrameError, []byte(err.Error())
+	}
+	return BlockFrameOK, nil
+}
+
+// RemoteDevice implements a device that is served by a block device
+// server over a network connection. The requests are sent one at a
+// time and they return after the server has executed them. The
+// remote device does not protect the data it stores: the database
+// pages can be protected with an ORAMDevice on top of the remote
+// device.
+type RemoteDevice struct {
+	m    sync.Mutex
+	conn io.ReadWriteCloser
+}
+
+var _ Device = &RemoteDevice{}
+
+// DialDevice connects to the block device server at the network
+// address.
+func DialDevice(network, address string) (*RemoteDevice, error) {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return NewRemoteDevice(conn), nil
+}
+
+// NewRemoteDevice creates a remote device that uses the block device
+// server connected to conn.
+func NewRemoteDevice(conn io.ReadWriteCloser) *RemoteDevice {
+	return &RemoteDevice{
+		conn: conn,
+	}
+}
+
+// request sends the request to the server and returns the response
+// payload. The EOF responses return io.EOF with the payload.
+func (dev *RemoteDevice) request(t byte, payload []byte) ([]byte, error) {
+	err := writeFrame(dev.conn, t, payload)
+	if err != nil {
+		return nil, err
+	}
+	t, payload, err = readFrame(dev.conn)
+	if err != nil {
+		return nil, err
+	}
+	switch t {
+	case BlockFrameOK:
+		return payload, nil
+	case BlockFrameEOF:
+		return payload, io.EOF
+	case BlockFrameError:
+		return nil, fmt.Errorf("remote device: %s", payload)
+	default:
+		return nil, fmt.Errorf("invalid response %v", t)
+	}
+}
+
+// Close implements Device.Close.
+func (dev *RemoteDevice) Close() error {
+	return dev.conn.Close()
+}
+
+// ReadAt implements Device.ReadAt.
+func (dev *RemoteDevice) ReadAt(b []byte, off int64) (n int, err error) {
+	dev.m.Lock()
+	defer dev.m.Unlock()
+
+	for n < len(b) {
+		chunk := b[n:min(len(b), n+blockMaxIO)]
+
+		req := bo.AppendUint64(nil, uint64(off+int64(n)))
+		req = bo.AppendUint32(req, uint32(len(chunk)))
+
+		data, err := dev.request(BlockFrameRead, req)
+		if len(data) > len(chunk) {
+			return n, fmt.Errorf("invalid read response")
+		}
+		n += copy(chunk, data)
+		if err != nil {
+			return n, err
+		}
+		if len(data) != len(chunk) {
+			return n, io.ErrUnexpectedEOF
+		}
+	}
+	return n, nil
+}
+
+// Sync implements Device.Sync.
+func (dev *RemoteDevice) Sync() error {
+	dev.m.Lock()
+	defer dev.m.Unlock()
+
+	_, err := dev.request(BlockFrameSync, nil)
+	return err
+}
+
+// WriteAt implements Device.WriteAt.
+func (dev *RemoteDevice) WriteAt(b []byte, off int64) (n int, err error) {
+	dev.m.Lock()
+	defer dev.m.Unlock()
+
+	for n < len(b) {
+		chunk := b[n:min(len(b), n+blockMaxIO)]
+
+		req := bo.AppendUint64(nil, uint64(off+int64(n)))
+		req = append(req, chunk...)
+
+		_, err := dev.request(BlockFrameWrite, req)
+		if err != nil {
+			return n, err
+		}
+		n += len(chunk)
+	}
+	return n, nil
+}
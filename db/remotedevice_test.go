@@ -0,0 +1,128 @@
+//
+// Copyright (c) 2024 Markku Rossi
+//
+// All rights reserved.
+//
+
+package db
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func serveTestDevice(t *testing.T, network, address string,
+	device Device) net.Listener {
+
+	l, err := net.Listen(network, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go ServeDevice(l, device)
+	t.Cleanup(func() {
+		l.Close()
+	})
+	return l
+}
+
+func TestRemoteDevice(t *testing.T) {
+	l := serveTestDevice(t, "tcp", "127.0.0.1:0", NewMemDevice(4*1024*1024))
+
+	dev, err := DialDevice("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dev.Close()
+
+	// The large writes and reads are split into multiple requests.
+	data := make([]byte, 3*1024*1024/2)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	n, err := dev.WriteAt(data, 1024)
+	if err != nil || n != len(data) {
+		t.Fatalf("WriteAt: n=%v, err=%v", n, err)
+	}
+	err = dev.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(data))
+	n, err = dev.ReadAt(buf, 1024)
+	if err != nil || n != len(buf) {
+		t.Fatalf("ReadAt: n=%v, err=%v", n, err)
+	}
+	if !bytes.Equal(buf, data) {
+		t.Errorf("ReadAt: data mismatch")
+	}
+
+	_, err = dev.ReadAt(buf, 4*1024*1024)
+	if err == nil {
+		t.Errorf("out of range read succeeded")
+	}
+	_, err = dev.WriteAt(data, -1)
+	if err == nil {
+		t.Errorf("negative offset write succeeded")
+	}
+}
+
+func TestRemoteDeviceEOF(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	file, err := OpenFileDevice(path, os.O_RDWR|os.O_CREATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	_, err = file.WriteAt([]byte("hello, world"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := serveTestDevice(t, "unix", filepath.Join(t.TempDir(), "sock"),
+		file)
+
+	dev, err := DialDevice("unix", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dev.Close()
+
+	buf := make([]byte, 100)
+	n, err := dev.ReadAt(buf, 7)
+	if err != io.EOF || string(buf[:n]) != "world" {
+		t.Errorf("ReadAt past end: n=%v, err=%v", n, err)
+	}
+}
+
+func TestRemoteDeviceDB(t *testing.T) {
+	l := serveTestDevice(t, "tcp", "127.0.0.1:0", NewMemDevice(4*1024*1024))
+
+	params := NewParams()
+	params.PageSize = 1024
+
+	dev, err := DialDevice("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := Create(params, dev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := writeTestPages(t, db, nil, 100, 1)
+	ids = writeTestPages(t, db, ids, 10, 2)
+	dev.Close()
+
+	dev, err = DialDevice("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dev.Close()
+	db, err = Open(params, dev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyTestPages(t, db, ids, 2)
+}
@@ -0,0 +1,315 @@
+//
+// Copyright (c) 2024 Markku Rossi
+//
+// All rights reserved.
+//
+
+package db
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Replication frame types. The follower opens the stream with a hello
+// frame identifying the generation of its device by the generation,
+// next physical page number, timestamp, and page table root. The
+// primary replies with page frames, holding the device offset and
+// the page data, followed by a root frame holding the root pointer of
+// the generation. The follower acknowledges each applied generation
+// with an ack frame.
+const (
+	ReplFrameHello byte = 1
+	ReplFramePage  byte = 2
+	ReplFrameRoot  byte = 3
+	ReplFrameAck   byte = 4
+
+	// ReplFrameHeaderSize defines the size of the replication frame
+	// header. The replication frames use the shared frame format of
+	// FrameHeaderSize.
+	ReplFrameHeaderSize = FrameHeaderSize
+)
+
+// Replicate streams the committed generations of the database to the
+// follower connected to conn. The new physical pages of each
+// generation are sent before its root pointer so the follower device
+// is consistent at all times. If the follower device does not hold a
+// generation of the database that is still retained, all pages of the
+// database are sent. Replicate returns when the follower closes the
+// connection or when the connection fails, and it closes conn.
+func (db *DB) Replicate(conn io.ReadWriteCloser) error {
+	defer conn.Close()
+
+	t, payload, err := readFrame(conn)
+	if err != nil {
+		return err
+	}
+	if t != ReplFrameHello || len(payload) != 32 {
+		return fmt.Errorf("invalid replication hello frame")
+	}
+	base, err := db.replicationBase(RootPointer{
+		Generation:   bo.Uint64(payload),
+		NextPhysical: bo.Uint64(payload[8:]),
+		Timestamp:    bo.Uint64(payload[16:]),
+		PageTable:    PhysicalID(bo.Uint64(payload[24:])),
+	})
+	if err != nil {
+		return err
+	}
+	sub := db.Subscribe()
+	defer sub.Close()
+
+	errc := make(chan error, 1)
+	done := make(chan struct{})
+	defer func() {
+		conn.Close()
+		<-done
+	}()
+	go func() {
+		defer close(done)
+		for {
+			t, _, err := readFrame(conn)
+			if err == nil && t != ReplFrameAck {
+				err = fmt.Errorf("unexpected replication frame %v", t)
+			}
+			if err != nil {
+				errc <- err
+				sub.Close()
+				return
+			}
+		}
+	}()
+
+	root := db.pt.committed()
+	for {
+		err = db.flushPending()
+		if err != nil {
+			return err
+		}
+		err = db.sendGeneration(conn, root, base)
+		if err != nil {
+			return err
+		}
+		base = root
+
+		for root.Generation == db.pt.committed().Generation {
+			_, ok := <-sub.C
+			if !ok {
+				err = <-errc
+				if err == io.EOF {
+					return nil
+				}
+				return err
+			}
+		}
+		root = db.pt.committed()
+	}
+}
+
+// replicationBase returns the root pointer of the generation that the
+// follower device holds. The argument base identifies the generation
+// by the fields of the follower hello. If base is not a retained
+// generation of the database, the function returns a zero root
+// pointer and all pages are sent.
+func (db *DB) replicationBase(base RootPointer) (RootPointer, error) {
+	if base.Generation == 0 {
+		return RootPointer{}, nil
+	}
+	err := db.flushPending()
+	if err != nil {
+		return RootPointer{}, err
+	}
+	root, err := db.pt.rootAt(base.Generation)
+	if err != nil {
+		return RootPointer{}, nil
+	}
+	if !root.sameGeneration(base) {
+		return RootPointer{}, nil
+	}
+	return root, nil
+}
+
+// sendGeneration sends the physical pages of the generation, which
+// are not part of the generation base, and the root pointer of the
+// generation to conn.
+func (db *DB) sendGeneration(conn io.Writer, root, base RootPointer) error {
+	buf := make([]byte, 0, root.PageSize+8)
+
+	err := walkPages(db.device, root, base,
+		func(pid PhysicalID, data []byte) error {
+			off, _ := physicalRange(pid, int(root.PageSize))
+			buf = bo.AppendUint64(buf[:0], uint64(off))
+			buf = append(buf, data...)
+			return writeFrame(conn, ReplFramePage, buf)
+		})
+	if err != nil {
+		return err
+	}
+	buf = buf[:root.size()]
+	db.pt.formatRootPointer(&root, buf)
+
+	return writeFrame(conn, ReplFrameRoot, buf)
+}
+
+// Follower applies the generations streamed by a primary database
+// into its device and serves them as a read-only database.
+type Follower struct {
+	params Params
+	device Device
+	conn   io.ReadWriter
+	pt     *PageTable
+	root   RootPointer
+	db     *DB
+}
+
+// NewFollower connects the device to the primary database over
+// conn. If the device holds a retained generation of the primary
+// database, only the pages that the generation does not reference are
+// transferred. Otherwise the device is overwritten with all pages of
+// the primary database. The function returns after the latest
+// generation of the primary is applied. The following generations are
+// applied by Run.
+func NewFollower(params Params, device Device, conn io.ReadWriter) (
+	*Follower, error) {
+
+	pt, err := NewPageTable(&DB{
+		params: params,
+	})
+	if err != nil {
+		return nil, err
+	}
+	f := &Follower{
+		params: params,
+		device: device,
+		conn:   conn,
+		pt:     pt,
+	}
+	// The primary checks the generation of the device and sends all
+	// pages if the device does not hold a valid database.
+	root, err := readRoot(params, device)
+	if err != nil {
+		root = RootPointer{}
+	}
+	hello := bo.AppendUint64(nil, root.Generation)
+	hello = bo.AppendUint64(hello, root.NextPhysical)
+	hello = bo.AppendUint64(hello, root.Timestamp)
+	hello = bo.AppendUint64(hello, uint64(root.PageTable))
+	err = writeFrame(conn, ReplFrameHello, hello)
+	if err != nil {
+		return nil, err
+	}
+	err = f.receive()
+	if err != nil {
+		return nil, err
+	}
+	params.ReadOnly = true
+	f.db, err = Open(params, device)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// DB returns the read-only follower database.
+func (f *Follower) DB() *DB {
+	return f.db
+}
+
+// Run applies the generations streamed by the primary until the
+// primary closes the connection or the connection fails. After each
+// generation, the follower database is refreshed once its active
+// transaction ends.
+func (f *Follower) Run() error {
+	for {
+		err := f.receive()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for {
+			_, err = f.db.Refresh()
+			if !errors.Is(err, ErrTransactionActive) {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// receive applies the next generation from the stream.
+func (f *Follower) receive() error {
+	for {
+		t, payload, err := readFrame(f.conn)
+		if err != nil {
+			return err
+		}
+		switch t {
+		case ReplFramePage:
+			if len(payload) < 8 {
+				return fmt.Errorf("invalid replication page frame")
+			}
+			_, err = f.device.WriteAt(payload[8:],
+				int64(bo.Uint64(payload)))
+			if err != nil {
+				return err
+			}
+
+		case ReplFrameRoot:
+			_, _, ok := layoutOf(len(payload))
+			if !ok {
+				return fmt.Errorf("invalid replication root frame")
+			}
+			return f.applyRoot(payload)
+
+		default:
+			return fmt.Errorf("unexpected replication frame %v", t)
+		}
+	}
+}
+
+// applyRoot writes the root pointer of the received generation into
+// the device and acknowledges it.
+func (f *Follower) applyRoot(buf []byte) error {
+	root, err := f.pt.parseRootPointer(buf)
+	if err != nil {
+		return err
+	}
+	if f.root.Generation != 0 && f.root.PageSize != root.PageSize {
+		return fmt.Errorf("page size mismatch: got %v, expected %v",
+			root.PageSize, f.root.PageSize)
+	}
+	if root.Generation < f.root.Generation {
+		return fmt.Errorf("generation %v is older than follower %v",
+			root.Generation, f.root.Generation)
+	}
+	// The root history and the write-ahead log are not replicated.
+	root.Snapshots = 0
+	root.Log = 0
+	root.LogPages = 0
+
+	err = f.device.Sync()
+	if err != nil {
+		return err
+	}
+	block := make([]byte, root.PageSize)
+	f.pt.formatRootBlock(&root, block)
+	_, err = f.device.WriteAt(block, 0)
+	if err != nil {
+		return err
+	}
+	err = f.device.Sync()
+	if err != nil {
+		return err
+	}
+	f.root = root
+
+	return writeFrame(f.conn, ReplFrameAck,
+		bo.AppendUint64(nil, root.Generation))
+}
@@ -0,0 +1,287 @@
+//
+// Copyright (c) 2024 Markku Rossi
+//
+// All rights reserved.
+//
+
+package db
+
+import (
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func waitGeneration(t *testing.T, db *DB, generation uint64) {
+	deadline := time.Now().Add(5 * time.Second)
+	for db.Root().Generation < generation {
+		if time.Now().After(deadline) {
+			t.Fatalf("follower generation %v, expected %v",
+				db.Root().Generation, generation)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func testReplicate(t *testing.T, params Params) {
+	primary, err := Create(params, NewMemDevice(4*1024*1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := writeTestPages(t, primary, nil, 10, 1)
+
+	device := NewMemDevice(4 * 1024 * 1024)
+	for round := 0; round < 2; round++ {
+		pconn, fconn := net.Pipe()
+		replicateErr := make(chan error, 1)
+		go func() {
+			replicateErr <- primary.Replicate(pconn)
+		}()
+
+		follower, err := NewFollower(params, device, fconn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fdb := follower.DB()
+		if fdb.Root().Generation != primary.Root().Generation {
+			t.Errorf("follower generation %v, expected %v",
+				fdb.Root().Generation, primary.Root().Generation)
+		}
+		verifyTestPages(t, fdb, ids, byte(1+round*3))
+
+		runErr := make(chan error, 1)
+		go func() {
+			runErr <- follower.Run()
+		}()
+
+		ids = writeTestPages(t, primary, ids, 5, byte(2+round*3))
+		waitGeneration(t, fdb, primary.Root().Generation)
+		verifyTestPages(t, fdb, ids, byte(2+round*3))
+
+		// Hold a transaction over the next generation.
+		tr, err := fdb.NewTransaction(false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = writeTestPages(t, primary, ids, 0, byte(3+round*3))
+		ids = writeTestPages(t, primary, ids, 0, byte(4+round*3))
+		err = tr.Commit()
+		if err != nil {
+			t.Fatal(err)
+		}
+		waitGeneration(t, fdb, primary.Root().Generation)
+		verifyTestPages(t, fdb, ids, byte(4+round*3))
+
+		_, err = fdb.NewTransaction(true)
+		if err == nil {
+			t.Errorf("follower started read-write transaction")
+		}
+
+		fconn.Close()
+		<-runErr
+		err = <-replicateErr
+		if err != nil {
+			t.Errorf("Replicate: %v", err)
+		}
+	}
+}
+
+func TestReplicate(t *testing.T) {
+	params := NewParams()
+	params.PageSize = 1024
+	testReplicate(t, params)
+}
+
+func TestReplicateWAL(t *testing.T) {
+	params := NewParams()
+	params.PageSize = 1024
+	params.WAL = true
+	params.WALSize = 64 * 1024
+	testReplicate(t, params)
+}
+
+func TestReplicateConcurrent(t *testing.T) {
+	params := NewParams()
+	params.PageSize = 1024
+
+	primary, err := Create(params, NewMemDevice(1024*1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := writeTestPages(t, primary, nil, 10, 1)
+
+	// The transaction committing after the follower connects
+	// allocates its pages before the follower generation.
+	tr1, err := primary.NewConcurrentTransaction()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr2, err := primary.NewConcurrentTransaction()
+	if err != nil {
+		t.Fatal(err)
+	}
+	updatePage(t, tr1, ids[0], 2)
+	updatePage(t, tr2, ids[9], 3)
+	err = tr2.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pconn, fconn := net.Pipe()
+	replicateErr := make(chan error, 1)
+	go func() {
+		replicateErr <- primary.Replicate(pconn)
+	}()
+	follower, err := NewFollower(params, NewMemDevice(1024*1024), fconn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runErr := make(chan error, 1)
+	go func() {
+		runErr <- follower.Run()
+	}()
+
+	err = tr1.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fdb := follower.DB()
+	waitGeneration(t, fdb, primary.Root().Generation)
+	verifyTestPages(t, fdb, ids[1:9], 1)
+	verifyTestPages(t, fdb, ids[:1], 2)
+	verifyTestPages(t, fdb, ids[9:], 3)
+
+	fconn.Close()
+	<-runErr
+	err = <-replicateErr
+	if err != nil {
+		t.Errorf("Replicate: %v", err)
+	}
+}
+
+func TestReplicateFullSync(t *testing.T) {
+	params := NewParams()
+	params.PageSize = 1024
+
+	primary, err := Create(params, NewMemDevice(4*1024*1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := writeTestPages(t, primary, nil, 10, 1)
+
+	// A device holding a newer generation of another database.
+	other := NewMemDevice(4 * 1024 * 1024)
+	odb, err := Create(params, other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var oids []LogicalID
+	for i := 0; i < 5; i++ {
+		oids = writeTestPages(t, odb, oids, 10, byte(10+i))
+	}
+
+	// A device holding random data.
+	corrupt := NewMemDevice(4 * 1024 * 1024)
+	buf := make([]byte, 64*1024)
+	rand.Read(buf)
+	_, err = corrupt.WriteAt(buf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The follower page size is taken from the primary.
+	for _, device := range []*MemDevice{other, corrupt} {
+		pconn, fconn := net.Pipe()
+		replicateErr := make(chan error, 1)
+		go func() {
+			replicateErr <- primary.Replicate(pconn)
+		}()
+		follower, err := NewFollower(NewParams(), device, fconn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fdb := follower.DB()
+		if fdb.Root().Generation != primary.Root().Generation {
+			t.Errorf("follower generation %v, expected %v",
+				fdb.Root().Generation, primary.Root().Generation)
+		}
+		verifyTestPages(t, fdb, ids, 1)
+
+		fconn.Close()
+		err = <-replicateErr
+		if err != nil {
+			t.Errorf("Replicate: %v", err)
+		}
+	}
+}
+
+type failingConn struct {
+	net.Conn
+}
+
+func (c failingConn) Write(p []byte) (int, error) {
+	return 0, errDevice
+}
+
+func TestReplicateSendFailure(t *testing.T) {
+	params := NewParams()
+	params.PageSize = 1024
+
+	primary, err := Create(params, NewMemDevice(4*1024*1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestPages(t, primary, nil, 10, 1)
+
+	pconn, fconn := net.Pipe()
+	replicateErr := make(chan error, 1)
+	go func() {
+		replicateErr <- primary.Replicate(failingConn{pconn})
+	}()
+	err = writeFrame(fconn, ReplFrameHello, make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = <-replicateErr
+	if !errors.Is(err, errDevice) {
+		t.Errorf("Replicate: got %v, expected %v", err, errDevice)
+	}
+
+	// The connection is closed when Replicate returns.
+	_, _, err = readFrame(fconn)
+	if err != io.EOF {
+		t.Errorf("readFrame: got %v, expected %v", err, io.EOF)
+	}
+}
+
+func TestReplicateFormatFixtures(t *testing.T) {
+	for _, fixture := range formatFixtures {
+		primary, _ := openFixture(t, fixture)
+
+		pconn, fconn := net.Pipe()
+		replicateErr := make(chan error, 1)
+		go func() {
+			replicateErr <- primary.Replicate(pconn)
+		}()
+		follower, err := NewFollower(fixtureParams(fixture),
+			NewMemDevice(1024*1024), fconn)
+		if err != nil {
+			t.Fatalf("%s: %v", fixture.file, err)
+		}
+		err = follower.DB().View(func(tr *BaseTransaction) error {
+			verifyFixture(t, tr, fixture, 3)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", fixture.file, err)
+		}
+		fconn.Close()
+		err = <-replicateErr
+		if err != nil {
+			t.Errorf("%s: Replicate: %v", fixture.file, err)
+		}
+	}
+}
@@ -0,0 +1,404 @@
+//
+// Copyright (c) 2024 Markku Rossi
+//
+// All rights reserved.
+//
+
+package db
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultSegmentSize specifies the default segment size of the
+// segmented devices.
+const DefaultSegmentSize = 1024 * 1024 * 1024
+
+// segmentLockFile names the lock file of the segmented devices.
+const segmentLockFile = "lock"
+
+// segmentHeaderFile names the header file of the segmented devices.
+// The header holds the segment size of the device.
+const segmentHeaderFile = "header"
+
+// SegmentedDevice implements a device that spreads its address space
+// over fixed-size segment files in a directory. The segments are
+// created on demand when they are written and the segments after the
+// end of the device are removed by Truncate. The segments that are
+// not written read as zeros. The read-write devices hold an exclusive
+// advisory lock on the directory, similar to FileDevice.
+type SegmentedDevice struct {
+	m           sync.RWMutex
+	dir         string
+	segmentSize int64
+	readOnly    bool
+	lock        *os.File
+	segments    map[int64]*os.File
+	size        int64
+	dirDirty    atomic.Bool
+}
+
+var _ Device = &SegmentedDevice{}
+
+// OpenSegmentedDevice opens the segmented device in the directory
+// dir. The read-write devices create the directory if it does not
+// exist, and they return ErrLocked if another process holds the
+// device open for writing. The segment size must match the size the
+// device was created with.
+func OpenSegmentedDevice(dir string, segmentSize int64, readOnly bool) (
+	*SegmentedDevice, error) {
+
+	if segmentSize <= 0 {
+		return nil, fmt.Errorf("invalid segment size %v", segmentSize)
+	}
+	dev := &SegmentedDevice{
+		dir:         dir,
+		segmentSize: segmentSize,
+		readOnly:    readOnly,
+		segments:    make(map[int64]*os.File),
+	}
+	if !readOnly {
+		err := os.MkdirAll(dir, 0755)
+		if err != nil {
+			return nil, err
+		}
+		dev.lock, err = os.OpenFile(filepath.Join(dir, segmentLockFile),
+			os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+		err = lockFile(dev.lock)
+		if err != nil {
+			dev.lock.Close()
+			return nil, fmt.Errorf("%s: %w", dir, err)
+		}
+	}
+
+	err := dev.scan()
+	if err == nil {
+		err = dev.checkHeader()
+	}
+	if err != nil {
+		dev.Close()
+		return nil, err
+	}
+	return dev, nil
+}
+
+// scan opens the segment files of the device directory and computes
+// the device size from the segment sizes. The segments that were
+// removed or replaced after the previous scan are closed.
+func (dev *SegmentedDevice) scan() error {
+	flags := os.O_RDWR
+	if dev.readOnly {
+		flags = os.O_RDONLY
+	}
+	entries, err := os.ReadDir(dev.dir)
+	if err != nil {
+		return err
+	}
+	found := make(map[int64]bool)
+	var size int64
+	for _, entry := range entries {
+		var idx int64
+		_, err := fmt.Sscanf(entry.Name(), "%08d.seg", &idx)
+		if err != nil || entry.Name() != dev.segmentName(idx) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		f, ok := dev.segments[idx]
+		if ok {
+			fi, err := f.Stat()
+			if err != nil {
+				return err
+			}
+			if !os.SameFile(fi, info) {
+				f.Close()
+				ok = false
+			}
+		}
+		if !ok {
+			f, err = os.OpenFile(filepath.Join(dev.dir, entry.Name()),
+				flags, 0)
+			if err != nil {
+				delete(dev.segments, idx)
+				return err
+			}
+			dev.segments[idx] = f
+		}
+		fi, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		found[idx] = true
+		size = max(size, idx*dev.segmentSize+fi.Size())
+	}
+	for idx, f := range dev.segments {
+		if !found[idx] {
+			f.Close()
+			delete(dev.segments, idx)
+		}
+	}
+	dev.size = size
+	return nil
+}
+
+// refresh rescans the segments of the read-only device if the range
+// [off, off+n) is not in the device. The writer can extend the device
+// after the read-only device was opened.
+func (dev *SegmentedDevice) refresh(off int64, n int) error {
+	if !dev.readOnly || off+int64(n) <= dev.Size() {
+		return nil
+	}
+	dev.m.Lock()
+	defer dev.m.Unlock()
+	return dev.scan()
+}
+
+// checkHeader verifies that the segment size matches the size in the
+// header file of the device. The read-write devices create the header
+// file for new devices.
+func (dev *SegmentedDevice) checkHeader() error {
+	path := filepath.Join(dev.dir, segmentHeaderFile)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) && !dev.readOnly &&
+		len(dev.segments) == 0 {
+		return dev.writeHeader(path)
+	}
+	if err != nil {
+		return err
+	}
+	if len(data) != 8 {
+		return fmt.Errorf("%s: invalid header", dev.dir)
+	}
+	size := int64(bo.Uint64(data))
+	if size != dev.segmentSize {
+		return fmt.Errorf("%s: segment size mismatch: got %v, expected %v",
+			dev.dir, size, dev.segmentSize)
+	}
+	return nil
+}
+
+func (dev *SegmentedDevice) writeHeader(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(bo.AppendUint64(nil, uint64(dev.segmentSize)))
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	return syncDir(dev.dir)
+}
+
+func (dev *SegmentedDevice) segmentName(idx int64) string {
+	return fmt.Sprintf("%08d.seg", idx)
+}
+
+// segment returns the segment idx. If the segment does not exist, it
+// is created if create is true, and nil is returned otherwise.
+func (dev *SegmentedDevice) segment(idx int64, create bool) (
+	*os.File, error) {
+
+	f, ok := dev.segments[idx]
+	if ok || !create {
+		return f, nil
+	}
+	f, err := os.OpenFile(filepath.Join(dev.dir, dev.segmentName(idx)),
+		os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	dev.segments[idx] = f
+	dev.dirDirty.Store(true)
+	return f, nil
+}
+
+// Close implements Device.Close.
+func (dev *SegmentedDevice) Close() error {
+	dev.m.Lock()
+	defer dev.m.Unlock()
+
+	var errs []error
+	for idx, f := range dev.segments {
+		errs = append(errs, f.Close())
+		delete(dev.segments, idx)
+	}
+	if dev.lock != nil {
+		errs = append(errs, dev.lock.Close())
+		dev.lock = nil
+	}
+	return errors.Join(errs...)
+}
+
+// ReadAt implements Device.ReadAt. The read-only devices rescan the
+// segments for the reads after the end of the device.
+func (dev *SegmentedDevice) ReadAt(b []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %v", off)
+	}
+	err = dev.refresh(off, len(b))
+	if err != nil {
+		return 0, err
+	}
+	dev.m.RLock()
+	defer dev.m.RUnlock()
+	for n < len(b) {
+		pos := off + int64(n)
+		if pos >= dev.size {
+			return n, io.EOF
+		}
+		idx := pos / dev.segmentSize
+		ofs := pos % dev.segmentSize
+		chunk := b[n : n+int(min(int64(len(b)-n), dev.segmentSize-ofs,
+			dev.size-pos))]
+
+		f, _ := dev.segment(idx, false)
+		if f == nil {
+			clear(chunk)
+		} else {
+			m, err := f.ReadAt(chunk, ofs)
+			if err == io.EOF {
+				// Short segment before the end of the device.
+				clear(chunk[m:])
+			} else if err != nil {
+				return n + m, err
+			}
+		}
+		n += len(chunk)
+	}
+	return n, nil
+}
+
+// Sync implements Device.Sync. The directory is synced after the
+// segments if segments were created or removed since the last sync.
+func (dev *SegmentedDevice) Sync() error {
+	dev.m.RLock()
+	defer dev.m.RUnlock()
+
+	for _, f := range dev.segments {
+		err := f.Sync()
+		if err != nil {
+			return err
+		}
+	}
+	return dev.syncDir()
+}
+
+// syncDir syncs the device directory if segments were created or
+// removed since the last sync.
+func (dev *SegmentedDevice) syncDir() error {
+	if !dev.dirDirty.Swap(false) {
+		return nil
+	}
+	err := syncDir(dev.dir)
+	if err != nil {
+		dev.dirDirty.Store(true)
+	}
+	return err
+}
+
+// WriteAt implements Device.WriteAt.
+func (dev *SegmentedDevice) WriteAt(b []byte, off int64) (n int, err error) {
+	dev.m.Lock()
+	defer dev.m.Unlock()
+
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %v", off)
+	}
+	if dev.readOnly {
+		return 0, ErrReadOnly
+	}
+	for n < len(b) {
+		pos := off + int64(n)
+		idx := pos / dev.segmentSize
+		ofs := pos % dev.segmentSize
+		chunk := b[n : n+int(min(int64(len(b)-n), dev.segmentSize-ofs))]
+
+		f, err := dev.segment(idx, true)
+		if err != nil {
+			return n, err
+		}
+		m, err := f.WriteAt(chunk, ofs)
+		n += m
+		dev.size = max(dev.size, off+int64(n))
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// Size returns the size of the device in bytes.
+func (dev *SegmentedDevice) Size() int64 {
+	dev.m.RLock()
+	defer dev.m.RUnlock()
+	return dev.size
+}
+
+// Truncate changes the size of the device. The segments that start
+// at or after the new size are removed and the directory is synced.
+func (dev *SegmentedDevice) Truncate(size int64) error {
+	dev.m.Lock()
+	defer dev.m.Unlock()
+
+	if size < 0 {
+		return fmt.Errorf("negative size %v", size)
+	}
+	if dev.readOnly {
+		return ErrReadOnly
+	}
+	for idx, f := range dev.segments {
+		start := idx * dev.segmentSize
+		if start < size {
+			if start+dev.segmentSize > size {
+				err := f.Truncate(size - start)
+				if err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		err := f.Close()
+		if err != nil {
+			return err
+		}
+		delete(dev.segments, idx)
+		dev.dirDirty.Store(true)
+		err = os.Remove(filepath.Join(dev.dir, dev.segmentName(idx)))
+		if err != nil {
+			return err
+		}
+	}
+	if size > dev.size {
+		// Extend the last segment.
+		idx := (size - 1) / dev.segmentSize
+		f, err := dev.segment(idx, true)
+		if err != nil {
+			return err
+		}
+		err = f.Truncate(size - idx*dev.segmentSize)
+		if err != nil {
+			return err
+		}
+	}
+	dev.size = size
+	return dev.syncDir()
+}
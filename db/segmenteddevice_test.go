@@ -0,0 +1,210 @@
+//
+// Copyright (c) 2024 Markku Rossi
+//
+// All rights reserved.
+//
+
+package db
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func segmentFiles(t *testing.T, dir string) []string {
+	files, err := filepath.Glob(filepath.Join(dir, "*.seg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, file := range files {
+		files[i] = filepath.Base(file)
+	}
+	return files
+}
+
+func TestSegmentedDevice(t *testing.T) {
+	dir := t.TempDir()
+
+	_, err := OpenSegmentedDevice(dir, 1024, true)
+	if err == nil {
+		t.Errorf("read-only open succeeded without header")
+	}
+	dev, err := OpenSegmentedDevice(dir, 1024, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = OpenSegmentedDevice(dir, 1024, false)
+	if fileLocking && !errors.Is(err, ErrLocked) {
+		t.Errorf("second writer: got %v, expected %v", err, ErrLocked)
+	}
+
+	// Write across the segment boundary.
+	data := bytes.Repeat([]byte{0xa5}, 512)
+	_, err = dev.WriteAt(data, 768)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Leave segment 2 as a hole.
+	_, err = dev.WriteAt(data[:100], 3*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files := segmentFiles(t, dir); len(files) != 3 {
+		t.Errorf("segments: %v", files)
+	}
+	if dev.Size() != 3*1024+100 {
+		t.Errorf("size %v, expected %v", dev.Size(), 3*1024+100)
+	}
+
+	buf := make([]byte, 4*1024)
+	n, err := dev.ReadAt(buf, 0)
+	if err != io.EOF || n != 3*1024+100 {
+		t.Fatalf("ReadAt past end: n=%v, err=%v", n, err)
+	}
+	for i, b := range buf[:n] {
+		var expected byte
+		if (i >= 768 && i < 768+512) || i >= 3*1024 {
+			expected = 0xa5
+		}
+		if b != expected {
+			t.Fatalf("buf[%v]=%x, expected %x", i, b, expected)
+		}
+	}
+	err = dev.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The segment size is checked on open.
+	for _, readOnly := range []bool{false, true} {
+		_, err = OpenSegmentedDevice(dir, 2048, readOnly)
+		if err == nil || !strings.Contains(err.Error(),
+			"got 1024, expected 2048") {
+			t.Errorf("segment size mismatch: readOnly=%v: %v", readOnly, err)
+		}
+	}
+
+	reader, err := OpenSegmentedDevice(dir, 1024, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reader.Size() != 3*1024+100 {
+		t.Errorf("reopened size %v", reader.Size())
+	}
+	_, err = reader.WriteAt(data, 0)
+	if !errors.Is(err, ErrReadOnly) {
+		t.Errorf("read-only write: got %v, expected %v", err, ErrReadOnly)
+	}
+	reader.Close()
+
+	dev, err = OpenSegmentedDevice(dir, 1024, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dev.Close()
+	err = dev.Truncate(1024 + 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := segmentFiles(t, dir)
+	if len(files) != 2 || files[1] != "00000001.seg" {
+		t.Errorf("segments after truncate: %v", files)
+	}
+	fi, err := os.Stat(filepath.Join(dir, "00000001.seg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != 10 {
+		t.Errorf("last segment size %v, expected 10", fi.Size())
+	}
+	n, err = dev.ReadAt(buf[:100], 1024)
+	if err != io.EOF || n != 10 {
+		t.Errorf("ReadAt after truncate: n=%v, err=%v", n, err)
+	}
+}
+
+func TestSegmentedDeviceDB(t *testing.T) {
+	dir := t.TempDir()
+
+	params := NewParams()
+	params.PageSize = 1024
+
+	dev, err := OpenSegmentedDevice(dir, 16*1024, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := Create(params, dev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := writeTestPages(t, db, nil, 100, 1)
+	ids = writeTestPages(t, db, ids, 10, 2)
+	err = dev.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files := segmentFiles(t, dir); len(files) < 2 {
+		t.Errorf("segments: %v", files)
+	}
+
+	dev, err = OpenSegmentedDevice(dir, 16*1024, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dev.Close()
+	db, err = Open(params, dev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyTestPages(t, db, ids, 2)
+}
+
+func TestSegmentedDeviceReadOnly(t *testing.T) {
+	dir := t.TempDir()
+
+	params := NewParams()
+	params.PageSize = 1024
+
+	wdev, err := OpenSegmentedDevice(dir, 16*1024, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wdev.Close()
+	writer, err := Create(params, wdev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := writeTestPages(t, writer, nil, 10, 1)
+
+	rdev, err := OpenSegmentedDevice(dir, 16*1024, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rdev.Close()
+	params.ReadOnly = true
+	reader, err := Open(params, rdev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyTestPages(t, reader, ids, 1)
+
+	// The writer extends the device with new segments.
+	segments := len(segmentFiles(t, dir))
+	ids = writeTestPages(t, writer, ids, 50, 2)
+	if len(segmentFiles(t, dir)) <= segments {
+		t.Fatalf("writer did not create segments")
+	}
+	changed, err := reader.Refresh()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changed {
+		t.Errorf("Refresh did not change generation")
+	}
+	verifyTestPages(t, reader, ids, 2)
+}
@@ -0,0 +1,153 @@
+//
+// Copyright (c) 2024 Markku Rossi
+//
+// All rights reserved.
+//
+
+package db
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// CommitEvent describes a committed read-write transaction.
+type CommitEvent struct {
+	Generation uint64
+	Timestamp  time.Time
+	Pages      []LogicalID
+}
+
+// CommitHook is called before a read-write transaction commits. The
+// hook can extend the commit by modifying pages in the transaction
+// or veto the commit by returning an error, in which case the
+// transaction is aborted and the error is returned from Commit.
+type CommitHook func(tr *BaseTransaction) error
+
+// AddCommitHook adds a hook that is called for each read-write
+// transaction commit. The hooks can be added while transactions are
+// running, and they apply to the transactions that commit after the
+// hook is added.
+func (db *DB) AddCommitHook(hook CommitHook) {
+	db.m.Lock()
+	db.hooks = append(db.hooks, hook)
+	db.m.Unlock()
+}
+
+// Subscription delivers commit events to the subscriber. The events
+// are queued for the subscriber so a slow reader does not block
+// commits.
+type Subscription struct {
+	// C receives the commit events in the commit order.
+	C <-chan CommitEvent
+
+	db     *DB
+	c      chan CommitEvent
+	done   chan struct{}
+	m      sync.Mutex
+	cond   *sync.Cond
+	queue  []CommitEvent
+	closed bool
+}
+
+// Subscribe creates a subscription for the commit events of all
+// successful read-write transactions.
+func (db *DB) Subscribe() *Subscription {
+	sub := &Subscription{
+		db:   db,
+		c:    make(chan CommitEvent),
+		done: make(chan struct{}),
+	}
+	sub.C = sub.c
+	sub.cond = sync.NewCond(&sub.m)
+
+	db.subscribersM.Lock()
+	db.subscribers = append(db.subscribers, sub)
+	db.subscribersM.Unlock()
+
+	go sub.deliver()
+
+	return sub
+}
+
+// Close closes the subscription. The pending events are discarded
+// and the channel C is closed.
+func (sub *Subscription) Close() {
+	db := sub.db
+	db.subscribersM.Lock()
+	for i, s := range db.subscribers {
+		if s == sub {
+			db.subscribers = append(db.subscribers[:i],
+				db.subscribers[i+1:]...)
+			break
+		}
+	}
+	db.subscribersM.Unlock()
+
+	sub.m.Lock()
+	if !sub.closed {
+		sub.closed = true
+		close(sub.done)
+		sub.cond.Broadcast()
+	}
+	sub.m.Unlock()
+}
+
+func (sub *Subscription) post(event CommitEvent) {
+	sub.m.Lock()
+	sub.queue = append(sub.queue, event)
+	sub.cond.Signal()
+	sub.m.Unlock()
+}
+
+func (sub *Subscription) deliver() {
+	defer close(sub.c)
+	for {
+		sub.m.Lock()
+		for len(sub.queue) == 0 && !sub.closed {
+			sub.cond.Wait()
+		}
+		if sub.closed {
+			sub.m.Unlock()
+			return
+		}
+		event := sub.queue[0]
+		sub.queue = sub.queue[1:]
+		sub.m.Unlock()
+
+		select {
+		case sub.c <- event:
+		case <-sub.done:
+			return
+		}
+	}
+}
+
+// notify queues the commit event of the read-write transaction for
+// all subscribers. The function must be called with db.m held right
+// after the commit so that root1 holds the committed root pointer and
+// the events are queued in the commit order. The subscriptions
+// deliver the queued events after db.m is released.
+func (db *DB) notify(tr *BaseTransaction) {
+	db.subscribersM.Lock()
+	defer db.subscribersM.Unlock()
+
+	if len(db.subscribers) == 0 {
+		return
+	}
+	root := db.pt.root1
+	event := CommitEvent{
+		Generation: root.Generation,
+		Timestamp:  time.Unix(0, int64(root.Timestamp)),
+	}
+	for id := range tr.written {
+		event.Pages = append(event.Pages, id)
+	}
+	sort.Slice(event.Pages, func(i, j int) bool {
+		return event.Pages[i] < event.Pages[j]
+	})
+	for _, sub := range db.subscribers {
+		sub.post(event)
+	}
+}
@@ -0,0 +1,170 @@
+//
+// Copyright (c) 2024 Markku Rossi
+//
+// All rights reserved.
+//
+
+package db
+
+import (
+	"errors"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestSubscribe(t *testing.T) {
+	params := NewParams()
+	params.PageSize = 1024
+
+	db, err := Create(params, NewMemDevice(1024*1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub := db.Subscribe()
+
+	ids := writeTestPages(t, db, nil, 3, 1)
+	event := <-sub.C
+	if event.Generation != db.pt.committed().Generation {
+		t.Errorf("event generation %v, expected %v",
+			event.Generation, db.pt.committed().Generation)
+	}
+	if !slices.Equal(event.Pages, ids) {
+		t.Errorf("event pages %v, expected %v", event.Pages, ids)
+	}
+
+	// Veto commits modifying the first page.
+	errVeto := errors.New("veto")
+	var extra LogicalID
+	db.AddCommitHook(func(tr *BaseTransaction) error {
+		if _, ok := tr.written[ids[0]]; ok {
+			return errVeto
+		}
+		ref, id, err := tr.NewPage()
+		if err != nil {
+			return err
+		}
+		ref.Release()
+		extra = id
+		return nil
+	})
+
+	tr, err := db.NewTransaction(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := tr.WritablePage(ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref.Release()
+	err = tr.Commit()
+	if err != errVeto {
+		t.Errorf("vetoed commit returned %v", err)
+	}
+
+	writeTestPages(t, db, ids[1:2], 0, 2)
+	event = <-sub.C
+	expected := []LogicalID{ids[1], extra}
+	if !slices.Equal(event.Pages, expected) {
+		t.Errorf("event pages %v, expected %v", event.Pages, expected)
+	}
+
+	sub.Close()
+	_, ok := <-sub.C
+	if ok {
+		t.Errorf("channel not closed")
+	}
+}
+
+func TestAddCommitHookConcurrent(t *testing.T) {
+	params := NewParams()
+	params.PageSize = 1024
+
+	db, err := Create(params, NewMemDevice(1024*1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var calls atomic.Int32
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 10; i++ {
+			db.AddCommitHook(func(tr *BaseTransaction) error {
+				calls.Add(1)
+				return nil
+			})
+		}
+	}()
+	var ids []LogicalID
+	for i := 0; i < 10; i++ {
+		ids = writeTestPages(t, db, ids, 1, byte(i))
+	}
+	<-done
+
+	calls.Store(0)
+	writeTestPages(t, db, ids, 0, 10)
+	if calls.Load() != 10 {
+		t.Errorf("hooks called %v times, expected 10", calls.Load())
+	}
+}
+
+func TestSubscribeOrder(t *testing.T) {
+	params := NewParams()
+	params.PageSize = 1024
+
+	db, err := Create(params, NewMemDevice(16*1024*1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	const workers = 8
+	const commits = 100
+
+	ids := writeTestPages(t, db, nil, workers, 1)
+	start := db.Root().Generation
+	sub := db.Subscribe()
+	defer sub.Close()
+
+	var wg sync.WaitGroup
+	errs := make([]error, workers)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < commits; i++ {
+				err := writeConcurrent(db, ids[w])
+				if errors.Is(err, ErrConflict) {
+					continue
+				}
+				if err != nil {
+					errs[w] = err
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var last CommitEvent
+	for gen := start + 1; gen <= db.Root().Generation; gen++ {
+		event := <-sub.C
+		if event.Generation != gen {
+			t.Fatalf("event generation %v, expected %v",
+				event.Generation, gen)
+		}
+		if event.Timestamp.Before(last.Timestamp) {
+			t.Errorf("event %v timestamp %v before %v", gen,
+				event.Timestamp, last.Timestamp)
+		}
+		if len(event.Pages) != 1 {
+			t.Errorf("event %v pages %v", gen, event.Pages)
+		}
+		last = event
+	}
+}
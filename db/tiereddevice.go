@@ -0,0 +1,393 @@
+//
+// Copyright (c) 2024 Markku Rossi
+//
+// All rights reserved.
+//
+
+package db
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/markkurossi/shades/crypto"
+)
+
+// TieredSlotMagic defines the magic number of the hot slot trailers.
+const TieredSlotMagic = uint32(0x53685473)
+
+// Tiered slot trailer offsets. The trailer is stored after the page
+// data of each hot device slot.
+const (
+	TieredSlotOfsMagic    = 0
+	TieredSlotOfsPagenum  = 8
+	TieredSlotOfsSeq      = 16
+	TieredSlotOfsChecksum = 24
+	TieredSlotTrailerSize = 40
+)
+
+// tieredSlot describes a hot device slot.
+type tieredSlot struct {
+	used    bool
+	pagenum int64
+	seq     uint64
+	lastUse uint64
+}
+
+// TieredDevice implements a device that keeps the recently written
+// and read pages on a small and fast hot device, and the other pages
+// on a large and slow cold device. The hot device is divided into
+// page slots which end with a trailer naming the page of the slot, so
+// the hot pages are found by scanning the hot device when the device
+// is opened.
+//
+// When the hot device fills, the least recently used hot pages are
+// migrated to the cold device. Migrate moves the pages explicitly and
+// it can be called from a background goroutine to keep free slots
+// available. The migrated pages are synced to the cold device before
+// their hot slots are cleared so the device always holds the latest
+// synced version of each page.
+type TieredDevice struct {
+	m        sync.Mutex
+	hot      Device
+	cold     Device
+	pageSize int
+	hash     *crypto.PRF
+	slots    []tieredSlot
+	pages    map[int64]int
+	free     []int
+	seq      uint64
+	clock    uint64
+	end      int64
+	buf      []byte
+}
+
+var _ Device = &TieredDevice{}
+
+// OpenTieredDevice opens a tiered device over the hot and cold
+// devices. The hot device holds numSlots slots of pageSize pages and
+// their trailers. A zeroed hot device holds no pages so a new tiered
+// device is created over an empty hot device.
+func OpenTieredDevice(hot, cold Device, pageSize, numSlots int) (
+	*TieredDevice, error) {
+
+	if pageSize <= 0 {
+		return nil, fmt.Errorf("invalid page size %v", pageSize)
+	}
+	if numSlots <= 0 {
+		return nil, fmt.Errorf("invalid number of slots %v", numSlots)
+	}
+	var key [16]byte
+	hash, err := crypto.NewPRF(key[:])
+	if err != nil {
+		return nil, err
+	}
+	dev := &TieredDevice{
+		hot:      hot,
+		cold:     cold,
+		pageSize: pageSize,
+		hash:     hash,
+		slots:    make([]tieredSlot, numSlots),
+		pages:    make(map[int64]int),
+		buf:      make([]byte, pageSize+TieredSlotTrailerSize),
+	}
+	err = dev.scan()
+	if err != nil {
+		return nil, err
+	}
+	return dev, nil
+}
+
+// scan reads the slot trailers of the hot device. If a page is found
+// from many slots, the slot with the highest sequence number holds
+// its latest version.
+func (dev *TieredDevice) scan() error {
+	for i := range dev.slots {
+		_, err := dev.hot.ReadAt(dev.buf, dev.slotOffset(i))
+		if err != nil {
+			return fmt.Errorf("hot slot %v: %w", i, err)
+		}
+		pagenum, seq, ok := dev.parseTrailer(dev.buf)
+		if !ok {
+			continue
+		}
+		old, ok := dev.pages[pagenum]
+		if ok {
+			if dev.slots[old].seq > seq {
+				continue
+			}
+			dev.slots[old] = tieredSlot{}
+		}
+		dev.slots[i] = tieredSlot{
+			used:    true,
+			pagenum: pagenum,
+			seq:     seq,
+		}
+		dev.pages[pagenum] = i
+		dev.seq = max(dev.seq, seq)
+		dev.end = max(dev.end, (pagenum+1)*int64(dev.pageSize))
+	}
+	for i := len(dev.slots) - 1; i >= 0; i-- {
+		if !dev.slots[i].used {
+			dev.free = append(dev.free, i)
+		}
+	}
+	return nil
+}
+
+// slotOffset returns the offset of the slot in the hot device.
+func (dev *TieredDevice) slotOffset(slot int) int64 {
+	return int64(slot) * int64(dev.pageSize+TieredSlotTrailerSize)
+}
+
+// formatTrailer formats the slot trailer after the page data of buf.
+func (dev *TieredDevice) formatTrailer(buf []byte, pagenum int64,
+	seq uint64) {
+
+	trailer := buf[dev.pageSize:]
+	clear(trailer)
+	bo.PutUint32(trailer[TieredSlotOfsMagic:], TieredSlotMagic)
+	bo.PutUint64(trailer[TieredSlotOfsPagenum:], uint64(pagenum))
+	bo.PutUint64(trailer[TieredSlotOfsSeq:], seq)
+
+	dev.hash.Data(buf[:dev.pageSize+TieredSlotOfsChecksum],
+		trailer[:TieredSlotOfsChecksum])
+}
+
+// parseTrailer parses and verifies the slot trailer of buf.
+func (dev *TieredDevice) parseTrailer(buf []byte) (int64, uint64, bool) {
+	trailer := buf[dev.pageSize:]
+	if bo.Uint32(trailer[TieredSlotOfsMagic:]) != TieredSlotMagic {
+		return 0, 0, false
+	}
+	var checksum [16]byte
+	dev.hash.Data(buf[:dev.pageSize+TieredSlotOfsChecksum], checksum[:0])
+	if !bytes.Equal(checksum[:], trailer[TieredSlotOfsChecksum:]) {
+		return 0, 0, false
+	}
+	pagenum := bo.Uint64(trailer[TieredSlotOfsPagenum:])
+	if pagenum > PIDPagenumMask {
+		return 0, 0, false
+	}
+	return int64(pagenum), bo.Uint64(trailer[TieredSlotOfsSeq:]), true
+}
+
+// Close implements Device.Close.
+func (dev *TieredDevice) Close() error {
+	hotErr := dev.hot.Close()
+	coldErr := dev.cold.Close()
+	if hotErr != nil {
+		return hotErr
+	}
+	return coldErr
+}
+
+// Sync implements Device.Sync.
+func (dev *TieredDevice) Sync() error {
+	dev.m.Lock()
+	defer dev.m.Unlock()
+
+	err := dev.hot.Sync()
+	if err != nil {
+		return err
+	}
+	return dev.cold.Sync()
+}
+
+// ReadAt implements Device.ReadAt. The pages read from the cold
+// device are promoted to the hot device.
+func (dev *TieredDevice) ReadAt(b []byte, off int64) (n int, err error) {
+	return dev.rw(b, off, false)
+}
+
+// WriteAt implements Device.WriteAt. The pages are written to the hot
+// device.
+func (dev *TieredDevice) WriteAt(b []byte, off int64) (n int, err error) {
+	return dev.rw(b, off, true)
+}
+
+func (dev *TieredDevice) rw(b []byte, off int64, write bool) (int, error) {
+	dev.m.Lock()
+	defer dev.m.Unlock()
+
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %v", off)
+	}
+	var n int
+	for n < len(b) {
+		pagenum := off / int64(dev.pageSize)
+		ofs := int(off % int64(dev.pageSize))
+		l := min(len(b)-n, dev.pageSize-ofs)
+
+		slot, err := dev.page(pagenum, write, write && l == dev.pageSize)
+		if err != nil {
+			return n, err
+		}
+		data := dev.buf[:dev.pageSize]
+		if write {
+			copy(data[ofs:], b[n:n+l])
+			err = dev.writeSlot(slot, pagenum)
+			if err != nil {
+				if !dev.slots[slot].used {
+					dev.free = append(dev.free, slot)
+				}
+				return n, err
+			}
+			dev.end = max(dev.end, (pagenum+1)*int64(dev.pageSize))
+		} else {
+			copy(b[n:n+l], data[ofs:])
+		}
+		n += l
+		off += int64(l)
+	}
+	return n, nil
+}
+
+// page reads the page into the device buffer and returns its hot
+// slot. The page is promoted to the hot device if it is read from the
+// cold device. The function returns io.EOF if the page is after the
+// end of the device and it is not created. The created pages are
+// written by the caller and the pages which are overwritten are not
+// read.
+func (dev *TieredDevice) page(pagenum int64, create, overwrite bool) (
+	int, error) {
+
+	data := dev.buf[:dev.pageSize]
+	slot, ok := dev.pages[pagenum]
+	if ok {
+		if !overwrite {
+			_, err := dev.hot.ReadAt(data, dev.slotOffset(slot))
+			if err != nil {
+				return 0, err
+			}
+		}
+		dev.clock++
+		dev.slots[slot].lastUse = dev.clock
+		return slot, nil
+	}
+	off := pagenum * int64(dev.pageSize)
+	var n int
+	var err error
+	if overwrite {
+		err = io.EOF
+	} else {
+		n, err = dev.cold.ReadAt(data, off)
+	}
+	if errors.Is(err, io.EOF) {
+		// The pages after the end of the cold device read as zeros
+		// if the device extends past them.
+		if !create && off+int64(n) >= dev.end {
+			return 0, io.EOF
+		}
+		clear(data[n:])
+	} else if err != nil {
+		return 0, err
+	}
+	slot, err = dev.alloc()
+	if err != nil {
+		return 0, err
+	}
+	if !create {
+		err = dev.writeSlot(slot, pagenum)
+		if err != nil {
+			dev.free = append(dev.free, slot)
+			return 0, err
+		}
+	}
+	return slot, nil
+}
+
+// writeSlot writes the page data of the device buffer into the slot.
+func (dev *TieredDevice) writeSlot(slot int, pagenum int64) error {
+	dev.seq++
+	dev.formatTrailer(dev.buf, pagenum, dev.seq)
+	_, err := dev.hot.WriteAt(dev.buf, dev.slotOffset(slot))
+	if err != nil {
+		return err
+	}
+	dev.clock++
+	dev.slots[slot] = tieredSlot{
+		used:    true,
+		pagenum: pagenum,
+		seq:     dev.seq,
+		lastUse: dev.clock,
+	}
+	dev.pages[pagenum] = slot
+	return nil
+}
+
+// alloc allocates a free hot slot. If the hot device is full, the
+// least recently used pages are migrated to the cold device. The
+// migration does not use the device buffer.
+func (dev *TieredDevice) alloc() (int, error) {
+	if len(dev.free) == 0 {
+		err := dev.migrate(len(dev.slots) - max(len(dev.slots)/8, 1))
+		if err != nil {
+			return 0, err
+		}
+	}
+	slot := dev.free[len(dev.free)-1]
+	dev.free = dev.free[:len(dev.free)-1]
+	return slot, nil
+}
+
+// Migrate moves the hot pages to the cold device, except the keep
+// most recently used pages.
+func (dev *TieredDevice) Migrate(keep int) error {
+	dev.m.Lock()
+	defer dev.m.Unlock()
+
+	return dev.migrate(keep)
+}
+
+func (dev *TieredDevice) migrate(keep int) error {
+	var slots []int
+	for i, slot := range dev.slots {
+		if slot.used {
+			slots = append(slots, i)
+		}
+	}
+	if len(slots) <= keep {
+		return nil
+	}
+	sort.Slice(slots, func(i, j int) bool {
+		return dev.slots[slots[i]].lastUse < dev.slots[slots[j]].lastUse
+	})
+	slots = slots[:len(slots)-max(keep, 0)]
+
+	buf := make([]byte, len(dev.buf))
+	for _, slot := range slots {
+		_, err := dev.hot.ReadAt(buf, dev.slotOffset(slot))
+		if err != nil {
+			return err
+		}
+		off := dev.slots[slot].pagenum * int64(dev.pageSize)
+		_, err = dev.cold.WriteAt(buf[:dev.pageSize], off)
+		if err != nil {
+			return err
+		}
+	}
+	err := dev.cold.Sync()
+	if err != nil {
+		return err
+	}
+
+	// Clear the trailers so that the older versions of the pages are
+	// not found from the hot device when it is scanned.
+	clear(buf[dev.pageSize:])
+	for _, slot := range slots {
+		_, err = dev.hot.WriteAt(buf[dev.pageSize:],
+			dev.slotOffset(slot)+int64(dev.pageSize))
+		if err != nil {
+			return err
+		}
+		delete(dev.pages, dev.slots[slot].pagenum)
+		dev.slots[slot] = tieredSlot{}
+		dev.free = append(dev.free, slot)
+	}
+	return dev.hot.Sync()
+}
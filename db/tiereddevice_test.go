@@ -0,0 +1,131 @@
+//
+// Copyright (c) 2024 Markku Rossi
+//
+// All rights reserved.
+//
+
+package db
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestTieredDevice(t *testing.T) {
+	const pageSize = 1024
+	const numSlots = 32
+
+	hot := NewMemDevice(numSlots * (pageSize + TieredSlotTrailerSize))
+	cold := NewMemDevice(1024 * 1024)
+	dev, err := OpenTieredDevice(hot, cold, pageSize, numSlots)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	params := NewParams()
+	params.PageSize = pageSize
+	db, err := Create(params, dev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := writeTestPages(t, db, nil, 100, 1)
+	updated := writeTestPages(t, db, ids[:10:10], 0, 2)
+	if len(dev.pages) > numSlots {
+		t.Errorf("%v hot pages, expected at most %v", len(dev.pages), numSlots)
+	}
+	if bytes.Count(cold.buf, []byte{1}) == 0 {
+		t.Errorf("no pages migrated to the cold device")
+	}
+
+	// Reopen the device from the hot slots.
+	dev, err = OpenTieredDevice(hot, cold, pageSize, numSlots)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(params, dev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyTestPages(t, db, updated, 2)
+	verifyTestPages(t, db, ids[10:], 1)
+
+	// Migrate all pages and open the cold device directly.
+	err = dev.Migrate(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dev.pages) != 0 {
+		t.Errorf("%v hot pages after migration", len(dev.pages))
+	}
+	db, err = Open(params, cold)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyTestPages(t, db, updated, 2)
+	verifyTestPages(t, db, ids[10:], 1)
+}
+
+func TestTieredDeviceMigrated(t *testing.T) {
+	const pageSize = 1024
+	const numSlots = 4
+
+	hot := NewMemDevice(numSlots * (pageSize + TieredSlotTrailerSize))
+	cold := NewMemDevice(64 * pageSize)
+	dev, err := OpenTieredDevice(hot, cold, pageSize, numSlots)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write := func(pagenum int64, value byte) {
+		page := make([]byte, pageSize)
+		page[0] = value
+		_, err := dev.WriteAt(page, pagenum*pageSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	migrate := func() {
+		err := dev.Migrate(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Write the versions of the page 5 into different slots and reuse
+	// the slot of its latest version.
+	write(5, 1)
+	write(6, 1)
+	migrate()
+	write(5, 2)
+	migrate()
+	write(6, 2)
+
+	// The older versions of the migrated page are not found from the
+	// hot slots.
+	dev, err = OpenTieredDevice(hot, cold, pageSize, numSlots)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page := make([]byte, pageSize)
+	_, err = dev.ReadAt(page, 5*pageSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page[0] != 2 {
+		t.Errorf("read version %v, expected 2", page[0])
+	}
+
+	// Unaligned access.
+	data := []byte("unaligned data crossing page boundary")
+	_, err = dev.WriteAt(data, 2*pageSize-10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(data))
+	_, err = dev.ReadAt(got, 2*pageSize-10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("ReadAt: got %q, expected %q", got, data)
+	}
+}
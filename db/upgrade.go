@@ -0,0 +1,90 @@
+//
+// Copyright (c) 2024 Markku Rossi
+//
+// All rights reserved.
+//
+
+package db
+
+// Upgrade converts the database into the current format version. The
+// conversion is committed as a new generation, which writes the root
+// pointer and the newest root history page in the current layout and
+// records the required features of the database in the root pointer
+// flags. The older history pages keep their layout. The
+// write-ahead log is checkpointed so that the new format is stored in
+// the root block. The function returns false if the database already
+// uses the current format version.
+func (db *DB) Upgrade() (bool, error) {
+	if db.params.ReadOnly {
+		return false, ErrReadOnly
+	}
+	// The page tables are scanned from the device.
+	err := db.Checkpoint()
+	if err != nil {
+		return false, err
+	}
+	if db.pt.committed().Version >= FormatVersion {
+		return false, nil
+	}
+
+	// The base transaction keeps the other read-write transactions
+	// from committing while the page tables are scanned.
+	tr, err := db.NewTransaction(true)
+	if err != nil {
+		return false, err
+	}
+	root := db.pt.committed()
+	if root.Version >= FormatVersion {
+		return false, tr.Abort()
+	}
+	compressed, err := mapsCompressed(db.device, root)
+	if err != nil {
+		tr.Abort()
+		return false, err
+	}
+	db.m.Lock()
+	db.pt.root1.Version = FormatVersion
+	if compressed {
+		db.pt.root1.Flags |= RootFlagCompressed
+	}
+	db.m.Unlock()
+
+	err = tr.Commit()
+	if err != nil {
+		return false, err
+	}
+	err = db.Checkpoint()
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// mapsCompressed tests if the page tables of the root pointer map any
+// compressed pages.
+func mapsCompressed(device Device, root RootPointer) (bool, error) {
+	var found bool
+
+	table := func(pid PhysicalID, data []byte) error {
+		return nil
+	}
+	data := func(pid, base PhysicalID) error {
+		if pid.Compressed() {
+			found = true
+		}
+		return nil
+	}
+	err := walkPageTable(device, root, root.PageTable, int(root.Depth), 0, 0,
+		table, data)
+	if err != nil || root.Objects == 0 {
+		return found, err
+	}
+	dir, depth := root.Objects.treeRoot()
+	err = walkPageTable(device, root, dir, depth, 0, 0, table,
+		func(pid, base PhysicalID) error {
+			objects, depth := pid.treeRoot()
+			return walkPageTable(device, root, objects, depth, 0, 0,
+				table, data)
+		})
+	return found, err
+}
@@ -0,0 +1,199 @@
+//
+// Copyright (c) 2024 Markku Rossi
+//
+// All rights reserved.
+//
+
+package db
+
+import (
+	"errors"
+	"testing"
+)
+
+// rewriteRoot rewrites the committed root pointer of the database.
+func rewriteRoot(t *testing.T, db *DB, fn func(root *RootPointer)) {
+	fn(&db.pt.root0)
+	db.pt.root1 = db.pt.root0
+	db.pt.formatRootBlock(&db.pt.root0, db.pt.rootBlock.Data())
+	err := db.pt.sync(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	for _, fixture := range formatFixtures {
+		_, device := openFixture(t, fixture)
+
+		// Chain the history pages of the fixture format.
+		params := fixtureParams(fixture)
+		params.RetainGenerations = 20
+		db, err := Open(params, device)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for round := 4; round <= 13; round++ {
+			updateFixture(t, db, fixture, round)
+		}
+		upgraded, err := db.Upgrade()
+		if err != nil {
+			t.Fatalf("%s: %v", fixture.file, err)
+		}
+		if !upgraded {
+			t.Fatalf("%s: database not upgraded", fixture.file)
+		}
+		updateFixture(t, db, fixture, 14)
+
+		db, err = Open(params, device)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if db.Root().Version != FormatVersion {
+			t.Fatalf("%s: upgraded database version %v, expected %v",
+				fixture.file, db.Root().Version, FormatVersion)
+		}
+		err = db.View(func(tr *BaseTransaction) error {
+			verifyFixture(t, tr, fixture, 14)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The retained generations survive the upgrade. The round r
+		// is the generation r+1 and the upgrade is the generation 15.
+		for round := 3; round <= 14; round++ {
+			gen := uint64(round + 1)
+			if round == 14 {
+				gen++
+			}
+			tr, err := db.NewTransactionAt(gen)
+			if err != nil {
+				t.Fatalf("%s: generation %v: %v", fixture.file, gen, err)
+			}
+			verifyFixture(t, tr, fixture, round)
+			tr.Commit()
+		}
+
+		upgraded, err = db.Upgrade()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if upgraded {
+			t.Errorf("%s: current database upgraded", fixture.file)
+		}
+	}
+}
+
+func TestUpgradeCompressed(t *testing.T) {
+	fixture := formatFixtures[0]
+	fixture.params = func(params *Params) {
+		params.Compression = true
+	}
+	db, _ := openFixture(t, fixture)
+	updateFixture(t, db, fixture, 4)
+	if db.Root().Flags&RootFlagCompressed != 0 {
+		t.Fatalf("version 0 database has compressed flag")
+	}
+	compressed, err := mapsCompressed(db.device, db.Root())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !compressed {
+		t.Fatalf("fixture has no compressed pages")
+	}
+	_, err = db.Upgrade()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.Root().Flags&RootFlagCompressed == 0 {
+		t.Errorf("compressed pages not detected")
+	}
+	err = db.View(func(tr *BaseTransaction) error {
+		verifyFixture(t, tr, fixture, 4)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUpgradeConcurrent(t *testing.T) {
+	db, _ := openFixture(t, formatFixtures[0])
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			db.Refresh()
+			tr, err := db.NewConcurrentTransaction()
+			if err == nil {
+				tr.Commit()
+			}
+		}
+	}()
+	_, err := db.Upgrade()
+	close(done)
+	<-stopped
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.Root().Version != FormatVersion {
+		t.Errorf("version %v, expected %v", db.Root().Version, FormatVersion)
+	}
+}
+
+func TestUnsupportedFormat(t *testing.T) {
+	for _, fn := range []func(root *RootPointer){
+		func(root *RootPointer) {
+			root.Version = FormatVersion + 1
+		},
+		func(root *RootPointer) {
+			root.Flags |= 0x8000
+		},
+	} {
+		params := NewParams()
+		params.PageSize = 1024
+
+		device := NewMemDevice(1024 * 1024)
+		db, err := Create(params, device)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rewriteRoot(t, db, fn)
+
+		_, err = Open(params, device)
+		if !errors.Is(err, ErrUnsupportedFormat) {
+			t.Errorf("Open: got %v, expected %v", err, ErrUnsupportedFormat)
+		}
+	}
+
+	// The unknown compatible flags are preserved.
+	params := NewParams()
+	params.PageSize = 1024
+
+	device := NewMemDevice(1024 * 1024)
+	db, err := Create(params, device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rewriteRoot(t, db, func(root *RootPointer) {
+		root.CompatFlags = 0x8000
+	})
+	db, err = Open(params, device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestPages(t, db, nil, 1, 0)
+	if db.Root().CompatFlags != 0x8000 {
+		t.Errorf("compatible flags %04x, expected %04x",
+			db.Root().CompatFlags, 0x8000)
+	}
+}
@@ -0,0 +1,406 @@
+//
+// Copyright (c) 2024 Markku Rossi
+//
+// All rights reserved.
+//
+
+package db
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// Log record offsets. Each log record holds the changes of one
+// committed transaction. The record header is followed by the log
+// entries and the record checksum.
+const (
+	LogRecOfsMagic       = 0
+	LogRecOfsCount       = 4
+	LogRecOfsGeneration  = 8
+	LogRecOfsNextLogical = 16
+	LogRecOfsLength      = 24
+	LogRecHeaderSize     = 32
+	LogRecChecksumSize   = 16
+)
+
+// LogRecMagic defines the log record magic number.
+const LogRecMagic = uint32(0x57414c31)
+
+// Log entry types. The entries start with the entry type and the
+// logical ID. The page entries continue with the number of delta runs
+// followed by the runs. Each run holds its offset, length, and data.
+const (
+	LogEntryNew    byte = 1
+	LogEntryUpdate byte = 2
+	LogEntryDrop   byte = 3
+)
+
+// logRunGap specifies the maximum number of unchanged bytes between
+// two delta runs that are merged into one run. It equals the run
+// header size.
+const logRunGap = 8
+
+// Checkpoint writes the pages of the transactions committed into the
+// write-ahead log to the device and advances the root pointer of the
+// device to the latest committed generation. The log is emptied after
+// the checkpoint.
+func (db *DB) Checkpoint() error {
+	if db.params.ReadOnly {
+		return ErrReadOnly
+	}
+	db.m.Lock()
+	defer db.m.Unlock()
+
+	return db.pt.checkpoint()
+}
+
+func (pt *PageTable) checkpoint() error {
+	if pt.root0.Log == 0 {
+		return nil
+	}
+	pt.formatRootBlock(&pt.root0, pt.rootBlock.Data())
+	err := pt.sync(nil)
+	if err != nil {
+		return err
+	}
+	pt.logOffset = 0
+	return nil
+}
+
+// flushPending writes the pages of the transactions committed into
+// the write-ahead log to the device.
+func (db *DB) flushPending() error {
+	db.m.Lock()
+	defer db.m.Unlock()
+
+	return db.pt.flushPending()
+}
+
+// flushPending writes the pages of the transactions committed into
+// the write-ahead log to the device without syncing it so that the
+// committed pages can be read directly from the device. The read-only
+// databases can't write the pages they replayed from the log.
+func (pt *PageTable) flushPending() error {
+	if pt.root0.Log == 0 {
+		return nil
+	}
+	if pt.db.params.ReadOnly {
+		if pt.logOffset > 0 {
+			return ErrReadOnly
+		}
+		return nil
+	}
+	return pt.db.cache.flush(pt.flushable(nil))
+}
+
+// initLog allocates the write-ahead log region for a new database
+// and clears its first record.
+func (pt *PageTable) initLog() error {
+	pageSize := pt.db.params.PageSize
+	pages := uint64(max(pt.db.params.WALSize/pageSize, 1))
+
+	pt.root0.Log = NewPhysicalID(0, pt.root0.NextPhysical)
+	pt.root0.LogPages = pages
+	pt.root0.NextPhysical += pages
+
+	_, err := pt.db.device.WriteAt(make([]byte, pageSize), pt.logStart())
+	return err
+}
+
+// logStart returns the device offset of the write-ahead log.
+func (pt *PageTable) logStart() int64 {
+	return int64(pt.root0.Log.Pagenum() * uint64(pt.db.params.PageSize))
+}
+
+// logSize returns the size of the write-ahead log in bytes.
+func (pt *PageTable) logSize() int64 {
+	return int64(pt.root0.LogPages * uint64(pt.db.params.PageSize))
+}
+
+// commitLog commits the transaction tr by appending its changes into
+// the write-ahead log. The pages of the transaction are kept in the
+// cache until the next checkpoint. If the log can't hold the changes,
+// the transaction is committed as a checkpoint.
+func (pt *PageTable) commitLog(tr *BaseTransaction) error {
+	if pt.replaying {
+		pt.publish()
+		return nil
+	}
+	record, err := pt.logRecord(tr)
+	if err != nil {
+		return err
+	}
+	if pt.logOffset+int64(len(record)) > pt.logSize() {
+		err = pt.commitRoot(tr)
+		if err != nil {
+			return err
+		}
+		pt.logOffset = 0
+		return nil
+	}
+	_, err = pt.db.device.WriteAt(record, pt.logStart()+pt.logOffset)
+	if err != nil {
+		return err
+	}
+	err = pt.db.device.Sync()
+	if err != nil {
+		return err
+	}
+	pt.logOffset += int64(len(record))
+	pt.publish()
+
+	return nil
+}
+
+// logRecord creates the log record of the transaction tr.
+func (pt *PageTable) logRecord(tr *BaseTransaction) ([]byte, error) {
+	record := make([]byte, LogRecHeaderSize)
+	bo.PutUint32(record[LogRecOfsMagic:], LogRecMagic)
+	bo.PutUint64(record[LogRecOfsGeneration:], pt.root1.Generation)
+	bo.PutUint64(record[LogRecOfsNextLogical:], pt.root1.NextLogical)
+
+	var count int
+	for _, objectID := range tr.dropped {
+		record = append(record, LogEntryDrop)
+		record = bo.AppendUint64(record,
+			uint64(NewLogicalID(0, objectID, 0)))
+		count++
+	}
+
+	var ids []LogicalID
+	for id := range tr.written {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+	for _, id := range ids {
+		pid := tr.written[id]
+		ref, err := pt.db.cache.Get(pid)
+		if err != nil {
+			return nil, err
+		}
+		var old []byte
+		var oldRef *PageRef
+		entryType := LogEntryNew
+
+		oldPid := tr.writable[pid]
+		if oldPid != 0 {
+			entryType = LogEntryUpdate
+			oldRef, err = pt.db.cache.Get(oldPid)
+			if err != nil {
+				ref.release()
+				return nil, err
+			}
+			old = oldRef.Read()
+		}
+		record = append(record, entryType)
+		record = bo.AppendUint64(record, uint64(id))
+		record = appendDelta(record, old, ref.Read())
+		count++
+
+		if oldRef != nil {
+			oldRef.release()
+		}
+		ref.release()
+	}
+	bo.PutUint32(record[LogRecOfsCount:], uint32(count))
+
+	length := len(record) + LogRecChecksumSize
+	bo.PutUint64(record[LogRecOfsLength:], uint64(length))
+
+	var checksum [LogRecChecksumSize]byte
+	pt.hash.Data(record, checksum[:0])
+
+	return append(record, checksum[:]...), nil
+}
+
+// appendDelta appends the delta runs that transform the data old into
+// data into the buffer buf. A nil old specifies an all-zero page.
+func appendDelta(buf, old, data []byte) []byte {
+	changed := func(i int) bool {
+		if old == nil {
+			return data[i] != 0
+		}
+		return data[i] != old[i]
+	}
+	type run struct {
+		start, end int
+	}
+	var runs []run
+	for i := 0; i < len(data); i++ {
+		if !changed(i) {
+			continue
+		}
+		if len(runs) > 0 && i-runs[len(runs)-1].end <= logRunGap {
+			runs[len(runs)-1].end = i + 1
+		} else {
+			runs = append(runs, run{
+				start: i,
+				end:   i + 1,
+			})
+		}
+	}
+	buf = bo.AppendUint32(buf, uint32(len(runs)))
+	for _, r := range runs {
+		buf = bo.AppendUint32(buf, uint32(r.start))
+		buf = bo.AppendUint32(buf, uint32(r.end-r.start))
+		buf = append(buf, data[r.start:r.end]...)
+	}
+	return buf
+}
+
+// applyDelta applies the delta runs from the buffer buf into data and
+// returns the remaining buffer.
+func applyDelta(buf, data []byte) ([]byte, error) {
+	if len(buf) < 4 {
+		return nil, fmt.Errorf("truncated log entry")
+	}
+	count := bo.Uint32(buf)
+	buf = buf[4:]
+	for ; count > 0; count-- {
+		if len(buf) < 8 {
+			return nil, fmt.Errorf("truncated log entry")
+		}
+		ofs := int(bo.Uint32(buf))
+		size := int(bo.Uint32(buf[4:]))
+		buf = buf[8:]
+		if size > len(buf) || ofs+size > len(data) {
+			return nil, fmt.Errorf("invalid log entry run %v+%v", ofs, size)
+		}
+		copy(data[ofs:], buf[:size])
+		buf = buf[size:]
+	}
+	return buf, nil
+}
+
+// replayLog replays the transactions from the write-ahead log that
+// are newer than the root pointer of the device.
+func (pt *PageTable) replayLog() error {
+	log, err := pt.readLog()
+	if err != nil {
+		return err
+	}
+	size := int64(len(log))
+
+	pt.replaying = true
+	defer func() {
+		pt.replaying = false
+	}()
+
+	var ofs int64
+	for ofs+LogRecHeaderSize <= size {
+		hdr := log[ofs:]
+		if bo.Uint32(hdr[LogRecOfsMagic:]) != LogRecMagic {
+			break
+		}
+		length := int64(bo.Uint64(hdr[LogRecOfsLength:]))
+		if length < LogRecHeaderSize+LogRecChecksumSize ||
+			length > size-ofs {
+			break
+		}
+		record := hdr[:length]
+		data := record[:length-LogRecChecksumSize]
+
+		var checksum [LogRecChecksumSize]byte
+		pt.hash.Data(data, checksum[:0])
+		if !bytes.Equal(checksum[:], record[len(data):]) {
+			break
+		}
+		gen := bo.Uint64(hdr[LogRecOfsGeneration:])
+		if gen <= pt.root0.Generation {
+			// Checkpointed record. The records following it are
+			// replayed only if they continue the generations of
+			// the device.
+			ofs += length
+			continue
+		}
+		if gen != pt.root0.Generation+1 {
+			break
+		}
+		err = pt.replayRecord(data)
+		if err != nil {
+			return err
+		}
+		ofs += length
+		pt.logOffset = ofs
+	}
+	return nil
+}
+
+// readLog reads the write-ahead log from the device. The log pages
+// after the end of the device are empty and they are not read.
+func (pt *PageTable) readLog() ([]byte, error) {
+	const chunkSize = 1024 * 1024
+
+	size := pt.logSize()
+	start := pt.logStart()
+	var log []byte
+
+	for int64(len(log)) < size {
+		chunk := make([]byte, min(size-int64(len(log)), chunkSize))
+		n, err := pt.db.device.ReadAt(chunk, start+int64(len(log)))
+		log = append(log, chunk[:n]...)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return log, nil
+}
+
+// replayRecord applies the changes of the log record data.
+func (pt *PageTable) replayRecord(data []byte) error {
+	tr, err := pt.newTransaction(true)
+	if err != nil {
+		return err
+	}
+	tr.cache = pt.db.cache
+
+	pt.nextLogical = max(pt.nextLogical,
+		bo.Uint64(data[LogRecOfsNextLogical:]))
+
+	count := bo.Uint32(data[LogRecOfsCount:])
+	buf := data[LogRecHeaderSize:]
+
+	for ; count > 0; count-- {
+		if len(buf) < 9 {
+			pt.abort(tr)
+			return fmt.Errorf("truncated log record")
+		}
+		entryType := buf[0]
+		id := LogicalID(bo.Uint64(buf[1:]))
+		buf = buf[9:]
+
+		var ref *PageRef
+		switch {
+		case entryType == LogEntryDrop:
+			err = pt.checkObjectID(id.ObjectID())
+			if err == nil {
+				err = pt.dropObject(tr, id.ObjectID())
+			}
+		case id.Pagenum() == 0:
+			err = fmt.Errorf("invalid log entry page %v", id)
+		case entryType == LogEntryNew:
+			ref, _, err = tr.newPage(id)
+		case entryType == LogEntryUpdate:
+			ref, err = tr.writablePage(id)
+		default:
+			err = fmt.Errorf("invalid log entry type %v", entryType)
+		}
+		if err == nil && ref != nil {
+			buf, err = applyDelta(buf, ref.Data())
+			ref.release()
+		}
+		if err != nil {
+			pt.abort(tr)
+			return err
+		}
+	}
+	return pt.commit(tr)
+}
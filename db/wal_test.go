@@ -0,0 +1,165 @@
+//
+// Copyright (c) 2024 Markku Rossi
+//
+// All rights reserved.
+//
+
+package db
+
+import (
+	"testing"
+)
+
+func TestWAL(t *testing.T) {
+	params := NewParams()
+	params.PageSize = 1024
+	params.WAL = true
+	params.WALSize = 64 * 1024
+
+	device := &recordingDevice{
+		MemDevice: NewMemDevice(4 * 1024 * 1024),
+	}
+	db, err := Create(params, device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := db.Root()
+	if root.Log == 0 || root.LogPages != 64 {
+		t.Fatalf("invalid log region %v+%v", root.Log, root.LogPages)
+	}
+	ids := writeTestPages(t, db, nil, 100, 1)
+
+	// Small updates write only a small log record.
+	device.writes = nil
+	err = db.Update(func(tr *BaseTransaction) error {
+		ref, err := tr.WritablePage(ids[5])
+		if err != nil {
+			return err
+		}
+		defer ref.Release()
+		buf := ref.Data()
+		for i := 8; i < 16; i++ {
+			buf[i] = 2
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(device.writes) != 1 {
+		t.Fatalf("WAL commit wrote %v times: %v",
+			len(device.writes), device.writes)
+	}
+	w := device.writes[0]
+	logStart := int64(root.Log.Pagenum()) * int64(params.PageSize)
+	if w.off < logStart || w.size > 128 {
+		t.Errorf("invalid WAL write %v", w)
+	}
+
+	checkData := func(db *DB) {
+		verifyTestPages(t, db, ids[:5], 1)
+		verifyTestPages(t, db, ids[6:], 1)
+		err := db.View(func(tr *BaseTransaction) error {
+			ref, err := tr.ReadablePage(ids[5])
+			if err != nil {
+				return err
+			}
+			defer ref.Release()
+			buf := ref.Read()
+			if buf[8] != 2 || buf[15] != 2 || buf[16] != 1 {
+				t.Errorf("invalid updated page data: %v", buf[:20])
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkData(db)
+
+	// Reopen without checkpoint replays the log.
+	gen := db.Root().Generation
+	db, err = Open(params, device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.Root().Generation != gen {
+		t.Errorf("replayed generation %v, expected %v",
+			db.Root().Generation, gen)
+	}
+	checkData(db)
+
+	// Checkpoint advances the root pointer of the device.
+	err = db.Checkpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	onDevice, err := readRoot(params, device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if onDevice.Generation != gen {
+		t.Errorf("checkpoint generation %v, expected %v",
+			onDevice.Generation, gen)
+	}
+	if db.pt.logOffset != 0 {
+		t.Errorf("log not emptied by checkpoint")
+	}
+	updated := writeTestPages(t, db, ids[:1:1], 5, 3)
+
+	db, err = Open(params, device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyTestPages(t, db, updated, 3)
+	verifyTestPages(t, db, ids[6:], 1)
+}
+
+func TestWALOverflow(t *testing.T) {
+	params := NewParams()
+	params.PageSize = 1024
+	params.WAL = true
+	params.WALSize = 4 * 1024
+	params.ObjectTables = true
+
+	device := NewMemDevice(4 * 1024 * 1024)
+	db, err := Create(params, device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := writeTestPages(t, db, nil, 10, 1)
+	objs := writeObjectPages(t, db, 1, 1, 2)
+	err = db.Update(func(tr *BaseTransaction) error {
+		return tr.DropObject(1)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	more := writeObjectPages(t, db, 2, 1, 3)
+	if db.pt.logOffset == 0 {
+		t.Fatalf("transactions not logged")
+	}
+
+	db, err = Open(params, device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyTestPages(t, db, ids, 1)
+	verifyTestPages(t, db, more, 3)
+	err = db.View(func(tr *BaseTransaction) error {
+		_, err := tr.ReadablePage(objs[0])
+		if err == nil {
+			t.Errorf("dropped object page is readable")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	params.Compression = true
+	_, err = Create(params, NewMemDevice(1024*1024))
+	if err == nil {
+		t.Errorf("Create succeeded with WAL and compression")
+	}
+}